@@ -22,7 +22,31 @@ func TestString(t *testing.T) {
 			},
 		},
 	}
-	if program.String() != "let myVar = anotherVar;" {
+	if program.String() != "mut myVar = anotherVar;" {
 		t.Errorf("program.String() wrong. got=%q", program.String())
 	}
 }
+
+func TestIndexAssignmentRoot(t *testing.T) {
+	ident := func(name string) *Identifier {
+		return &Identifier{Token: token.Token{Type: token.IDENT, Literal: name}, Value: name}
+	}
+	tests := []struct {
+		target   Expression
+		expected string
+	}{
+		{&IndexExpression{Left: ident("a"), Index: ident("i")}, "a"},
+		{&IndexExpression{Left: &ModuleExpression{Left: ident("h"), Index: ident("k")}, Index: ident("i")}, "h"},
+		{&IndexExpression{Left: &CallExpression{Function: ident("f")}, Index: ident("i")}, ""},
+	}
+	for _, tt := range tests {
+		root := (&IndexAssignmentStatement{Target: tt.target}).Root()
+		got := ""
+		if root != nil {
+			got = root.Value
+		}
+		if got != tt.expected {
+			t.Errorf("Root() of %s = %q, want %q", tt.target.String(), got, tt.expected)
+		}
+	}
+}
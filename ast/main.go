@@ -10,6 +10,7 @@ import (
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Pos() token.Position
 }
 
 type Statement interface {
@@ -22,6 +23,21 @@ type Expression interface {
 	expressionNode()
 }
 
+// Documented is implemented by statements that can carry `///` doc comments.
+type Documented interface {
+	Documentation() string
+	SetDoc(doc string)
+}
+
+// DocComment holds the `///` lines written directly above a statement,
+// joined with newlines and without the leading slashes.
+type DocComment struct {
+	Doc string
+}
+
+func (d *DocComment) Documentation() string { return d.Doc }
+func (d *DocComment) SetDoc(doc string)     { d.Doc = doc }
+
 type Program struct {
 	Node
 	Statements []Statement
@@ -35,6 +51,13 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Position{}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -46,7 +69,9 @@ func (p *Program) String() string {
 }
 
 type Module struct {
+	DocComment
 	Node
+	Token      token.Token // the 'module' token
 	Name       string
 	Path       string
 	Statements []Statement
@@ -58,6 +83,8 @@ func (p *Module) TokenLiteral() string {
 	return p.Name
 }
 
+func (p *Module) Pos() token.Position { return p.Token.Pos }
+
 type ImportModule struct {
 	Module Module
 	Path   string
@@ -69,6 +96,8 @@ func (p *ImportModule) TokenLiteral() string {
 	return p.Module.Name
 }
 
+func (p *ImportModule) Pos() token.Position { return p.Module.Pos() }
+
 type ImportExpression struct {
 	Token    token.Token // 'import'
 	FilePath string
@@ -76,6 +105,7 @@ type ImportExpression struct {
 
 func (ie *ImportExpression) expressionNode()      {}
 func (ie *ImportExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *ImportExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *ImportExpression) String() string       { return "import \"" + ie.FilePath + "\"" }
 
 type ModuleLiteral struct {
@@ -85,6 +115,7 @@ type ModuleLiteral struct {
 
 func (hl *ModuleLiteral) expressionNode()      {}
 func (hl *ModuleLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *ModuleLiteral) Pos() token.Position  { return hl.Token.Pos }
 func (hl *ModuleLiteral) String() string {
 	return hl.Name
 }
@@ -100,6 +131,7 @@ func (p *Module) String() string {
 }
 
 type MutStatement struct {
+	DocComment
 	Token token.Token
 	Name  *Identifier
 	Value Expression
@@ -107,6 +139,7 @@ type MutStatement struct {
 
 func (ls *MutStatement) statementNode()       {}
 func (ls *MutStatement) TokenLiteral() string { return ls.Token.Literal }
+func (ls *MutStatement) Pos() token.Position  { return ls.Token.Pos }
 func (ls *MutStatement) String() string {
 	var out bytes.Buffer
 
@@ -122,6 +155,7 @@ func (ls *MutStatement) String() string {
 }
 
 type ConstStatement struct {
+	DocComment
 	Token    token.Token
 	Name     *Identifier
 	Value    Expression
@@ -130,6 +164,7 @@ type ConstStatement struct {
 
 func (cs *ConstStatement) statementNode()       {}
 func (cs *ConstStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ConstStatement) Pos() token.Position  { return cs.Token.Pos }
 func (cs *ConstStatement) String() string {
 	var out bytes.Buffer
 
@@ -145,6 +180,7 @@ func (cs *ConstStatement) String() string {
 }
 
 type AssignmentStatement struct {
+	DocComment
 	Token token.Token
 	Name  *Identifier
 	Value Expression
@@ -152,6 +188,7 @@ type AssignmentStatement struct {
 
 func (ls *AssignmentStatement) statementNode()       {}
 func (ls *AssignmentStatement) TokenLiteral() string { return ls.Token.Literal }
+func (ls *AssignmentStatement) Pos() token.Position  { return ls.Token.Pos }
 func (ls *AssignmentStatement) String() string {
 	var out bytes.Buffer
 
@@ -166,6 +203,48 @@ func (ls *AssignmentStatement) String() string {
 	return out.String()
 }
 
+// IndexAssignmentStatement assigns through an index or member access:
+// `arr[i] = v`, `hash["k"] = v` or `hash.k = v`.
+type IndexAssignmentStatement struct {
+	DocComment
+	Token  token.Token // the = token
+	Target Expression  // *IndexExpression or *ModuleExpression
+	Value  Expression
+}
+
+func (is *IndexAssignmentStatement) statementNode()       {}
+func (is *IndexAssignmentStatement) TokenLiteral() string { return is.Token.Literal }
+func (is *IndexAssignmentStatement) Pos() token.Position  { return is.Target.Pos() }
+
+// Root returns the variable an assignment ends up modifying, such as a in
+// `a.b[0] = v`, or nil when the target does not start with one.
+func (is *IndexAssignmentStatement) Root() *Identifier {
+	target := is.Target
+	for {
+		switch t := target.(type) {
+		case *IndexExpression:
+			target = t.Left
+		case *ModuleExpression:
+			target = t.Left
+		case *Identifier:
+			return t
+		default:
+			return nil
+		}
+	}
+}
+
+func (is *IndexAssignmentStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(is.Target.String())
+	out.WriteString(" = ")
+	if is.Value != nil {
+		out.WriteString(is.Value.String())
+	}
+	out.WriteString(";")
+	return out.String()
+}
+
 type Identifier struct {
 	Token token.Token
 	Value string
@@ -173,15 +252,18 @@ type Identifier struct {
 
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
+func (i *Identifier) Pos() token.Position  { return i.Token.Pos }
 func (i *Identifier) String() string       { return i.Value }
 
 type ReturnStatement struct {
+	DocComment
 	Token       token.Token
 	ReturnValue Expression
 }
 
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *ReturnStatement) Pos() token.Position  { return rs.Token.Pos }
 
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
@@ -193,13 +275,127 @@ func (rs *ReturnStatement) String() string {
 	return out.String()
 }
 
+type WhileStatement struct {
+	DocComment
+	Token     token.Token // the 'while' token
+	Condition Expression
+	Body      *BlockStatement
+}
+
+func (ws *WhileStatement) statementNode()       {}
+func (ws *WhileStatement) TokenLiteral() string { return ws.Token.Literal }
+func (ws *WhileStatement) Pos() token.Position  { return ws.Token.Pos }
+func (ws *WhileStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("while ")
+	out.WriteString(ws.Condition.String())
+	out.WriteString(" ")
+	out.WriteString(ws.Body.String())
+	return out.String()
+}
+
+// ForInStatement iterates over an array, hash or range.
+// Key is nil for the single variable form `for (x in xs)`.
+type ForInStatement struct {
+	DocComment
+	Token    token.Token // the 'for' token
+	Key      *Identifier
+	Value    *Identifier
+	Iterable Expression
+	Body     *BlockStatement
+}
+
+func (fs *ForInStatement) statementNode()       {}
+func (fs *ForInStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *ForInStatement) Pos() token.Position  { return fs.Token.Pos }
+func (fs *ForInStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("for (")
+	if fs.Key != nil {
+		out.WriteString(fs.Key.String())
+		out.WriteString(", ")
+	}
+	out.WriteString(fs.Value.String())
+	out.WriteString(" in ")
+	out.WriteString(fs.Iterable.String())
+	out.WriteString(") ")
+	out.WriteString(fs.Body.String())
+	return out.String()
+}
+
+type BreakStatement struct {
+	Token token.Token
+}
+
+func (bs *BreakStatement) statementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) Pos() token.Position  { return bs.Token.Pos }
+func (bs *BreakStatement) String() string       { return "break;" }
+
+type ContinueStatement struct {
+	Token token.Token
+}
+
+func (cs *ContinueStatement) statementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) Pos() token.Position  { return cs.Token.Pos }
+func (cs *ContinueStatement) String() string       { return "continue;" }
+
+// TryStatement runs Block and hands a raised error to Catch, bound to
+// Param when given. Finally always runs last. Either Catch or Finally
+// may be nil, but not both.
+type TryStatement struct {
+	DocComment
+	Token   token.Token // the 'try' token
+	Block   *BlockStatement
+	Param   *Identifier
+	Catch   *BlockStatement
+	Finally *BlockStatement
+}
+
+func (ts *TryStatement) statementNode()       {}
+func (ts *TryStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *TryStatement) Pos() token.Position  { return ts.Token.Pos }
+func (ts *TryStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("try ")
+	out.WriteString(ts.Block.String())
+	if ts.Catch != nil {
+		out.WriteString(" catch ")
+		if ts.Param != nil {
+			out.WriteString("(" + ts.Param.String() + ") ")
+		}
+		out.WriteString(ts.Catch.String())
+	}
+	if ts.Finally != nil {
+		out.WriteString(" finally ")
+		out.WriteString(ts.Finally.String())
+	}
+	return out.String()
+}
+
+type ThrowStatement struct {
+	DocComment
+	Token token.Token // the 'throw' token
+	Value Expression
+}
+
+func (ts *ThrowStatement) statementNode()       {}
+func (ts *ThrowStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *ThrowStatement) Pos() token.Position  { return ts.Token.Pos }
+func (ts *ThrowStatement) String() string {
+	return "throw " + ts.Value.String() + ";"
+}
+
 type ExpressionStatement struct {
+	DocComment
 	Token      token.Token // first token of the expression
 	Expression Expression
 }
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExpressionStatement) Pos() token.Position  { return es.Token.Pos }
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -214,6 +410,7 @@ type IntegerLiteral struct {
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() token.Position  { return il.Token.Pos }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
 type PrefixExpression struct {
@@ -229,10 +426,12 @@ type FloatLiteral struct {
 
 func (il *FloatLiteral) expressionNode()      {}
 func (il *FloatLiteral) TokenLiteral() string { return il.Token.Literal }
+func (il *FloatLiteral) Pos() token.Position  { return il.Token.Pos }
 func (il *FloatLiteral) String() string       { return il.Token.Literal }
 
 func (pe *PrefixExpression) expressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() token.Position  { return pe.Token.Pos }
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -251,6 +450,7 @@ type InfixExpression struct {
 
 func (oe *InfixExpression) expressionNode()      {}
 func (oe *InfixExpression) TokenLiteral() string { return oe.Token.Literal }
+func (oe *InfixExpression) Pos() token.Position  { return oe.Token.Pos }
 func (oe *InfixExpression) String() string {
 	var out bytes.Buffer
 
@@ -269,6 +469,7 @@ type Boolean struct {
 
 func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
+func (b *Boolean) Pos() token.Position  { return b.Token.Pos }
 func (b *Boolean) String() string       { return b.Token.Literal }
 
 type IfExpression struct {
@@ -280,6 +481,7 @@ type IfExpression struct {
 
 func (ie *IfExpression) expressionNode()      {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("if")
@@ -301,6 +503,7 @@ type BlockStatement struct {
 
 func (bs *BlockStatement) statementNode()       {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BlockStatement) Pos() token.Position  { return bs.Token.Pos }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 	for _, s := range bs.Statements {
@@ -313,10 +516,12 @@ type FunctionLiteral struct {
 	Token      token.Token // The 'fn' token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	Name       string // set when the literal is bound by mut or const
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
 func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FunctionLiteral) Pos() token.Position  { return fl.Token.Pos }
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 	params := []string{}
@@ -339,6 +544,7 @@ type CallExpression struct {
 
 func (ce *CallExpression) expressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() token.Position  { return ce.Token.Pos }
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 	args := []string{}
@@ -359,8 +565,35 @@ type StringLiteral struct {
 
 func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() token.Position  { return sl.Token.Pos }
 func (sl *StringLiteral) String() string       { return sl.Token.Literal }
 
+// TemplateLiteral is a string with ${...} interpolations. Parts alternate
+// freely between *StringLiteral text and the embedded expressions.
+type TemplateLiteral struct {
+	Token token.Token
+	Parts []Expression
+}
+
+func (tl *TemplateLiteral) expressionNode()      {}
+func (tl *TemplateLiteral) TokenLiteral() string { return tl.Token.Literal }
+func (tl *TemplateLiteral) Pos() token.Position  { return tl.Token.Pos }
+func (tl *TemplateLiteral) String() string {
+	var out bytes.Buffer
+	out.WriteString("\"")
+	for _, part := range tl.Parts {
+		if str, ok := part.(*StringLiteral); ok {
+			out.WriteString(str.Value)
+			continue
+		}
+		out.WriteString("${")
+		out.WriteString(part.String())
+		out.WriteString("}")
+	}
+	out.WriteString("\"")
+	return out.String()
+}
+
 type ArrayLiteral struct {
 	Token    token.Token
 	Elements []Expression
@@ -368,6 +601,7 @@ type ArrayLiteral struct {
 
 func (al *ArrayLiteral) expressionNode()      {}
 func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
+func (al *ArrayLiteral) Pos() token.Position  { return al.Token.Pos }
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 	elements := []string{}
@@ -388,6 +622,7 @@ type IndexExpression struct {
 
 func (ie *IndexExpression) expressionNode()      {}
 func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -406,6 +641,7 @@ type ModuleExpression struct {
 
 func (ie *ModuleExpression) expressionNode()      {}
 func (ie *ModuleExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *ModuleExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *ModuleExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -423,6 +659,7 @@ type HashLiteral struct {
 
 func (hl *HashLiteral) expressionNode()      {}
 func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *HashLiteral) Pos() token.Position  { return hl.Token.Pos }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 	pairs := []string{}
@@ -1,6 +1,10 @@
 package code
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/pecet3/hmbk-script/token"
+)
 
 func TestMake(t *testing.T) {
 	tests := []struct {
@@ -9,7 +13,13 @@ func TestMake(t *testing.T) {
 		expected []byte
 	}{
 		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
-		{OpAdd, []int{}, []byte{byte(OpAdd)}}}
+		{OpAdd, []int{}, []byte{byte(OpAdd)}},
+		{OpIterNext, []int{65534, 2}, []byte{byte(OpIterNext), 255, 254, 2}},
+		{OpConstant, []int{65536}, []byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0}},
+		{OpClosure, []int{70000, 3}, []byte{byte(OpWide), byte(OpClosure), 0, 1, 17, 112, 0, 3}},
+		{OpClosure, []int{1, 300}, []byte{byte(OpWide), byte(OpClosure), 0, 0, 0, 1, 1, 44}},
+		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 1, 0}}}
 	for _, tt := range tests {
 		instruction := Make(tt.op, tt.operands...)
 		if len(instruction) != len(tt.expected) {
@@ -30,10 +40,16 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpAdd),
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
+		Make(OpIterNext, 12, 1),
+		Make(OpConstant, 65536),
+		MakeWide(OpJump, 3),
 	}
 	expected := `0000 OpAdd
 0001 OpConstant 2
 0004 OpConstant 65535
+0007 OpIterNext 12 1
+0011 OpWide OpConstant 65536
+0017 OpWide OpJump 3
 `
 	concatted := Instructions{}
 	for _, ins := range instructions {
@@ -45,6 +61,18 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsStringInvalid(t *testing.T) {
+	ins := Instructions{255, byte(OpPop), byte(OpConstant), 1}
+	expected := `0000 ERROR: opcode 255 undefined
+0001 OpPop
+0002 ERROR: OpConstant: truncated operands
+0003 OpAdd
+`
+	if ins.String() != expected {
+		t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", expected, ins.String())
+	}
+}
+
 func TestReadOperands(t *testing.T) {
 	tests := []struct {
 		op        Opcode
@@ -52,6 +80,7 @@ func TestReadOperands(t *testing.T) {
 		bytesRead int
 	}{
 		{OpConstant, []int{65535}, 2},
+		{OpIterNext, []int{65535, 255}, 3},
 	}
 	for _, tt := range tests {
 		instruction := Make(tt.op, tt.operands...)
@@ -71,3 +100,48 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestReadInstructionWide(t *testing.T) {
+	ins := Instructions(append(Make(OpPop), MakeWide(OpIterNext, 70000, 2)...))
+	op, operands, size, err := ReadInstruction(ins, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if op != OpIterNext || size != 8 || len(operands) != 2 || operands[0] != 70000 || operands[1] != 2 {
+		t.Errorf("wrong instruction. got op=%s operands=%v size=%d", op, operands, size)
+	}
+	_, _, _, err = ReadInstruction(ins[:len(ins)-1], 1)
+	if err == nil {
+		t.Errorf("expected an error for truncated wide operands")
+	}
+}
+
+func TestPositions(t *testing.T) {
+	at := func(line int) token.Position { return token.Position{Line: line, Column: 1} }
+	var p Positions
+	p = p.Add(0, at(1))
+	p = p.Add(3, at(1)) // same position, no new entry
+	p = p.Add(5, at(2))
+	p = p.Add(9, at(3))
+	p = p.Truncate(9) // the instruction at 9 was removed
+	p = p.Add(9, at(4))
+	p = p.Add(9, at(5)) // replaces the entry at the same offset
+
+	if len(p) != 3 {
+		t.Fatalf("wrong number of entries. want=3, got=%d (%v)", len(p), p)
+	}
+	tests := []struct {
+		offset int
+		line   int
+	}{
+		{0, 1}, {4, 1}, {5, 2}, {8, 2}, {9, 5}, {100, 5},
+	}
+	for _, tt := range tests {
+		if got := p.At(tt.offset); got.Line != tt.line {
+			t.Errorf("At(%d) = line %d, want %d", tt.offset, got.Line, tt.line)
+		}
+	}
+	if got := Positions(nil).At(0); got.IsValid() {
+		t.Errorf("At on no positions = %v, want none", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
 type Instructions []byte
@@ -44,6 +45,51 @@ const (
 	OpCall
 	OpReturnValue
 	OpReturn
+
+	OpConcat
+
+	OpMod
+	OpPow
+	OpGreaterEqual
+	OpLessThan
+	OpLessEqual
+
+	OpIter
+	OpIterNext
+
+	OpSetIndex
+
+	OpSetupTry
+	OpPopTry
+	OpThrow
+
+	OpGetLocal
+	OpSetLocal
+	OpClosure
+	OpGetFree
+	OpSetFree
+	OpCurrentClosure
+	OpCaptureLocal
+	OpCaptureFree
+	OpGetBuiltin
+	OpGetBuiltinModule
+
+	// A variable declared in a block that has not run is unset, nil on
+	// the stack. OpCheckDefined raises the error in the constant it names
+	// when the top of the stack is unset; OpJumpDefined jumps when it is
+	// set and pops it otherwise, so the outer binding can be used instead.
+	OpCheckDefined
+	OpJumpDefined
+
+	// OpWide is a prefix: the operands of the instruction after it are
+	// twice as wide, 1-byte ones taking 2 and 2-byte ones 4. Make adds it
+	// when an operand needs it.
+	OpWide
+
+	// Superinstructions do the work of a common sequence of the
+	// instructions above in one step; see compiler.Superinstructions.
+	OpBinaryConst // OpConstant c; op, for an arithmetic op
+	OpCompareJump // op; OpJumpNotTruthy target, for a comparison op
 )
 
 type Definition struct {
@@ -77,9 +123,45 @@ var definitions = map[Opcode]*Definition{
 	OpHash:  {"OpHash", []int{2}},
 	OpIndex: {"OpIndex", []int{}},
 
-	OpCall:        {"OpCall", []int{}},
+	OpCall:        {"OpCall", []int{1}},
 	OpReturnValue: {"OpReturnValue", []int{}},
 	OpReturn:      {"OpReturn", []int{}},
+
+	OpConcat: {"OpConcat", []int{2}},
+
+	OpMod:          {"OpMod", []int{}},
+	OpPow:          {"OpPow", []int{}},
+	OpGreaterEqual: {"OpGreaterEqual", []int{}},
+	OpLessThan:     {"OpLessThan", []int{}},
+	OpLessEqual:    {"OpLessEqual", []int{}},
+
+	OpIter:     {"OpIter", []int{}},
+	OpIterNext: {"OpIterNext", []int{2, 1}},
+
+	OpSetIndex: {"OpSetIndex", []int{}},
+
+	OpSetupTry: {"OpSetupTry", []int{2}},
+	OpPopTry:   {"OpPopTry", []int{}},
+	OpThrow:    {"OpThrow", []int{}},
+
+	OpGetLocal:       {"OpGetLocal", []int{1}},
+	OpSetLocal:       {"OpSetLocal", []int{1}},
+	OpClosure:        {"OpClosure", []int{2, 1}},
+	OpGetFree:        {"OpGetFree", []int{1}},
+	OpSetFree:        {"OpSetFree", []int{1}},
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpCaptureLocal:   {"OpCaptureLocal", []int{1}},
+	OpCaptureFree:    {"OpCaptureFree", []int{1}},
+	OpGetBuiltin:     {"OpGetBuiltin", []int{1}},
+
+	OpGetBuiltinModule: {"OpGetBuiltinModule", []int{1}},
+	OpCheckDefined:     {"OpCheckDefined", []int{2}},
+	OpJumpDefined:      {"OpJumpDefined", []int{2}},
+
+	OpWide: {"OpWide", []int{}},
+
+	OpBinaryConst: {"OpBinaryConst", []int{2, 1}},
+	OpCompareJump: {"OpCompareJump", []int{2, 1}},
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -90,56 +172,169 @@ func Lookup(op byte) (*Definition, error) {
 	return def, nil
 }
 
+// Make encodes an instruction. When an operand does not fit in its slot
+// the instruction is prefixed with OpWide and all its operands take twice
+// their width.
 func Make(op Opcode, operands ...int) []byte {
 	def, ok := definitions[op]
 	if !ok {
 		return []byte{}
 	}
+	for i, o := range operands {
+		if o < 0 || o > maxOperand(def.OperandWidths[i]) {
+			return MakeWide(op, operands...)
+		}
+	}
+	return makeInstruction(op, def.OperandWidths, operands)
+}
+
+// MakeWide encodes an instruction with the OpWide prefix even if its
+// operands would fit, for jumps whose target is patched in later.
+func MakeWide(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+	return append([]byte{byte(OpWide)}, makeInstruction(op, wideWidths(def), operands)...)
+}
+
+func makeInstruction(op Opcode, widths []int, operands []int) []byte {
 	instructionLen := 1
-	for _, w := range def.OperandWidths {
+	for _, w := range widths {
 		instructionLen += w
 	}
 	instruction := make([]byte, instructionLen)
 	instruction[0] = byte(op)
 	offset := 1
 	for i, o := range operands {
-		width := def.OperandWidths[i]
+		width := widths[i]
 		switch width {
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 1:
+			instruction[offset] = byte(o)
 		}
 		offset += width
 	}
 	return instruction
 }
 
+// maxOperand returns the largest operand that fits in width bytes.
+func maxOperand(width int) int {
+	switch width {
+	case 1:
+		return math.MaxUint8
+	case 2:
+		return math.MaxUint16
+	}
+	return math.MaxUint32
+}
+
+// MaxWideOperand is the largest operand of a 1-byte slot after an OpWide
+// prefix, which bounds the locals, arguments and free variables of a
+// function.
+const MaxWideOperand = math.MaxUint16
+
+// wideWidths returns the operand widths of def after an OpWide prefix.
+func wideWidths(def *Definition) []int {
+	widths := make([]int, len(def.OperandWidths))
+	for i, w := range def.OperandWidths {
+		widths[i] = 2 * w
+	}
+	return widths
+}
+
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
-	operands := make([]int, len(def.OperandWidths))
+	return readOperands(def.OperandWidths, ins)
+}
+
+// ReadWideOperands reads the operands of an instruction that follows an
+// OpWide prefix.
+func ReadWideOperands(def *Definition, ins Instructions) ([]int, int) {
+	return readOperands(wideWidths(def), ins)
+}
+
+func readOperands(widths []int, ins Instructions) ([]int, int) {
+	operands := make([]int, len(widths))
 	offset := 0
-	for i, width := range def.OperandWidths {
+	for i, width := range widths {
 		switch width {
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
 		}
 		offset += width
 	}
 	return operands, offset
 }
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
+func ReadUint8(ins Instructions) uint8 {
+	return uint8(ins[0])
+}
+
+// ReadInstruction decodes the instruction at offset and returns its opcode,
+// operands and size in bytes. An OpWide prefix is included in the size and
+// the opcode is the one it widens. On an unknown opcode or missing operands
+// it returns an error and a size of 1, so callers listing instructions can
+// skip the byte.
+func ReadInstruction(ins Instructions, offset int) (Opcode, []int, int, error) {
+	prefix := 0
+	if Opcode(ins[offset]) == OpWide && offset+1 < len(ins) {
+		prefix = 1
+	}
+	op := Opcode(ins[offset+prefix])
+	def, err := Lookup(byte(op))
+	if err != nil {
+		return op, nil, 1, err
+	}
+	widths := def.OperandWidths
+	if prefix == 1 {
+		widths = wideWidths(def)
+	}
+	width := 0
+	for _, w := range widths {
+		width += w
+	}
+	if offset+prefix+1+width > len(ins) {
+		return op, nil, 1, fmt.Errorf("%s: truncated operands", def.Name)
+	}
+	operands, read := readOperands(widths, ins[offset+prefix+1:])
+	return op, operands, prefix + 1 + read, nil
+}
+
+func (op Opcode) String() string {
+	def, ok := definitions[op]
+	if !ok {
+		return fmt.Sprintf("Opcode(%d)", byte(op))
+	}
+	return def.Name
+}
+
 func (ins Instructions) String() string {
 	var out bytes.Buffer
 	i := 0
 	for i < len(ins) {
-		def, err := Lookup(ins[i])
+		op, operands, size, err := ReadInstruction(ins, i)
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+		} else {
+			prefix := ""
+			if Opcode(ins[i]) == OpWide {
+				prefix = "OpWide "
+			}
+			fmt.Fprintf(&out, "%04d %s%s\n", i, prefix, ins.fmtInstruction(definitions[op], operands))
 		}
-		operands, read := ReadOperands(def, ins[i+1:])
-		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
-		i += 1 + read
+		i += size
 	}
 	return out.String()
 }
@@ -154,6 +349,8 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 		return def.Name
 	case 1:
 		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
 	}
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
 }
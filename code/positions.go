@@ -0,0 +1,51 @@
+package code
+
+import (
+	"sort"
+
+	"github.com/pecet3/hmbk-script/token"
+)
+
+// Positions maps instructions back to the source they were compiled from,
+// so runtime errors can say where they happened. Entries are sorted by
+// Offset; each one covers the instructions from its Offset up to the next
+// entry's.
+type Positions []Position
+
+type Position struct {
+	Offset int
+	Pos    token.Position
+}
+
+// Add records that the instructions from offset on come from pos. An entry
+// at the same offset is replaced, as when the instruction there was removed
+// and another emitted in its place.
+func (p Positions) Add(offset int, pos token.Position) Positions {
+	if n := len(p); n > 0 {
+		if p[n-1].Offset == offset {
+			p = p[:n-1]
+		}
+	}
+	if n := len(p); n > 0 && p[n-1].Pos == pos {
+		return p
+	}
+	return append(p, Position{Offset: offset, Pos: pos})
+}
+
+// Truncate drops the entries of instructions at or after offset.
+func (p Positions) Truncate(offset int) Positions {
+	for len(p) > 0 && p[len(p)-1].Offset >= offset {
+		p = p[:len(p)-1]
+	}
+	return p
+}
+
+// At returns the source position of the instruction at offset, which may
+// also be the offset of one of its operands.
+func (p Positions) At(offset int) token.Position {
+	i := sort.Search(len(p), func(i int) bool { return p[i].Offset > offset })
+	if i == 0 {
+		return token.Position{}
+	}
+	return p[i-1].Pos
+}
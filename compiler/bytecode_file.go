@@ -0,0 +1,368 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/pecet3/hmbk-script/code"
+	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/token"
+)
+
+// A compiled script (.hmbkc) is laid out as
+//
+//	magic    "HMBKC\x00"
+//	version  uint16, big endian
+//	length   uint32, the size of the payload
+//	payload  the instructions and their positions, then the constant pool
+//	checksum uint32, CRC-32 (IEEE) of the payload
+//
+// Lengths and counts inside the payload are uvarints. Positions are a
+// count followed by the offset, file, line and column of each entry. Each
+// constant starts with a tag byte: a Number is its float64 bits, a String
+// its bytes, and a CompiledFunction its name, locals, parameters,
+// instructions and positions.
+//
+// BytecodeVersion must change whenever the payload layout or the opcodes
+// change, so a file built by another version is rejected instead of run.
+const BytecodeVersion = 7
+
+var bytecodeMagic = []byte("HMBKC\x00")
+
+const (
+	tagNumber byte = iota + 1
+	tagString
+	tagFunction
+)
+
+var ErrNotBytecode = errors.New("not a compiled hmbk script")
+
+// WriteBytecode writes b to w in the .hmbkc format.
+func WriteBytecode(w io.Writer, b *Bytecode) error {
+	var payload bytes.Buffer
+	writeBytes(&payload, b.Instructions)
+	writePositions(&payload, b.Positions)
+	writeUvarint(&payload, uint64(len(b.Constants)))
+	for i, c := range b.Constants {
+		err := writeConstant(&payload, c)
+		if err != nil {
+			return fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+
+	var out bytes.Buffer
+	out.Write(bytecodeMagic)
+	binary.Write(&out, binary.BigEndian, uint16(BytecodeVersion))
+	binary.Write(&out, binary.BigEndian, uint32(payload.Len()))
+	out.Write(payload.Bytes())
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(payload.Bytes()))
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// ReadBytecode reads a script written by WriteBytecode, checking its
+// header, version and checksum.
+func ReadBytecode(r io.Reader) (*Bytecode, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	header := len(bytecodeMagic) + 2 + 4
+	if len(data) < header || !bytes.Equal(data[:len(bytecodeMagic)], bytecodeMagic) {
+		return nil, ErrNotBytecode
+	}
+	version := binary.BigEndian.Uint16(data[len(bytecodeMagic):])
+	if version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d, want %d", version, BytecodeVersion)
+	}
+	length := binary.BigEndian.Uint32(data[len(bytecodeMagic)+2:])
+	if uint64(len(data)) != uint64(header)+uint64(length)+4 {
+		return nil, fmt.Errorf("bytecode is truncated or has trailing data")
+	}
+	payload := data[header : header+int(length)]
+	checksum := binary.BigEndian.Uint32(data[header+int(length):])
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, fmt.Errorf("bytecode checksum mismatch")
+	}
+
+	pr := bytes.NewReader(payload)
+	instructions, err := readBytes(pr)
+	if err != nil {
+		return nil, fmt.Errorf("instructions: %w", err)
+	}
+	positions, err := readPositions(pr)
+	if err != nil {
+		return nil, fmt.Errorf("positions: %w", err)
+	}
+	count, err := readCount(pr, pr.Len())
+	if err != nil {
+		return nil, fmt.Errorf("constants: %w", err)
+	}
+	constants := make([]object.Object, 0, count)
+	for i := 0; i < count; i++ {
+		c, err := readConstant(pr)
+		if err != nil {
+			return nil, fmt.Errorf("constant %d: %w", i, err)
+		}
+		constants = append(constants, c)
+	}
+	if pr.Len() != 0 {
+		return nil, fmt.Errorf("unexpected data after the constant pool")
+	}
+	b := &Bytecode{Instructions: instructions, Positions: positions, Constants: constants}
+	if err := validate(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// validate checks the code of b and of its functions the way the compiler
+// would have written it: every instruction decodes, jumps land on an
+// instruction, and the constants, globals, locals, free variables and
+// builtins they refer to exist. The VM trusts its bytecode, so a corrupt
+// file is rejected here instead of crashing it.
+func validate(b *Bytecode) error {
+	// the free variables of a function are the ones its OpClosure captures
+	numFree := map[int]int{}
+	lists := map[int][]*instruction{}
+	units := []int{-1} // the program, then its functions by constant index
+	for i, c := range b.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		if fn.NumParameters > fn.NumLocals {
+			return fmt.Errorf("constant %d: %d parameters but %d locals", i, fn.NumParameters, fn.NumLocals)
+		}
+		units = append(units, i)
+	}
+	for _, unit := range units {
+		ins, positions := b.Instructions, b.Positions
+		if unit >= 0 {
+			fn := b.Constants[unit].(*object.CompiledFunction)
+			ins, positions = fn.Instructions, fn.Positions
+		}
+		list, err := decode(ins, positions)
+		if err != nil {
+			return unitError(unit, err)
+		}
+		lists[unit] = list
+		for _, in := range list {
+			if in.op != code.OpClosure || in.operands[0] >= len(b.Constants) {
+				continue
+			}
+			if n, ok := numFree[in.operands[0]]; !ok || in.operands[1] < n {
+				numFree[in.operands[0]] = in.operands[1]
+			}
+		}
+	}
+	for _, unit := range units {
+		numLocals := 0
+		if unit >= 0 {
+			numLocals = b.Constants[unit].(*object.CompiledFunction).NumLocals
+		}
+		for _, in := range lists[unit] {
+			if err := validateOperands(in, b.Constants, numLocals, numFree[unit]); err != nil {
+				return unitError(unit, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateOperands(in *instruction, constants []object.Object, numLocals, numFree int) error {
+	var index, limit int
+	var what string
+	switch in.op {
+	case code.OpConstant, code.OpClosure, code.OpBinaryConst, code.OpCheckDefined:
+		index, limit, what = in.operands[0], len(constants), "constant"
+		if in.op == code.OpClosure && index < limit {
+			if _, ok := constants[index].(*object.CompiledFunction); !ok {
+				return fmt.Errorf("%s: constant %d is not a function", in.op, index)
+			}
+		}
+		if in.op == code.OpCheckDefined && index < limit {
+			if _, ok := constants[index].(*object.String); !ok {
+				return fmt.Errorf("%s: constant %d is not a string", in.op, index)
+			}
+		}
+	case code.OpGetGlobal, code.OpSetGlobal:
+		index, limit, what = in.operands[0], MaxGlobals, "global"
+	case code.OpGetLocal, code.OpSetLocal, code.OpCaptureLocal:
+		index, limit, what = in.operands[0], numLocals, "local"
+	case code.OpGetFree, code.OpSetFree, code.OpCaptureFree:
+		index, limit, what = in.operands[0], numFree, "free variable"
+	case code.OpGetBuiltin:
+		index, limit, what = in.operands[0], len(object.Builtins), "builtin"
+	case code.OpGetBuiltinModule:
+		index, limit, what = in.operands[0], len(object.BuiltinModules), "builtin module"
+	default:
+		return nil
+	}
+	if index >= limit {
+		return fmt.Errorf("%s: %s index %d out of range", in.op, what, index)
+	}
+	return nil
+}
+
+func unitError(unit int, err error) error {
+	if unit < 0 {
+		return fmt.Errorf("instructions: %w", err)
+	}
+	return fmt.Errorf("constant %d: %w", unit, err)
+}
+
+func writeConstant(buf *bytes.Buffer, obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Number:
+		buf.WriteByte(tagNumber)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(obj.Value))
+	case *object.String:
+		buf.WriteByte(tagString)
+		writeBytes(buf, []byte(obj.Value))
+	case *object.CompiledFunction:
+		buf.WriteByte(tagFunction)
+		writeBytes(buf, []byte(obj.Name))
+		writeUvarint(buf, uint64(obj.NumLocals))
+		writeUvarint(buf, uint64(obj.NumParameters))
+		writeBytes(buf, obj.Instructions)
+		writePositions(buf, obj.Positions)
+	default:
+		return fmt.Errorf("cannot serialize %s", obj.Type())
+	}
+	return nil
+}
+
+func readConstant(r *bytes.Reader) (object.Object, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch tag {
+	case tagNumber:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return &object.Number{Value: math.Float64frombits(bits)}, nil
+	case tagString:
+		s, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		return &object.String{Value: string(s)}, nil
+	case tagFunction:
+		name, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		numLocals, err := readCount(r, code.MaxWideOperand)
+		if err != nil {
+			return nil, err
+		}
+		numParameters, err := readCount(r, code.MaxWideOperand)
+		if err != nil {
+			return nil, err
+		}
+		instructions, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		positions, err := readPositions(r)
+		if err != nil {
+			return nil, err
+		}
+		return &object.CompiledFunction{
+			Instructions:  instructions,
+			Positions:     positions,
+			NumLocals:     numLocals,
+			NumParameters: numParameters,
+			Name:          string(name),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown constant tag %d", tag)
+	}
+}
+
+func writeUvarint(buf *bytes.Buffer, n uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], n)])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func writePositions(buf *bytes.Buffer, positions code.Positions) {
+	writeUvarint(buf, uint64(len(positions)))
+	for _, p := range positions {
+		writeUvarint(buf, uint64(p.Offset))
+		writeBytes(buf, []byte(p.Pos.File))
+		writeUvarint(buf, uint64(p.Pos.Line))
+		writeUvarint(buf, uint64(p.Pos.Column))
+	}
+}
+
+func readPositions(r *bytes.Reader) (code.Positions, error) {
+	// every entry takes at least 4 bytes
+	count, err := readCount(r, r.Len()/4)
+	if err != nil {
+		return nil, err
+	}
+	var positions code.Positions
+	for i := 0; i < count; i++ {
+		offset, err := readCount(r, math.MaxInt32)
+		if err != nil {
+			return nil, err
+		}
+		file, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		line, err := readCount(r, math.MaxInt32)
+		if err != nil {
+			return nil, err
+		}
+		column, err := readCount(r, math.MaxInt32)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, code.Position{
+			Offset: offset,
+			Pos:    token.Position{File: string(file), Line: line, Column: column},
+		})
+	}
+	return positions, nil
+}
+
+// readCount reads a uvarint no larger than max, so a corrupt count cannot
+// make us allocate more than the file could describe.
+func readCount(r *bytes.Reader, max int) (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if n > uint64(max) {
+		return 0, fmt.Errorf("count %d out of range", n)
+	}
+	return int(n), nil
+}
+
+func readBytes(r *bytes.Reader) (code.Instructions, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return b, nil
+}
@@ -0,0 +1,158 @@
+package compiler
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pecet3/hmbk-script/code"
+	"github.com/pecet3/hmbk-script/object"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	comp := New()
+	err := comp.Compile(parse(`mut add = fn(a, b) { mut c = a + b; c }; add(1.5, 2); "hello"; http.get;`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	want := comp.Bytecode()
+
+	var buf bytes.Buffer
+	if err := WriteBytecode(&buf, want); err != nil {
+		t.Fatalf("WriteBytecode: %s", err)
+	}
+	got, err := ReadBytecode(&buf)
+	if err != nil {
+		t.Fatalf("ReadBytecode: %s", err)
+	}
+	if !bytes.Equal(got.Instructions, want.Instructions) {
+		t.Errorf("instructions differ.\nwant=%s\ngot=%s", want.Instructions, got.Instructions)
+	}
+	if len(want.Positions) == 0 || !reflect.DeepEqual(got.Positions, want.Positions) {
+		t.Errorf("positions differ.\nwant=%v\ngot=%v", want.Positions, got.Positions)
+	}
+	if len(got.Constants) != len(want.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(want.Constants), len(got.Constants))
+	}
+	for i, c := range want.Constants {
+		switch c := c.(type) {
+		case *object.CompiledFunction:
+			fn, ok := got.Constants[i].(*object.CompiledFunction)
+			if !ok {
+				t.Fatalf("constant %d is not a function: %T", i, got.Constants[i])
+			}
+			if !bytes.Equal(fn.Instructions, c.Instructions) || !reflect.DeepEqual(fn.Positions, c.Positions) ||
+				fn.NumLocals != c.NumLocals || fn.NumParameters != c.NumParameters || fn.Name != c.Name {
+				t.Errorf("constant %d differs. want=%+v, got=%+v", i, c, fn)
+			}
+		default:
+			if got.Constants[i].Type() != c.Type() || got.Constants[i].Inspect() != c.Inspect() {
+				t.Errorf("constant %d differs. want=%s, got=%s", i, c.Inspect(), got.Constants[i].Inspect())
+			}
+		}
+	}
+}
+
+func TestReadBytecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteBytecode(&buf, &Bytecode{
+		Instructions: []byte{1, 2, 3},
+		Constants:    []object.Object{&object.String{Value: "s"}},
+	}); err != nil {
+		t.Fatalf("WriteBytecode: %s", err)
+	}
+	valid := buf.Bytes()
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"empty", nil, "not a compiled hmbk script"},
+		{"source", []byte(`mut a = 1;`), "not a compiled hmbk script"},
+		{"version", corrupt(func(b []byte) []byte { b[7] = 99; return b }), "unsupported bytecode version 99"},
+		{"truncated", valid[:len(valid)-1], "truncated"},
+		{"checksum", corrupt(func(b []byte) []byte { b[13]++; return b }), "checksum mismatch"},
+	}
+	for _, tt := range tests {
+		_, err := ReadBytecode(bytes.NewReader(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected error %q, got=%v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestWriteBytecodeRejectsUnknownConstants(t *testing.T) {
+	err := WriteBytecode(&bytes.Buffer{}, &Bytecode{Constants: []object.Object{&object.Bool{Value: true}}})
+	if err == nil || !strings.Contains(err.Error(), "cannot serialize BOOL") {
+		t.Errorf("expected serialize error, got=%v", err)
+	}
+}
+
+func TestReadBytecodeValidates(t *testing.T) {
+	fn := func(numLocals int, ins ...code.Instructions) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: concatInstructions(ins), NumLocals: numLocals}
+	}
+	tests := []struct {
+		name     string
+		bytecode *Bytecode
+		expected string
+	}{
+		{"constant", &Bytecode{Instructions: code.Make(code.OpConstant, 1), Constants: []object.Object{&object.Number{}}},
+			"instructions: OpConstant: constant index 1 out of range"},
+		{"binary constant", &Bytecode{Instructions: concatInstructions([]code.Instructions{code.Make(code.OpTrue), code.Make(code.OpBinaryConst, 3, int(code.OpAdd))})},
+			"instructions: OpBinaryConst: constant index 3 out of range"},
+		{"closure", &Bytecode{Instructions: code.Make(code.OpClosure, 0, 0), Constants: []object.Object{&object.Number{}}},
+			"instructions: OpClosure: constant 0 is not a function"},
+		{"global", &Bytecode{Instructions: concatInstructions([]code.Instructions{code.Make(code.OpTrue), code.Make(code.OpSetGlobal, 0xFFFFFFFF)})},
+			"instructions: OpSetGlobal: global index 4294967295 out of range"},
+		{"builtin", &Bytecode{Instructions: code.Make(code.OpGetBuiltin, 200)},
+			"instructions: OpGetBuiltin: builtin index 200 out of range"},
+		{"builtin module", &Bytecode{Instructions: code.Make(code.OpGetBuiltinModule, 200)},
+			"instructions: OpGetBuiltinModule: builtin module index 200 out of range"},
+		{"jump", &Bytecode{Instructions: code.Make(code.OpJump, 2)},
+			"instructions: jump to 0002 is not the start of an instruction"},
+		{"truncated", &Bytecode{Instructions: []byte{byte(code.OpConstant), 0}},
+			"instructions: 0000: OpConstant: truncated operands"},
+		{"unknown opcode", &Bytecode{Instructions: []byte{255}},
+			"instructions: 0000: opcode 255 undefined"},
+		{"program local", &Bytecode{Instructions: code.Make(code.OpGetLocal, 0)},
+			"instructions: OpGetLocal: local index 0 out of range"},
+		{"function local", &Bytecode{
+			Instructions: code.Make(code.OpClosure, 0, 0),
+			Constants:    []object.Object{fn(1, code.Make(code.OpGetLocal, 1), code.Make(code.OpReturnValue))},
+		}, "constant 0: OpGetLocal: local index 1 out of range"},
+		{"free", &Bytecode{
+			Instructions: concatInstructions([]code.Instructions{code.Make(code.OpNull), code.Make(code.OpClosure, 0, 1)}),
+			Constants:    []object.Object{fn(0, code.Make(code.OpGetFree, 1), code.Make(code.OpReturnValue))},
+		}, "constant 0: OpGetFree: free variable index 1 out of range"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WriteBytecode(&buf, tt.bytecode); err != nil {
+			t.Fatalf("%s: WriteBytecode: %s", tt.name, err)
+		}
+		_, err := ReadBytecode(&buf)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("%s: expected error %q, got=%v", tt.name, tt.expected, err)
+		}
+	}
+
+	// what the compiler writes is always valid
+	comp := New()
+	err := comp.Compile(parse(`mut make = fn(a) { mut b = 1; fn(c) { a + b + c } }; make(1)(2); len([]); http.get;`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteBytecode(&buf, comp.Bytecode()); err != nil {
+		t.Fatalf("WriteBytecode: %s", err)
+	}
+	if _, err := ReadBytecode(&buf); err != nil {
+		t.Errorf("ReadBytecode: %s", err)
+	}
+}
@@ -0,0 +1,139 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pecet3/hmbk-script/code"
+	"github.com/pecet3/hmbk-script/object"
+)
+
+// Disassemble writes a listing of b: the main program, the constant pool
+// and then every compiled function in it. Instructions are annotated with
+// constant values, builtin names, jump targets and, when symbols is not
+// nil, the names of globals. Lines that are jumped to are marked with >.
+func Disassemble(w io.Writer, b *Bytecode, symbols *SymbolTable) {
+	var globals map[int]string
+	if symbols != nil {
+		globals = symbols.GlobalNames()
+	}
+	d := &disassembler{w: w, constants: b.Constants, globals: globals}
+
+	d.listing("main", b.Instructions)
+	if len(b.Constants) > 0 {
+		fmt.Fprintf(w, "\n== constants ==\n")
+		for i, c := range b.Constants {
+			fmt.Fprintf(w, "%4d %s\n", i, d.constant(c))
+		}
+	}
+	for i, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			title := fmt.Sprintf("%s (constant %d, %d params, %d locals)",
+				functionName(fn), i, fn.NumParameters, fn.NumLocals)
+			fmt.Fprintln(w)
+			d.listing(title, fn.Instructions)
+		}
+	}
+}
+
+type disassembler struct {
+	w         io.Writer
+	constants []object.Object
+	globals   map[int]string
+}
+
+func (d *disassembler) listing(title string, ins code.Instructions) {
+	fmt.Fprintf(d.w, "== %s ==\n", title)
+	targets := jumpTargets(ins)
+	for i := 0; i < len(ins); {
+		op, operands, size, err := code.ReadInstruction(ins, i)
+		marker := " "
+		if targets[i] {
+			marker = ">"
+		}
+		if err != nil {
+			fmt.Fprintf(d.w, "%s %04d ERROR: %s\n", marker, i, err)
+			i += size
+			continue
+		}
+		text := op.String()
+		if code.Opcode(ins[i]) == code.OpWide {
+			text = "OpWide " + text
+		}
+		for _, o := range operands {
+			text += fmt.Sprintf(" %d", o)
+		}
+		if note := d.annotate(op, operands); note != "" {
+			fmt.Fprintf(d.w, "%s %04d %-24s ; %s\n", marker, i, text, note)
+		} else {
+			fmt.Fprintf(d.w, "%s %04d %s\n", marker, i, text)
+		}
+		i += size
+	}
+}
+
+func (d *disassembler) annotate(op code.Opcode, operands []int) string {
+	switch op {
+	case code.OpConstant, code.OpCheckDefined:
+		return d.constantValue(operands[0])
+	case code.OpBinaryConst:
+		return fmt.Sprintf("%s %s", code.Opcode(operands[1]), d.constantValue(operands[0]))
+	case code.OpClosure:
+		return fmt.Sprintf("%s, %d free", d.constantValue(operands[0]), operands[1])
+	case code.OpGetGlobal, code.OpSetGlobal:
+		return d.globals[operands[0]]
+	case code.OpGetBuiltin:
+		if operands[0] < len(object.Builtins) {
+			return object.Builtins[operands[0]].Name
+		}
+	case code.OpGetBuiltinModule:
+		if operands[0] < len(object.BuiltinModules) {
+			return object.BuiltinModules[operands[0]]
+		}
+	case code.OpJump, code.OpJumpNotTruthy, code.OpSetupTry, code.OpIterNext, code.OpJumpDefined:
+		return fmt.Sprintf("-> %04d", operands[0])
+	case code.OpCompareJump:
+		return fmt.Sprintf("%s, -> %04d if false", code.Opcode(operands[1]), operands[0])
+	}
+	return ""
+}
+
+func (d *disassembler) constantValue(index int) string {
+	if index >= len(d.constants) {
+		return fmt.Sprintf("<constant %d out of range>", index)
+	}
+	return d.constant(d.constants[index])
+}
+
+func (d *disassembler) constant(c object.Object) string {
+	switch c := c.(type) {
+	case *object.String:
+		return fmt.Sprintf("%q", c.Value)
+	case *object.CompiledFunction:
+		return fmt.Sprintf("<fn %s>", functionName(c))
+	default:
+		return c.Inspect()
+	}
+}
+
+func functionName(fn *object.CompiledFunction) string {
+	if fn.Name == "" {
+		return "<anonymous>"
+	}
+	return fn.Name
+}
+
+// jumpTargets returns the offsets in ins that some instruction jumps to.
+func jumpTargets(ins code.Instructions) map[int]bool {
+	targets := map[int]bool{}
+	for i := 0; i < len(ins); {
+		op, operands, size, err := code.ReadInstruction(ins, i)
+		if err == nil {
+			if isJump(op) {
+				targets[operands[0]] = true
+			}
+		}
+		i += size
+	}
+	return targets
+}
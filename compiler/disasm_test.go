@@ -0,0 +1,59 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pecet3/hmbk-script/code"
+)
+
+func TestDisassemble(t *testing.T) {
+	comp := New()
+	err := comp.Compile(parse(`mut a = 1; const f = fn(x) { if (x) { len("s") } else { a } }; f(a);`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	expected := `== main ==
+  0000 OpConstant 0             ; 1
+  0003 OpSetGlobal 0            ; a
+  0006 OpClosure 2 0            ; <fn f>, 0 free
+  0010 OpSetGlobal 1            ; f
+  0013 OpGetGlobal 1            ; f
+  0016 OpGetGlobal 0            ; a
+  0019 OpCall 1
+  0021 OpPop
+
+== constants ==
+   0 1
+   1 "s"
+   2 <fn f>
+
+== f (constant 2, 1 params, 1 locals) ==
+  0000 OpGetLocal 0
+  0002 OpJumpNotTruthy 15       ; -> 0015
+  0005 OpGetBuiltin 6           ; len
+  0007 OpConstant 1             ; "s"
+  0010 OpCall 1
+  0012 OpJump 18                ; -> 0018
+> 0015 OpGetGlobal 0            ; a
+> 0018 OpReturnValue
+`
+	var out strings.Builder
+	Disassemble(&out, comp.Bytecode(), comp.SymbolTable())
+	if out.String() != expected {
+		t.Errorf("wrong listing.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+}
+
+func TestDisassembleWide(t *testing.T) {
+	ins := append(code.MakeWide(code.OpJump, 6), code.Make(code.OpConstant, 70000)...)
+	expected := `== main ==
+  0000 OpWide OpJump 6          ; -> 0006
+> 0006 OpWide OpConstant 70000  ; <constant 70000 out of range>
+`
+	var out strings.Builder
+	Disassemble(&out, &Bytecode{Instructions: ins}, nil)
+	if out.String() != expected {
+		t.Errorf("wrong listing.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+}
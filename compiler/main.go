@@ -7,6 +7,7 @@ import (
 	"github.com/pecet3/hmbk-script/ast"
 	"github.com/pecet3/hmbk-script/code"
 	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/token"
 )
 
 type Compiler struct {
@@ -15,12 +16,35 @@ type Compiler struct {
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	// pos is the position of the innermost node being compiled, recorded
+	// for the instructions emitted for it
+	pos token.Position
 }
 
 type CompilationScope struct {
 	instructions        code.Instructions
+	positions           code.Positions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+	loops               []*loopContext
+	tries               []*tryContext
+}
+
+// loopContext records where `continue` jumps to and the `break` jumps
+// that get patched once the end of the loop is known. tryDepth is the
+// number of try blocks already open when the loop started.
+type loopContext struct {
+	continuePos int
+	breakJumps  []int
+	tryDepth    int
+}
+
+// tryContext is a try or catch block being compiled. A `break` or
+// `continue` leaving it has to drop its handler and run its finally block.
+type tryContext struct {
+	hasHandler bool
+	finally    *ast.BlockStatement
 }
 
 type EmittedInstruction struct {
@@ -34,9 +58,13 @@ func New() *Compiler {
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
 	}
+	symbolTable := NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
 	return &Compiler{
 		constants:   []object.Object{},
-		symbolTable: NewSymbolTable(),
+		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
 	}
@@ -48,15 +76,29 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	return compiler
 }
 
+// SymbolTable returns the names defined by the compiled program.
+func (c *Compiler) SymbolTable() *SymbolTable {
+	return c.symbolTable
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
+	scope := c.scopes[c.scopeIndex]
+	instructions, positions := narrowJumps(scope.instructions, scope.positions)
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
+		Positions:    positions,
 		Constants:    c.constants,
 	}
 }
 
+// MaxGlobals bounds the number of globals of a program. The VM makes room
+// for every global up to the highest index it stores, so ReadBytecode
+// rejects larger indices.
+const MaxGlobals = 1 << 20
+
 type Bytecode struct {
 	Instructions code.Instructions
+	Positions    code.Positions // of Instructions
 	Constants    []object.Object
 }
 
@@ -68,6 +110,7 @@ func (c *Compiler) addInstruction(ins []byte) int {
 	posNewInstruction := len(c.currentInstructions())
 	updatedInstructions := append(c.currentInstructions(), ins...)
 	c.scopes[c.scopeIndex].instructions = updatedInstructions
+	c.scopes[c.scopeIndex].positions = c.scopes[c.scopeIndex].positions.Add(posNewInstruction, c.pos)
 	return posNewInstruction
 }
 
@@ -91,6 +134,11 @@ func (c *Compiler) addConstant(obj object.Object) int {
 }
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	ins := code.Make(op, operands...)
+	if isJump(op) {
+		// the target is usually patched in later, when it may no longer
+		// fit in 2 bytes; narrowJumps shrinks the jumps that do fit
+		ins = code.MakeWide(op, operands...)
+	}
 	pos := c.addInstruction(ins)
 	c.setLastInstruction(op, pos)
 	return pos
@@ -101,6 +149,7 @@ func (c *Compiler) removeLastPop() {
 	old := c.currentInstructions()
 	new := old[:last.Position]
 	c.scopes[c.scopeIndex].instructions = new
+	c.scopes[c.scopeIndex].positions = c.scopes[c.scopeIndex].positions.Truncate(last.Position)
 	c.scopes[c.scopeIndex].lastInstruction = previous
 }
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
@@ -111,10 +160,25 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 }
 func (c *Compiler) changeOperand(opPos int, operand int) {
 	op := code.Opcode(c.currentInstructions()[opPos])
+	if op == code.OpWide {
+		op = code.Opcode(c.currentInstructions()[opPos+1])
+		c.replaceInstruction(opPos, code.MakeWide(op, operand))
+		return
+	}
 	newInstruction := code.Make(op, operand)
 	c.replaceInstruction(opPos, newInstruction)
 }
 
+// narrowJumps re-encodes ins with every jump as narrow as its target
+// allows. The compiler emits all jumps wide, see emit.
+func narrowJumps(ins code.Instructions, positions code.Positions) (code.Instructions, code.Positions) {
+	list, err := decode(ins, positions)
+	if err != nil {
+		return ins, positions
+	}
+	return encode(list, nil)
+}
+
 func (c *Compiler) enterScope() {
 	scope := CompilationScope{
 		instructions:        code.Instructions{},
@@ -123,15 +187,24 @@ func (c *Compiler) enterScope() {
 	}
 	c.scopes = append(c.scopes, scope)
 	c.scopeIndex++
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
 }
-func (c *Compiler) leaveScope() code.Instructions {
-	instructions := c.currentInstructions()
+func (c *Compiler) leaveScope() (code.Instructions, code.Positions) {
+	scope := c.scopes[c.scopeIndex]
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex--
-	return instructions
+	c.symbolTable = c.symbolTable.Outer
+	return narrowJumps(scope.instructions, scope.positions)
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	// an instruction gets the position of the innermost node it was
+	// emitted for, which is where the evaluator reports its errors
+	if pos := node.Pos(); pos.IsValid() {
+		outer := c.pos
+		c.pos = pos
+		defer func() { c.pos = outer }()
+	}
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
@@ -140,6 +213,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 		}
+		if c.symbolTable.globalTable().numDefinitions > MaxGlobals {
+			return fmt.Errorf("%s: too many global variables", node.Pos())
+		}
+	case *ast.Module:
+		return c.compileModule(node)
 	case *ast.ExpressionStatement:
 		err := c.Compile(node.Expression)
 		if err != nil {
@@ -147,17 +225,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpPop)
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
-			}
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-			c.emit(code.OpGreaterThan)
-			return nil
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
 		}
 		err := c.Compile(node.Left)
 		if err != nil {
@@ -176,14 +245,24 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
+		case "**":
+			c.emit(code.OpPow)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case ">=":
+			c.emit(code.OpGreaterEqual)
+		case "<":
+			c.emit(code.OpLessThan)
+		case "<=":
+			c.emit(code.OpLessEqual)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
 		}
 	case *ast.IntegerLiteral:
 		integer := &object.Number{Value: float64(node.Value)}
@@ -209,7 +288,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "-":
 			c.emit(code.OpMinus)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
 		}
 	case *ast.IfExpression:
 
@@ -219,12 +298,14 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		// Emit an `OpJumpNotTruthy` with a bogus value
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
-		err = c.Compile(node.Consequence)
+		err = c.compileBlock(node.Consequence)
 		if err != nil {
 			return err
 		}
-		if c.lastInstructionIs(code.OpPop) {
+		if c.lastInstructionIs(code.OpPop) && endsWithExpression(node.Consequence) {
 			c.removeLastPop()
+		} else {
+			c.emit(code.OpNull)
 		}
 		// Emit an `OpJump` with a bogus value
 		jumpPos := c.emit(code.OpJump, 9999)
@@ -233,17 +314,52 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
-			err := c.Compile(node.Alternative)
+			err := c.compileBlock(node.Alternative)
 			if err != nil {
 				return err
 			}
-			if c.lastInstructionIs(code.OpPop) {
+			if c.lastInstructionIs(code.OpPop) && endsWithExpression(node.Alternative) {
 				c.removeLastPop()
+			} else {
+				c.emit(code.OpNull)
 			}
 		}
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
 
+	case *ast.WhileStatement:
+		return c.compileWhileStatement(node)
+	case *ast.ForInStatement:
+		return c.compileForInStatement(node)
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("%s: break outside of a loop", node.Pos())
+		}
+		err := c.unwindTries(loop.tryDepth)
+		if err != nil {
+			return err
+		}
+		loop.breakJumps = append(loop.breakJumps, c.emit(code.OpJump, 9999))
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("%s: continue outside of a loop", node.Pos())
+		}
+		err := c.unwindTries(loop.tryDepth)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loop.continuePos)
+	case *ast.TryStatement:
+		return c.compileTryStatement(node)
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
 			err := c.Compile(s)
@@ -253,21 +369,57 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.MutStatement:
+		symbol, err := c.defineBinding(node.Value, func() Symbol {
+			return c.symbolTable.Define(node.Name.Value)
+		})
+		if err != nil {
+			return err
+		}
+		c.storeSymbol(symbol)
+	case *ast.ConstStatement:
+		symbol, err := c.defineBinding(node.Value, func() Symbol {
+			return c.symbolTable.DefineConst(node.Name.Value)
+		})
+		if err != nil {
+			return err
+		}
+		if node.IsExport {
+			c.symbolTable.Export(node.Name.Value)
+		}
+		c.storeSymbol(symbol)
+	case *ast.AssignmentStatement:
+		symbol, ok := c.symbolTable.ResolveAssignment(node.Name.Value)
+		if !ok {
+			return fmt.Errorf("%s: assignment to undefined variable %s", node.Pos(), node.Name.Value)
+		}
+		if c.symbolTable.IsConst(node.Name.Value) || symbol.Scope == BuiltinScope {
+			return fmt.Errorf("%s: assignment to const variable %s", node.Pos(), node.Name.Value)
+		}
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
-		symbol := c.symbolTable.Define(node.Name.Value)
-		c.emit(code.OpSetGlobal, symbol.Index)
+		c.assignSymbol(symbol)
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			if _, isModule := c.symbolTable.ResolveModule(node.Value); isModule || isBuiltinModule(node.Value) {
+				return fmt.Errorf("%s: module %s can only be used as %s.<symbol>", node.Pos(), node.Value, node.Value)
+			}
+			return fmt.Errorf("%s: undefined variable %s", node.Pos(), node.Value)
 		}
-		c.emit(code.OpGetGlobal, symbol.Index)
+		c.loadSymbol(symbol)
 	case *ast.StringLiteral:
 		str := &object.String{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(str))
+	case *ast.TemplateLiteral:
+		for _, part := range node.Parts {
+			err := c.Compile(part)
+			if err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpConcat, len(node.Parts))
 
 	case *ast.ArrayLiteral:
 		for _, el := range node.Elements {
@@ -306,34 +458,573 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 		c.emit(code.OpIndex)
+	case *ast.ModuleExpression:
+		if handled, err := c.compileModuleMember(node); handled {
+			return err
+		}
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+		member := &object.String{Value: node.Index.Value}
+		c.emit(code.OpConstant, c.addConstant(member))
+		c.emit(code.OpIndex)
+	case *ast.IndexAssignmentStatement:
+		return c.compileIndexAssignment(node)
 
 	case *ast.FunctionLiteral:
 		c.enterScope()
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
 		for _, p := range node.Parameters {
-			c.symbolTable.Define(p.Value)
+			c.symbolTable.defineSlot(p.Value)
 		}
 		err := c.Compile(node.Body)
 		if err != nil {
 			return err
 		}
-		if c.lastInstructionIs(code.OpPop) {
+		if c.lastInstructionIs(code.OpPop) && endsWithExpression(node.Body) {
 			c.replaceLastPopWithReturn()
 		}
-		instructions := c.leaveScope()
-		compiledFn := &object.CompiledFunction{Instructions: instructions}
-		c.emit(code.OpConstant, c.addConstant(compiledFn))
+		if !c.lastInstructionIs(code.OpReturnValue) {
+			c.emit(code.OpReturn)
+		}
+		freeSymbols := c.symbolTable.FreeSymbols
+		numLocals := c.symbolTable.numDefinitions
+		instructions, positions := c.leaveScope()
+		if numLocals > code.MaxWideOperand {
+			return fmt.Errorf("%s: too many local variables in function", node.Pos())
+		}
+		if len(freeSymbols) > code.MaxWideOperand {
+			return fmt.Errorf("%s: too many free variables in function", node.Pos())
+		}
+
+		for _, s := range freeSymbols {
+			c.captureSymbol(s)
+		}
+		compiledFn := &object.CompiledFunction{
+			Instructions:  instructions,
+			Positions:     positions,
+			NumLocals:     numLocals,
+			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+		}
+		c.emit(code.OpClosure, c.addConstant(compiledFn), len(freeSymbols))
+
+	case *ast.CallExpression:
+		if len(node.Arguments) > code.MaxWideOperand {
+			return fmt.Errorf("%s: too many arguments in call", node.Pos())
+		}
+		err := c.Compile(node.Function)
+		if err != nil {
+			return err
+		}
+		for _, a := range node.Arguments {
+			err := c.Compile(a)
+			if err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpCall, len(node.Arguments))
 
 	case *ast.ReturnStatement:
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
+		// finally blocks run before leaving the function, on top of the
+		// value being returned
+		err = c.unwindTries(0)
+		if err != nil {
+			return err
+		}
 		c.emit(code.OpReturnValue)
 
 	}
 
 	return nil
 }
+
+// compileLogicalExpression compiles && and || into jumps, so the right
+// operand only runs when it decides the result. Both leave a Bool on the stack.
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+	var jumpToRight, jumpToEnd int
+	if node.Operator == "||" {
+		jumpToRight = c.emit(code.OpJumpNotTruthy, 9999)
+		c.emit(code.OpTrue)
+		jumpToEnd = c.emit(code.OpJump, 9999)
+		c.changeOperand(jumpToRight, len(c.currentInstructions()))
+	} else {
+		jumpToRight = c.emit(code.OpJumpNotTruthy, 9999)
+	}
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+	jumpToFalse := c.emit(code.OpJumpNotTruthy, 9999)
+	c.emit(code.OpTrue)
+	jumpAfterTrue := c.emit(code.OpJump, 9999)
+
+	falsePos := c.emit(code.OpFalse)
+	c.changeOperand(jumpToFalse, falsePos)
+	if node.Operator == "&&" {
+		c.changeOperand(jumpToRight, falsePos)
+	}
+
+	afterPos := len(c.currentInstructions())
+	c.changeOperand(jumpAfterTrue, afterPos)
+	if node.Operator == "||" {
+		c.changeOperand(jumpToEnd, afterPos)
+	}
+	return nil
+}
+
+func (c *Compiler) currentLoop() *loopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+func (c *Compiler) enterLoop(continuePos int) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, &loopContext{continuePos: continuePos, tryDepth: len(scope.tries)})
+}
+
+// leaveLoop points every pending `break` at breakPos.
+func (c *Compiler) leaveLoop(breakPos int) {
+	scope := &c.scopes[c.scopeIndex]
+	loop := scope.loops[len(scope.loops)-1]
+	for _, pos := range loop.breakJumps {
+		c.changeOperand(pos, breakPos)
+	}
+	scope.loops = scope.loops[:len(scope.loops)-1]
+}
+
+func (c *Compiler) enterTry(hasHandler bool, finally *ast.BlockStatement) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.tries = append(scope.tries, &tryContext{hasHandler: hasHandler, finally: finally})
+}
+
+func (c *Compiler) leaveTry() {
+	scope := &c.scopes[c.scopeIndex]
+	scope.tries = scope.tries[:len(scope.tries)-1]
+}
+
+// unwindTries emits what a jump out of the try blocks above depth needs:
+// OpPopTry for each handler and a copy of each finally block, innermost
+// first.
+func (c *Compiler) unwindTries(depth int) error {
+	tries := c.scopes[c.scopeIndex].tries
+	defer func() { c.scopes[c.scopeIndex].tries = tries }()
+
+	for i := len(tries) - 1; i >= depth; i-- {
+		if tries[i].hasHandler {
+			c.emit(code.OpPopTry)
+		}
+		if tries[i].finally != nil {
+			c.scopes[c.scopeIndex].tries = tries[:i]
+			err := c.Compile(tries[i].finally)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compileTryStatement protects the try block with OpSetupTry. When an
+// error is raised the VM jumps to the catch code with the error value on
+// the stack. The finally block is copied onto every way out: after the
+// try block, after the catch block, and before rethrowing an error the
+// catch block raised or that had no catch block.
+func (c *Compiler) compileTryStatement(node *ast.TryStatement) error {
+	jumpsToEnd := []int{}
+
+	setupPos := c.emit(code.OpSetupTry, 9999)
+	c.enterTry(true, node.Finally)
+	err := c.compileBlock(node.Block)
+	if err != nil {
+		return err
+	}
+	c.leaveTry()
+	c.emit(code.OpPopTry)
+	err = c.compileFinally(node.Finally)
+	if err != nil {
+		return err
+	}
+	jumpsToEnd = append(jumpsToEnd, c.emit(code.OpJump, 9999))
+
+	c.changeOperand(setupPos, len(c.currentInstructions()))
+	if node.Catch != nil {
+		rethrowSetupPos := -1
+		if node.Finally != nil {
+			rethrowSetupPos = c.emit(code.OpSetupTry, 9999)
+		}
+		c.enterTry(node.Finally != nil, node.Finally)
+		err = c.compileCatch(node)
+		if err != nil {
+			return err
+		}
+		c.leaveTry()
+		if node.Finally == nil {
+			jumpsToEnd = append(jumpsToEnd, c.emit(code.OpJump, 9999))
+		} else {
+			c.emit(code.OpPopTry)
+			err = c.compileFinally(node.Finally)
+			if err != nil {
+				return err
+			}
+			jumpsToEnd = append(jumpsToEnd, c.emit(code.OpJump, 9999))
+			c.changeOperand(rethrowSetupPos, len(c.currentInstructions()))
+		}
+	}
+	if node.Finally != nil {
+		err = c.compileFinally(node.Finally)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	}
+
+	afterTryPos := len(c.currentInstructions())
+	for _, pos := range jumpsToEnd {
+		c.changeOperand(pos, afterTryPos)
+	}
+	return nil
+}
+
+// compileCatch binds the error on the stack to the catch parameter, if
+// any, and compiles the catch block. Both only run on an error.
+func (c *Compiler) compileCatch(node *ast.TryStatement) error {
+	c.symbolTable.EnterBlock()
+	defer c.symbolTable.LeaveBlock()
+	if node.Param == nil {
+		c.emit(code.OpPop)
+	} else if err := c.defineAndStore(node.Param); err != nil {
+		return err
+	}
+	return c.Compile(node.Catch)
+}
+
+func (c *Compiler) compileFinally(finally *ast.BlockStatement) error {
+	if finally == nil {
+		return nil
+	}
+	return c.compileBlock(finally)
+}
+
+// compileBlock compiles a block that may not run, or not to its end. A
+// variable first declared in it is checked when used, see Symbol.
+func (c *Compiler) compileBlock(block *ast.BlockStatement) error {
+	c.symbolTable.EnterBlock()
+	defer c.symbolTable.LeaveBlock()
+	return c.Compile(block)
+}
+
+func (c *Compiler) compileWhileStatement(node *ast.WhileStatement) error {
+	loopStart := len(c.currentInstructions())
+	err := c.Compile(node.Condition)
+	if err != nil {
+		return err
+	}
+	jumpToEnd := c.emit(code.OpJumpNotTruthy, 9999)
+
+	c.enterLoop(loopStart)
+	err = c.compileBlock(node.Body)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpJump, loopStart)
+
+	afterLoopPos := len(c.currentInstructions())
+	c.changeOperand(jumpToEnd, afterLoopPos)
+	c.leaveLoop(afterLoopPos)
+	return nil
+}
+
+// compileForInStatement keeps the iterator on the stack for the whole loop.
+// OpIterNext pushes the next key and value (or only the value) and jumps
+// past the body once the iterator is exhausted, where it is popped.
+func (c *Compiler) compileForInStatement(node *ast.ForInStatement) error {
+	err := c.Compile(node.Iterable)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpIter)
+
+	count := 1
+	if node.Key != nil {
+		count = 2
+	}
+	loopStart := c.emit(code.OpIterNext, 9999, count)
+	vars := []*ast.Identifier{node.Value}
+	if node.Key != nil {
+		vars = append(vars, node.Key)
+	}
+	names := make([]string, len(vars))
+	for i, ident := range vars {
+		if c.symbolTable.IsConst(ident.Value) {
+			return fmt.Errorf("%s: assignment to const variable %s", ident.Pos(), ident.Value)
+		}
+		names[i] = ident.Value
+	}
+	// the loop variables are scoped to the body
+	defer c.symbolTable.Shadow(names...)()
+	for _, ident := range vars {
+		c.storeSymbol(c.symbolTable.defineSlot(ident.Value))
+	}
+
+	c.enterLoop(loopStart)
+	err = c.compileBlock(node.Body)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpJump, loopStart)
+
+	donePos := c.emit(code.OpPop)
+	c.replaceInstruction(loopStart, code.MakeWide(code.OpIterNext, donePos, count))
+	c.leaveLoop(donePos)
+	return nil
+}
+
+// defineAndStore binds the value on top of the stack to ident, as a catch
+// parameter. Rebinding a const in scope is an error,
+// as assigning to it is.
+func (c *Compiler) defineAndStore(ident *ast.Identifier) error {
+	if c.symbolTable.IsConst(ident.Value) {
+		return fmt.Errorf("%s: assignment to const variable %s", ident.Pos(), ident.Value)
+	}
+	c.storeSymbol(c.symbolTable.Define(ident.Value))
+	return nil
+}
+
+// compileIndexAssignment pushes the collection, the index and the value
+// for OpSetIndex. `hash.k` uses "k" as the index.
+func (c *Compiler) compileIndexAssignment(node *ast.IndexAssignmentStatement) error {
+	if root := node.Root(); root != nil && c.symbolTable.IsConst(root.Value) {
+		return fmt.Errorf("%s: assignment to const variable %s", node.Pos(), root.Value)
+	}
+	switch target := node.Target.(type) {
+	case *ast.IndexExpression:
+		err := c.Compile(target.Left)
+		if err != nil {
+			return err
+		}
+		err = c.Compile(target.Index)
+		if err != nil {
+			return err
+		}
+	case *ast.ModuleExpression:
+		if module, ok := c.moduleName(target); ok {
+			return fmt.Errorf("%s: cannot assign to symbol %s of module %s", node.Pos(), target.Index.Value, module)
+		}
+		err := c.Compile(target.Left)
+		if err != nil {
+			return err
+		}
+		member := &object.String{Value: target.Index.Value}
+		c.emit(code.OpConstant, c.addConstant(member))
+	}
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpSetIndex)
+	return nil
+}
+
+// compileModule compiles the body of a module in its own namespace. Its
+// names are globals, but only `@ const` exports are reachable from outside,
+// as mod.symbol.
+func (c *Compiler) compileModule(node *ast.Module) error {
+	table := NewModuleSymbolTable(c.symbolTable, node.Name)
+	c.symbolTable = table
+	defer func() { c.symbolTable = table.Outer }()
+	for _, s := range node.Statements {
+		err := c.Compile(s)
+		if err != nil {
+			return err
+		}
+	}
+	table.Outer.DefineModule(node.Name, table)
+	return nil
+}
+
+// compileModuleMember compiles mod.symbol when the left side names a
+// module, checking the same public/private rules as the evaluator. It
+// reports false when node is a member access on a value instead.
+func (c *Compiler) compileModuleMember(node *ast.ModuleExpression) (bool, error) {
+	name, ok := c.moduleName(node)
+	if !ok {
+		return false, nil
+	}
+	member := node.Index.Value
+	if index, ok := builtinModuleIndex(name); ok {
+		c.emit(code.OpGetBuiltinModule, index)
+		c.emit(code.OpConstant, c.addConstant(&object.String{Value: member}))
+		c.emit(code.OpIndex)
+		return true, nil
+	}
+	module, _ := c.symbolTable.ResolveModule(name)
+	symbol, ok, isMut := module.ResolveExport(member)
+	if !ok {
+		if isMut {
+			return true, fmt.Errorf("%s: cannot access non-const symbol %s from module %s", node.Pos(), member, name)
+		}
+		return true, fmt.Errorf("%s: module %s has no public symbol %s", node.Pos(), name, member)
+	}
+	c.loadSymbol(symbol)
+	return true, nil
+}
+
+// moduleName returns the module node refers to, if its left side is the
+// name of a builtin or compiled module. Builtin modules come first, as in
+// the evaluator; compiled modules come before variables.
+func (c *Compiler) moduleName(node *ast.ModuleExpression) (string, bool) {
+	ident, ok := node.Left.(*ast.Identifier)
+	if !ok {
+		return "", false
+	}
+	if isBuiltinModule(ident.Value) {
+		return ident.Value, true
+	}
+	if _, ok := c.symbolTable.ResolveModule(ident.Value); ok {
+		return ident.Value, true
+	}
+	return "", false
+}
+
+func builtinModuleIndex(name string) (int, bool) {
+	for i, m := range object.BuiltinModules {
+		if m == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func isBuiltinModule(name string) bool {
+	_, ok := builtinModuleIndex(name)
+	return ok
+}
+
+// loadSymbol pushes the value of s. If its declaration may not have run,
+// an unset value is replaced by what the name means outside of it, or is
+// an error, as in the evaluator.
+func (c *Compiler) loadSymbol(s Symbol) {
+	c.emitLoad(s)
+	if !MaybeUnset(s) {
+		return
+	}
+	fallback, ok := c.symbolTable.Fallback(s)
+	if !ok {
+		c.emit(code.OpCheckDefined, c.addConstant(&object.String{Value: "identifier not found: " + s.Name}))
+		return
+	}
+	jumpPos := c.emit(code.OpJumpDefined, 9999)
+	c.loadSymbol(fallback)
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+}
+
+func (c *Compiler) emitLoad(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
+	}
+}
+
+// captureSymbol pushes what OpClosure needs to share the variable s with
+// the new closure, so assignments on either side are seen by both, the
+// way closures share their environment in the evaluator.
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
+// assignSymbol pops the top of the stack into the variable s, or into
+// what its name means outside of the block declaring it, if that has not
+// run. With nothing outside either, the assignment is an error.
+func (c *Compiler) assignSymbol(s Symbol) {
+	if !MaybeUnset(s) {
+		c.storeSymbol(s)
+		return
+	}
+	c.emitLoad(s)
+	fallback, ok := c.symbolTable.Fallback(s)
+	if !ok || fallback.Scope == BuiltinScope || fallback.Scope == FunctionScope {
+		c.emit(code.OpCheckDefined, c.addConstant(&object.String{Value: "assignment to undefined variable: " + s.Name}))
+		c.emit(code.OpPop)
+		c.storeSymbol(s)
+		return
+	}
+	jumpPos := c.emit(code.OpJumpDefined, 9999)
+	c.assignSymbol(fallback)
+	endPos := c.emit(code.OpJump, 9999)
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+	c.emit(code.OpPop)
+	c.storeSymbol(s)
+	c.changeOperand(endPos, len(c.currentInstructions()))
+}
+
+// storeSymbol pops the top of the stack into s.
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+	}
+}
+
+// defineBinding compiles the value of a mut or const statement and defines
+// its name with define. A function assigning to its own name assigns to
+// the binding, so for a named function it is defined first.
+func (c *Compiler) defineBinding(value ast.Expression, define func() Symbol) (Symbol, error) {
+	if fn, ok := value.(*ast.FunctionLiteral); ok && fn.Name != "" {
+		symbol := define()
+		return symbol, c.Compile(value)
+	}
+	if err := c.Compile(value); err != nil {
+		return Symbol{}, err
+	}
+	return define(), nil
+}
+
+// endsWithExpression reports whether the last thing a block compiled to is
+// the OpPop of an expression statement, and not e.g. a loop dropping its
+// iterator.
+func endsWithExpression(block *ast.BlockStatement) bool {
+	if len(block.Statements) == 0 {
+		return false
+	}
+	_, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
 	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
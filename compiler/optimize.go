@@ -0,0 +1,582 @@
+package compiler
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pecet3/hmbk-script/code"
+	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/token"
+)
+
+// Optimize returns an optimized copy of b, for running with `-O`. It folds
+// operations on constant numbers, strings and booleans, drops branches on
+// constant conditions, threads jumps to jumps, removes unreachable code and
+// deduplicates the constant pool. The program computes the same results;
+// only operations that would fail at run time, like dividing by zero, are
+// left alone so they fail the same way.
+//
+// Optimize renumbers constants, so it is meant for whole programs. Code
+// compiled against a pool that earlier code still uses needs OptimizeFrom.
+func Optimize(b *Bytecode) (*Bytecode, error) {
+	return OptimizeFrom(b, 0)
+}
+
+// OptimizeFrom optimizes b like Optimize, but leaves its first keep
+// constants where they are, and the functions among them as they are. The
+// REPL uses it: functions defined by earlier lines refer to those
+// constants by index, and later lines are compiled against the result.
+func OptimizeFrom(b *Bytecode, keep int) (*Bytecode, error) {
+	o := &optimizer{constants: append([]object.Object{}, b.Constants...), keep: keep}
+
+	list, err := decode(b.Instructions, b.Positions)
+	if err != nil {
+		return nil, err
+	}
+	main := o.optimize(list)
+	functions := map[int][]*instruction{}
+	for i, c := range b.Constants[keep:] {
+		i += keep
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			list, err := decode(fn.Instructions, fn.Positions)
+			if err != nil {
+				return nil, fmt.Errorf("constant %d: %w", i, err)
+			}
+			functions[i] = o.optimize(list)
+		}
+	}
+
+	remap, constants := o.rebuildPool(main, functions)
+	for i, ins := range functions {
+		fn := b.Constants[i].(*object.CompiledFunction)
+		if newIndex, ok := remap[i]; ok {
+			instructions, positions := encode(ins, remap)
+			constants[newIndex] = &object.CompiledFunction{
+				Instructions:  instructions,
+				Positions:     positions,
+				NumLocals:     fn.NumLocals,
+				NumParameters: fn.NumParameters,
+				Name:          fn.Name,
+			}
+		}
+	}
+	instructions, positions := encode(main, remap)
+	return &Bytecode{Instructions: instructions, Positions: positions, Constants: constants}, nil
+}
+
+// instruction is a decoded instruction. Jumps refer to the index of their
+// target in the instruction list rather than to a byte offset, so
+// instructions can be removed without breaking them.
+type instruction struct {
+	op       code.Opcode
+	operands []int
+	target   int            // for jumps: index of the target, len(list) for the end
+	pos      token.Position // where in the source it comes from
+}
+
+func isJump(op code.Opcode) bool {
+	switch op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpSetupTry, code.OpIterNext, code.OpCompareJump, code.OpJumpDefined:
+		return true
+	}
+	return false
+}
+
+// usesConstant reports whether the first operand of op is an index into
+// the constant pool.
+func usesConstant(op code.Opcode) bool {
+	switch op {
+	case code.OpConstant, code.OpClosure, code.OpBinaryConst, code.OpCheckDefined:
+		return true
+	}
+	return false
+}
+
+// falls reports whether execution can continue with the next instruction.
+func falls(op code.Opcode) bool {
+	switch op {
+	case code.OpJump, code.OpReturnValue, code.OpReturn, code.OpThrow:
+		return false
+	}
+	return true
+}
+
+func decode(ins code.Instructions, positions code.Positions) ([]*instruction, error) {
+	list := []*instruction{}
+	indexAt := map[int]int{}
+	for i := 0; i < len(ins); {
+		op, operands, size, err := code.ReadInstruction(ins, i)
+		if err != nil {
+			return nil, fmt.Errorf("%04d: %w", i, err)
+		}
+		indexAt[i] = len(list)
+		list = append(list, &instruction{op: op, operands: operands, pos: positions.At(i)})
+		i += size
+	}
+	indexAt[len(ins)] = len(list)
+	for _, in := range list {
+		if isJump(in.op) {
+			target, ok := indexAt[in.operands[0]]
+			if !ok {
+				return nil, fmt.Errorf("jump to %04d is not the start of an instruction", in.operands[0])
+			}
+			in.target = target
+		}
+	}
+	return list, nil
+}
+
+// encode lays list out as bytes, renumbering constants through remap when
+// it is not nil, and returns them with their positions. Jumps are 2 bytes
+// wide unless their target lies beyond 65535; widening one moves the code
+// after it, so the layout is repeated until every jump fits.
+func encode(list []*instruction, remap map[int]int) (code.Instructions, code.Positions) {
+	operands := make([][]int, len(list))
+	for i, in := range list {
+		operands[i] = append([]int{}, in.operands...)
+		if remap != nil && usesConstant(in.op) {
+			operands[i][0] = remap[operands[i][0]]
+		}
+	}
+	wide := make([]bool, len(list))
+	instructionAt := func(i int) []byte {
+		if wide[i] {
+			return code.MakeWide(list[i].op, operands[i]...)
+		}
+		return code.Make(list[i].op, operands[i]...)
+	}
+
+	offsets := make([]int, len(list)+1)
+	for {
+		size := 0
+		for i, in := range list {
+			offsets[i] = size
+			if isJump(in.op) {
+				operands[i][0] = 0
+			}
+			size += len(instructionAt(i))
+		}
+		offsets[len(list)] = size
+
+		changed := false
+		for i, in := range list {
+			if isJump(in.op) && !wide[i] && offsets[in.target] > math.MaxUint16 {
+				wide[i] = true
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	out := make(code.Instructions, 0, offsets[len(list)])
+	var positions code.Positions
+	for i, in := range list {
+		if isJump(in.op) {
+			operands[i][0] = offsets[in.target]
+		}
+		positions = positions.Add(len(out), in.pos)
+		out = append(out, instructionAt(i)...)
+	}
+	return out, positions
+}
+
+type optimizer struct {
+	constants []object.Object
+	// keep is the number of constants at the start of the pool that stay
+	// where they are, see OptimizeFrom
+	keep int
+}
+
+// optimize runs the passes over one function until none changes anything.
+func (o *optimizer) optimize(list []*instruction) []*instruction {
+	for {
+		changed := false
+		for _, pass := range []func([]*instruction) ([]*instruction, bool){
+			o.foldConstants,
+			foldBranches,
+			threadJumps,
+			removeUnreachable,
+			removeUselessJumps,
+		} {
+			var c bool
+			list, c = pass(list)
+			changed = changed || c
+		}
+		if !changed {
+			return list
+		}
+	}
+}
+
+// compact keeps the instructions marked in keep. A jump to a removed
+// instruction continues at the next kept one, which is where execution
+// would have ended up.
+func compact(list []*instruction, keep []bool) []*instruction {
+	newIndex := make([]int, len(list)+1)
+	kept := []*instruction{}
+	for i, in := range list {
+		newIndex[i] = len(kept)
+		if keep[i] {
+			kept = append(kept, in)
+		}
+	}
+	newIndex[len(list)] = len(kept)
+	for _, in := range kept {
+		if isJump(in.op) {
+			in.target = newIndex[in.target]
+		}
+	}
+	return kept
+}
+
+func jumpTargetSet(list []*instruction) map[int]bool {
+	targets := map[int]bool{}
+	for _, in := range list {
+		if isJump(in.op) {
+			targets[in.target] = true
+		}
+	}
+	return targets
+}
+
+func keepAll(n int) []bool {
+	keep := make([]bool, n)
+	for i := range keep {
+		keep[i] = true
+	}
+	return keep
+}
+
+// constantValue returns the value an instruction pushes if it is known at
+// compile time.
+func (o *optimizer) constantValue(in *instruction) (object.Object, bool) {
+	switch in.op {
+	case code.OpConstant:
+		switch c := o.constants[in.operands[0]].(type) {
+		case *object.Number, *object.String:
+			return c, true
+		}
+	case code.OpTrue:
+		return &object.Bool{Value: true}, true
+	case code.OpFalse:
+		return &object.Bool{Value: false}, true
+	case code.OpNull:
+		return &object.Null{}, true
+	}
+	return nil, false
+}
+
+// push returns the instruction that pushes value, attributed to pos.
+func (o *optimizer) push(value object.Object, pos token.Position) *instruction {
+	switch value := value.(type) {
+	case *object.Bool:
+		if value.Value {
+			return &instruction{op: code.OpTrue, pos: pos}
+		}
+		return &instruction{op: code.OpFalse, pos: pos}
+	default:
+		o.constants = append(o.constants, value)
+		return &instruction{op: code.OpConstant, operands: []int{len(o.constants) - 1}, pos: pos}
+	}
+}
+
+// foldConstants replaces operations on values known at compile time by
+// their result, e.g. `OpConstant 1; OpConstant 2; OpAdd` by `OpConstant 3`.
+func (o *optimizer) foldConstants(list []*instruction) ([]*instruction, bool) {
+	targets := jumpTargetSet(list)
+	keep := keepAll(len(list))
+	changed := false
+	for i := 0; i < len(list); i++ {
+		if !keep[i] {
+			continue
+		}
+		left, ok := o.constantValue(list[i])
+		if !ok {
+			continue
+		}
+		next := nextKept(keep, i)
+		if next >= len(list) || targets[next] {
+			continue
+		}
+		if result, ok := foldUnary(list[next].op, left); ok {
+			list[i] = o.push(result, list[next].pos)
+			keep[next] = false
+			changed = true
+			i--
+			continue
+		}
+		right, ok := o.constantValue(list[next])
+		if !ok {
+			continue
+		}
+		op := nextKept(keep, next)
+		if op >= len(list) || targets[op] {
+			continue
+		}
+		if result, ok := foldBinary(list[op].op, left, right); ok {
+			list[i] = o.push(result, list[op].pos)
+			keep[next], keep[op] = false, false
+			changed = true
+			i--
+		}
+	}
+	if !changed {
+		return list, false
+	}
+	return compact(list, keep), true
+}
+
+func nextKept(keep []bool, i int) int {
+	i++
+	for i < len(keep) && !keep[i] {
+		i++
+	}
+	return i
+}
+
+func foldUnary(op code.Opcode, operand object.Object) (object.Object, bool) {
+	switch op {
+	case code.OpMinus:
+		if n, ok := operand.(*object.Number); ok {
+			return &object.Number{Value: -n.Value}, true
+		}
+	case code.OpBang:
+		return &object.Bool{Value: !constantTruthy(operand)}, true
+	}
+	return nil, false
+}
+
+// foldBinary computes what the VM would for op on two constants. It only
+// handles the cases where the VM succeeds.
+func foldBinary(op code.Opcode, left, right object.Object) (object.Object, bool) {
+	switch left := left.(type) {
+	case *object.Number:
+		right, ok := right.(*object.Number)
+		if !ok {
+			return nil, false
+		}
+		l, r := left.Value, right.Value
+		switch op {
+		case code.OpAdd:
+			return &object.Number{Value: l + r}, true
+		case code.OpSub:
+			return &object.Number{Value: l - r}, true
+		case code.OpMul:
+			return &object.Number{Value: l * r}, true
+		case code.OpDiv:
+			if r != 0 {
+				return &object.Number{Value: l / r}, true
+			}
+		case code.OpMod:
+			if r != 0 {
+				return &object.Number{Value: math.Mod(l, r)}, true
+			}
+		case code.OpPow:
+			return &object.Number{Value: math.Pow(l, r)}, true
+		case code.OpEqual:
+			return &object.Bool{Value: l == r}, true
+		case code.OpNotEqual:
+			return &object.Bool{Value: l != r}, true
+		case code.OpGreaterThan:
+			return &object.Bool{Value: l > r}, true
+		case code.OpGreaterEqual:
+			return &object.Bool{Value: l >= r}, true
+		case code.OpLessThan:
+			return &object.Bool{Value: l < r}, true
+		case code.OpLessEqual:
+			return &object.Bool{Value: l <= r}, true
+		}
+	case *object.String:
+		right, ok := right.(*object.String)
+		if !ok {
+			return nil, false
+		}
+		switch op {
+		case code.OpAdd:
+			return &object.String{Value: left.Value + right.Value}, true
+		case code.OpEqual:
+			return &object.Bool{Value: left.Value == right.Value}, true
+		case code.OpNotEqual:
+			return &object.Bool{Value: left.Value != right.Value}, true
+		}
+	case *object.Bool:
+		right, ok := right.(*object.Bool)
+		if !ok {
+			return nil, false
+		}
+		switch op {
+		case code.OpEqual:
+			return &object.Bool{Value: left.Value == right.Value}, true
+		case code.OpNotEqual:
+			return &object.Bool{Value: left.Value != right.Value}, true
+		}
+	}
+	return nil, false
+}
+
+func constantTruthy(value object.Object) bool {
+	switch value := value.(type) {
+	case *object.Bool:
+		return value.Value
+	case *object.Null:
+		return false
+	}
+	return true
+}
+
+// foldBranches removes OpJumpNotTruthy on a constant condition: it never
+// jumps on a truthy one and always jumps on a falsy one.
+func foldBranches(list []*instruction) ([]*instruction, bool) {
+	targets := jumpTargetSet(list)
+	keep := keepAll(len(list))
+	changed := false
+	for i := 0; i+1 < len(list); i++ {
+		jump := list[i+1]
+		if jump.op != code.OpJumpNotTruthy || targets[i+1] {
+			continue
+		}
+		var truthy bool
+		switch list[i].op {
+		case code.OpTrue, code.OpConstant: // constants are numbers and strings
+			truthy = true
+		case code.OpFalse, code.OpNull:
+			truthy = false
+		default:
+			continue
+		}
+		if truthy {
+			keep[i], keep[i+1] = false, false
+		} else {
+			list[i] = &instruction{op: code.OpJump, operands: []int{0}, target: jump.target, pos: jump.pos}
+			keep[i+1] = false
+		}
+		changed = true
+		i++
+	}
+	if !changed {
+		return list, false
+	}
+	return compact(list, keep), true
+}
+
+// threadJumps points jumps whose target is an OpJump at that jump's target.
+func threadJumps(list []*instruction) ([]*instruction, bool) {
+	changed := false
+	for _, in := range list {
+		if !isJump(in.op) {
+			continue
+		}
+		seen := map[int]bool{}
+		for in.target < len(list) && list[in.target].op == code.OpJump && !seen[in.target] {
+			seen[in.target] = true
+			if list[in.target].target == in.target {
+				break
+			}
+			in.target = list[in.target].target
+			changed = true
+		}
+	}
+	return list, changed
+}
+
+// removeUnreachable drops instructions no path from the start reaches.
+func removeUnreachable(list []*instruction) ([]*instruction, bool) {
+	reached := make([]bool, len(list))
+	work := []int{0}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(list) || reached[i] {
+			continue
+		}
+		reached[i] = true
+		if isJump(list[i].op) {
+			work = append(work, list[i].target)
+		}
+		if falls(list[i].op) {
+			work = append(work, i+1)
+		}
+	}
+	for _, r := range reached {
+		if !r {
+			return compact(list, reached), true
+		}
+	}
+	return list, false
+}
+
+// removeUselessJumps drops an OpJump to the instruction right after it.
+func removeUselessJumps(list []*instruction) ([]*instruction, bool) {
+	keep := keepAll(len(list))
+	changed := false
+	for i, in := range list {
+		if in.op == code.OpJump && in.target == i+1 {
+			keep[i] = false
+			changed = true
+		}
+	}
+	if !changed {
+		return list, false
+	}
+	return compact(list, keep), true
+}
+
+// rebuildPool builds the constant pool of the optimized program: the kept
+// constants, then only the constants still in use, with equal numbers and
+// strings stored once. It returns where each old constant went. Function
+// slots are filled in by the caller.
+func (o *optimizer) rebuildPool(main []*instruction, functions map[int][]*instruction) (map[int]int, []object.Object) {
+	used := map[int]bool{}
+	var mark func(list []*instruction)
+	mark = func(list []*instruction) {
+		for _, in := range list {
+			if !usesConstant(in.op) {
+				continue
+			}
+			index := in.operands[0]
+			if used[index] {
+				continue
+			}
+			used[index] = true
+			if fn, ok := functions[index]; ok {
+				mark(fn)
+			}
+		}
+	}
+	mark(main)
+
+	type key struct {
+		t    object.ObjectType
+		bits uint64
+		s    string
+	}
+	remap := map[int]int{}
+	seen := map[key]int{}
+	constants := []object.Object{}
+	for i, c := range o.constants {
+		if !used[i] && i >= o.keep {
+			continue
+		}
+		var k key
+		switch c := c.(type) {
+		case *object.Number:
+			k = key{t: object.NUMBER, bits: math.Float64bits(c.Value)}
+		case *object.String:
+			k = key{t: object.STRING, s: c.Value}
+		default:
+			remap[i] = len(constants)
+			constants = append(constants, c)
+			continue
+		}
+		if index, ok := seen[k]; ok && i >= o.keep {
+			remap[i] = index
+			continue
+		}
+		seen[k] = len(constants)
+		remap[i] = len(constants)
+		constants = append(constants, c)
+	}
+	return remap, constants
+}
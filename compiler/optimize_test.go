@@ -0,0 +1,223 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/pecet3/hmbk-script/code"
+)
+
+func runOptimizerTests(t *testing.T, tests []compilerTestCase) {
+	t.Helper()
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode, err := Optimize(compiler.Bytecode())
+		if err != nil {
+			t.Fatalf("optimizer error: %s", err)
+		}
+		err = testInstructions(tt.expectedInstructions, bytecode.Instructions)
+		if err != nil {
+			t.Fatalf("input %q: testInstructions failed: %s", tt.input, err)
+		}
+		err = testConstants(t, tt.expectedConstants, bytecode.Constants)
+		if err != nil {
+			t.Fatalf("input %q: testConstants failed: %s", tt.input, err)
+		}
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 + 2 * 3",
+			expectedConstants: []interface{}{7},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-(2 ** 3) % 5",
+			expectedConstants: []interface{}{-3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"a" + "b" == "ab"`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "!(1 > 2) != false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// division by zero must still fail at run time
+			input:             "1 / 0",
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "mut a = 2; a * 3 * 4",
+			expectedConstants: []interface{}{2, 3, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runOptimizerTests(t, tests)
+}
+
+func TestConstantPoolDeduplication(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `mut a = "s"; mut f = fn() { "s" + a }; 1; 1;`,
+			expectedConstants: []interface{}{
+				"s",
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runOptimizerTests(t, tests)
+}
+
+func TestOptimizeFromKeepsConstants(t *testing.T) {
+	first := New()
+	if err := first.Compile(parse(`mut f = fn() { "hi" }; 7`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	kept, err := Optimize(first.Bytecode())
+	if err != nil {
+		t.Fatalf("optimizer error: %s", err)
+	}
+
+	second := NewWithState(first.SymbolTable(), kept.Constants)
+	if err := second.Compile(parse(`"hi"; 2 + 3`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode, err := OptimizeFrom(second.Bytecode(), len(kept.Constants))
+	if err != nil {
+		t.Fatalf("optimizer error: %s", err)
+	}
+	for i, c := range kept.Constants {
+		if bytecode.Constants[i] != c {
+			t.Errorf("constant %d moved or changed: %s", i, bytecode.Constants[i].Inspect())
+		}
+	}
+	// "hi" is the kept constant 0 and 5 comes after the kept ones
+	expected := []code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, len(kept.Constants)),
+		code.Make(code.OpPop),
+	}
+	if err := testInstructions(expected, bytecode.Instructions); err != nil {
+		t.Errorf("testInstructions failed: %s", err)
+	}
+}
+
+func TestBranchesAndUnreachableCode(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "if (true) { 10 } else { 20 }",
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "if (1 > 2) { 10 } else { 20 }",
+			expectedConstants: []interface{}{20},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// the code after return is dropped, and so is the constant it used
+			input: "fn() { return 1; 2 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runOptimizerTests(t, tests)
+}
+
+func TestJumpThreading(t *testing.T) {
+	list, err := decode(concatInstructions([]code.Instructions{
+		code.Make(code.OpGetGlobal, 0),     // 0000
+		code.Make(code.OpJumpNotTruthy, 9), // 0003
+		code.Make(code.OpJump, 12),         // 0006
+		code.Make(code.OpJump, 15),         // 0009
+		code.Make(code.OpJump, 9),          // 0012
+		code.Make(code.OpNull),             // 0015
+		code.Make(code.OpPop),              // 0016
+	}), nil)
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	list, _ = threadJumps(list)
+	got, _ := encode(list, nil)
+	expected := concatInstructions([]code.Instructions{
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpJumpNotTruthy, 15),
+		code.Make(code.OpJump, 15),
+		code.Make(code.OpJump, 15),
+		code.Make(code.OpJump, 15),
+		code.Make(code.OpNull),
+		code.Make(code.OpPop),
+	})
+	if err := testInstructions([]code.Instructions{expected}, got); err != nil {
+		t.Fatalf("threadJumps: %s", err)
+	}
+}
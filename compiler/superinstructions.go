@@ -0,0 +1,97 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/pecet3/hmbk-script/code"
+	"github.com/pecet3/hmbk-script/object"
+)
+
+// Superinstructions returns a copy of b in which common sequences of
+// instructions are replaced by one superinstruction doing the same work,
+// so the VM dispatches fewer instructions and moves fewer values through
+// the stack:
+//
+//	OpConstant c; OpAdd            =>  OpBinaryConst c OpAdd
+//	OpGreaterThan; OpJumpNotTruthy =>  OpCompareJump target OpGreaterThan
+//
+// and likewise for the other arithmetic and comparison operators. Calls
+// and returns are left as they are, so this speeds up arithmetic loops but
+// not call-heavy code (see BenchmarkVM). `-O` runs it after Optimize,
+// whose passes only know the basic instructions.
+func Superinstructions(b *Bytecode) (*Bytecode, error) {
+	list, err := decode(b.Instructions, b.Positions)
+	if err != nil {
+		return nil, err
+	}
+	constants := append([]object.Object{}, b.Constants...)
+	for i, c := range constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		fnList, err := decode(fn.Instructions, fn.Positions)
+		if err != nil {
+			return nil, fmt.Errorf("constant %d: %w", i, err)
+		}
+		instructions, positions := encode(fuse(fnList), nil)
+		constants[i] = &object.CompiledFunction{
+			Instructions:  instructions,
+			Positions:     positions,
+			NumLocals:     fn.NumLocals,
+			NumParameters: fn.NumParameters,
+			Name:          fn.Name,
+		}
+	}
+	instructions, positions := encode(fuse(list), nil)
+	return &Bytecode{Instructions: instructions, Positions: positions, Constants: constants}, nil
+}
+
+// fuse replaces pairs of instructions by superinstructions. The second
+// instruction of a pair must not be a jump target, since it disappears.
+func fuse(list []*instruction) []*instruction {
+	targets := jumpTargetSet(list)
+	keep := keepAll(len(list))
+	for i := 0; i+1 < len(list); i++ {
+		first, second := list[i], list[i+1]
+		if targets[i+1] {
+			continue
+		}
+		switch {
+		case first.op == code.OpConstant && isArithmetic(second.op):
+			list[i] = &instruction{
+				op:       code.OpBinaryConst,
+				operands: []int{first.operands[0], int(second.op)},
+				pos:      second.pos, // the operator, which may fail
+			}
+		case isComparison(first.op) && second.op == code.OpJumpNotTruthy:
+			list[i] = &instruction{
+				op:       code.OpCompareJump,
+				operands: []int{0, int(first.op)},
+				target:   second.target,
+				pos:      first.pos,
+			}
+		default:
+			continue
+		}
+		keep[i+1] = false
+		i++
+	}
+	return compact(list, keep)
+}
+
+func isArithmetic(op code.Opcode) bool {
+	switch op {
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow:
+		return true
+	}
+	return false
+}
+
+func isComparison(op code.Opcode) bool {
+	switch op {
+	case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterEqual, code.OpLessThan, code.OpLessEqual:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/pecet3/hmbk-script/code"
+	"github.com/pecet3/hmbk-script/object"
+)
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "mut a = 1; a + 2; a * 3;",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpBinaryConst, 1, int(code.OpAdd)),
+				code.Make(code.OpPop),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpBinaryConst, 2, int(code.OpMul)),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "mut a = 1; while (a < 10) { a = a + 1 }",
+			expectedConstants: []interface{}{1, 10, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),                           // 0000
+				code.Make(code.OpSetGlobal, 0),                          // 0003
+				code.Make(code.OpGetGlobal, 0),                          // 0006
+				code.Make(code.OpConstant, 1),                           // 0009
+				code.Make(code.OpCompareJump, 29, int(code.OpLessThan)), // 0012
+				code.Make(code.OpGetGlobal, 0),                          // 0016
+				code.Make(code.OpBinaryConst, 2, int(code.OpAdd)),       // 0019
+				code.Make(code.OpSetGlobal, 0),                          // 0023
+				code.Make(code.OpJump, 6),                               // 0026
+			},
+		},
+		{
+			input: "fn(n) { n - 1 }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpBinaryConst, 0, int(code.OpSub)),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	for _, tt := range tests {
+		compiler := New()
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode, err := Superinstructions(compiler.Bytecode())
+		if err != nil {
+			t.Fatalf("superinstructions error: %s", err)
+		}
+		if err := testInstructions(tt.expectedInstructions, bytecode.Instructions); err != nil {
+			t.Fatalf("input %q: testInstructions failed: %s", tt.input, err)
+		}
+		if err := testConstants(t, tt.expectedConstants, bytecode.Constants); err != nil {
+			t.Fatalf("input %q: testConstants failed: %s", tt.input, err)
+		}
+	}
+}
+
+// A jump to the second instruction of a pair keeps the pair apart.
+func TestSuperinstructionsKeepJumpTargets(t *testing.T) {
+	ins := concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0), // 0000
+		code.Make(code.OpJump, 9),     // 0003, to the OpAdd
+		code.Make(code.OpConstant, 0), // 0006
+		code.Make(code.OpAdd),         // 0009
+	})
+	b, err := Superinstructions(&Bytecode{Instructions: ins, Constants: []object.Object{&object.Number{Value: 1}}})
+	if err != nil {
+		t.Fatalf("superinstructions error: %s", err)
+	}
+	if err := testInstructions([]code.Instructions{ins}, b.Instructions); err != nil {
+		t.Errorf("instructions changed: %s", err)
+	}
+}
@@ -1,34 +1,401 @@
 package compiler
 
+import "sort"
+
 type SymbolScope string
 
 const (
-	GlobalScope SymbolScope = "GLOBAL"
+	GlobalScope   SymbolScope = "GLOBAL"
+	LocalScope    SymbolScope = "LOCAL"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
+	BuiltinScope  SymbolScope = "BUILTIN"
 )
 
 type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+
+	// maybeUnset is set for a variable first declared in a block, which
+	// may not have run when the variable is used after it. Until it does,
+	// the name keeps meaning fallback, if not nil, from the table owner.
+	maybeUnset bool
+	block      int
+	fallback   *Symbol
+	owner      *SymbolTable
 }
 type SymbolTable struct {
+	Outer *SymbolTable
+
 	store          map[string]Symbol
+	consts         map[string]bool
 	numDefinitions int
+
+	// openBlocks are the if, loop and try blocks being compiled in s,
+	// numbered from 1 by blockCount
+	openBlocks []int
+	blockCount int
+
+	// FreeSymbols are the outer symbols captured by the function being
+	// compiled, in the order OpClosure pushes them.
+	FreeSymbols []Symbol
+
+	// module is set on the table of a module body: its definitions are
+	// globals, numbered after the program's, and exports lists the ones
+	// declared with `@ const`.
+	module  string
+	exports map[string]bool
+	modules map[string]*SymbolTable
 }
 
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
-	return &SymbolTable{store: s}
+	return &SymbolTable{store: s, consts: make(map[string]bool), modules: make(map[string]*SymbolTable)}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
+// NewModuleSymbolTable creates the table a module body is compiled in.
+// The module sees the names of outer, but its own names stay in it.
+func NewModuleSymbolTable(outer *SymbolTable, name string) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.module = name
+	s.exports = make(map[string]bool)
+	return s
 }
 
+// Define declares name in s. Declaring a name already declared in s
+// reuses its slot, as the evaluator rebinds the same variable.
 func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions, Scope: GlobalScope}
+	previous, defined := s.store[name]
+	if !defined || (previous.Scope != GlobalScope && previous.Scope != LocalScope) {
+		symbol := s.defineSlot(name)
+		if len(s.openBlocks) > 0 {
+			symbol.maybeUnset = true
+			symbol.block = s.openBlocks[len(s.openBlocks)-1]
+			symbol.owner = s
+			symbol.fallback = s.outerSymbol(name, previous, defined)
+			s.store[name] = symbol
+		}
+		return symbol
+	}
+	symbol := previous
+	if len(s.openBlocks) == 0 {
+		symbol.maybeUnset = false
+		symbol.fallback = nil
+		symbol.owner = nil
+	} else if symbol.maybeUnset {
+		symbol.block = s.openBlocks[len(s.openBlocks)-1]
+	}
 	s.store[name] = symbol
-	s.numDefinitions++
+	delete(s.consts, name)
+	if s.exports != nil {
+		delete(s.exports, name)
+	}
 	return symbol
 }
 
+// outerSymbol returns what name means in s before it is declared there,
+// given its previous entry in s, or nil if it is undefined.
+func (s *SymbolTable) outerSymbol(name string, previous Symbol, defined bool) *Symbol {
+	if defined {
+		return &previous
+	}
+	if s.Outer == nil {
+		return nil
+	}
+	symbol, ok := s.Outer.Resolve(name)
+	if !ok {
+		return nil
+	}
+	if symbol.Scope != GlobalScope && symbol.Scope != BuiltinScope {
+		symbol = s.captureHidden(symbol)
+	}
+	return &symbol
+}
+
+// defineSlot declares name in a new slot, even if it is already declared
+// in s. Parameters and loop variables use it, as they are always set.
+func (s *SymbolTable) defineSlot(name string) Symbol {
+	var symbol Symbol
+	if s.isGlobal() {
+		globals := s.globalTable()
+		symbol = Symbol{Name: name, Scope: GlobalScope, Index: globals.numDefinitions}
+		globals.numDefinitions++
+	} else {
+		symbol = Symbol{Name: name, Scope: LocalScope, Index: s.numDefinitions}
+		s.numDefinitions++
+	}
+	s.store[name] = symbol
+	delete(s.consts, name)
+	if s.exports != nil {
+		delete(s.exports, name)
+	}
+	return symbol
+}
+
+// Shadow hides the bindings of names in s until the returned function is
+// called. A for-in loop defines its variables in between, so they get
+// slots of their own and the bindings outside the loop keep their values.
+func (s *SymbolTable) Shadow(names ...string) (restore func()) {
+	type binding struct {
+		symbol           Symbol
+		defined, isConst bool
+		exported         bool
+	}
+	saved := make(map[string]binding, len(names))
+	for _, name := range names {
+		symbol, defined := s.store[name]
+		saved[name] = binding{symbol, defined, s.consts[name], s.exports[name]}
+	}
+	return func() {
+		for name, b := range saved {
+			delete(s.store, name)
+			delete(s.consts, name)
+			if s.exports != nil {
+				delete(s.exports, name)
+			}
+			if !b.defined {
+				continue
+			}
+			s.store[name] = b.symbol
+			if b.isConst {
+				s.consts[name] = true
+			}
+			if b.exported {
+				s.exports[name] = true
+			}
+		}
+	}
+}
+
+// isGlobal reports whether s is the program's table or a module's, whose
+// definitions live in the global store.
+func (s *SymbolTable) isGlobal() bool {
+	return s.Outer == nil || s.module != ""
+}
+
+func (s *SymbolTable) globalTable() *SymbolTable {
+	for s.Outer != nil {
+		s = s.Outer
+	}
+	return s
+}
+
+// DefineConst defines name like Define and marks it read-only.
+func (s *SymbolTable) DefineConst(name string) Symbol {
+	symbol := s.Define(name)
+	s.consts[name] = true
+	return symbol
+}
+
+// Export marks the const name of a module as public.
+func (s *SymbolTable) Export(name string) {
+	if s.exports != nil {
+		s.exports[name] = true
+	}
+}
+
+// DefineModule makes the module compiled in table visible as name.
+func (s *SymbolTable) DefineModule(name string, table *SymbolTable) {
+	s.modules[name] = table
+}
+
+// ResolveModule looks up a module by name in s and its outer tables.
+func (s *SymbolTable) ResolveModule(name string) (*SymbolTable, bool) {
+	for t := s; t != nil; t = t.Outer {
+		if mod, ok := t.modules[name]; ok {
+			return mod, true
+		}
+	}
+	return nil, false
+}
+
+// ResolveExport returns the public symbol name of module s. A mutable
+// symbol is reported as such, so the caller can explain why it is hidden.
+func (s *SymbolTable) ResolveExport(name string) (symbol Symbol, ok bool, isMut bool) {
+	symbol, defined := s.store[name]
+	if !defined {
+		return symbol, false, false
+	}
+	if !s.exports[name] {
+		return symbol, false, !s.consts[name]
+	}
+	return symbol, true, false
+}
+
+// DefineFunctionName lets a function refer to itself by the name it is
+// being bound to, so recursive functions work before the binding exists.
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+// DefineBuiltin makes the builtin at index in object.Builtins visible as
+// name.
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+	symbol := freeSymbol(original, len(s.FreeSymbols)-1)
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+// captureHidden captures the outer symbol original without binding its
+// name in s, where the name means something else.
+func (s *SymbolTable) captureHidden(original Symbol) Symbol {
+	for i, free := range s.FreeSymbols {
+		if free == original {
+			return freeSymbol(original, i)
+		}
+	}
+	s.FreeSymbols = append(s.FreeSymbols, original)
+	return freeSymbol(original, len(s.FreeSymbols)-1)
+}
+
+func freeSymbol(original Symbol, index int) Symbol {
+	return Symbol{
+		Name:       original.Name,
+		Scope:      FreeScope,
+		Index:      index,
+		maybeUnset: original.maybeUnset,
+		block:      original.block,
+		fallback:   original.fallback,
+		owner:      original.owner,
+	}
+}
+
+// EnterBlock and LeaveBlock delimit a block that may not run, or not to
+// its end. Variables first declared in it may be unset after it.
+func (s *SymbolTable) EnterBlock() {
+	s.blockCount++
+	s.openBlocks = append(s.openBlocks, s.blockCount)
+}
+
+func (s *SymbolTable) LeaveBlock() {
+	s.openBlocks = s.openBlocks[:len(s.openBlocks)-1]
+}
+
+// MaybeUnset reports whether symbol may be used before its declaration
+// has run: it was declared in a block that is no longer being compiled.
+func MaybeUnset(symbol Symbol) bool {
+	if !symbol.maybeUnset {
+		return false
+	}
+	for _, block := range symbol.owner.openBlocks {
+		if block == symbol.block {
+			return false
+		}
+	}
+	return true
+}
+
+// Fallback returns what symbol, resolved in s, means while its declaration
+// has not run, captured into s if needed.
+func (s *SymbolTable) Fallback(symbol Symbol) (Symbol, bool) {
+	if symbol.fallback == nil {
+		return Symbol{}, false
+	}
+	return s.captureFrom(symbol.owner, *symbol.fallback), true
+}
+
+// captureFrom makes symbol, which belongs to owner, reachable from s.
+func (s *SymbolTable) captureFrom(owner *SymbolTable, symbol Symbol) Symbol {
+	if s == owner || symbol.Scope == GlobalScope || symbol.Scope == BuiltinScope {
+		return symbol
+	}
+	return s.captureHidden(s.Outer.captureFrom(owner, symbol))
+}
+
+// IsConst reports whether name resolves to a const binding. Free variables
+// and function names are bindings of an outer table, so it looks there.
+func (s *SymbolTable) IsConst(name string) bool {
+	if symbol, ok := s.store[name]; ok && symbol.Scope != FreeScope && symbol.Scope != FunctionScope {
+		return s.consts[name]
+	}
+	return s.Outer != nil && s.Outer.IsConst(name)
+}
+
+// ResolveAssignment resolves name as the target of an assignment. Inside a
+// function its own name is the closure being run, not a variable, so the
+// assignment goes to the binding the function was stored in instead.
+func (s *SymbolTable) ResolveAssignment(name string) (Symbol, bool) {
+	obj, ok := s.store[name]
+	if ok && !s.isFunctionName(obj) {
+		return obj, true
+	}
+	if s.Outer == nil {
+		return Symbol{}, false
+	}
+	obj, ok = s.Outer.ResolveAssignment(name)
+	if !ok || obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		return obj, ok
+	}
+	if _, shadowed := s.store[name]; !shadowed {
+		return s.defineFree(obj), true
+	}
+	// reads of name still mean the closure, so the binding is captured
+	// without taking over the name
+	return s.captureHidden(obj), true
+}
+
+// isFunctionName reports whether symbol, from s, refers to the function
+// being compiled, directly or captured from an enclosing one.
+func (s *SymbolTable) isFunctionName(symbol Symbol) bool {
+	for symbol.Scope == FreeScope {
+		symbol = s.FreeSymbols[symbol.Index]
+		s = s.Outer
+	}
+	return symbol.Scope == FunctionScope
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
+	if !ok && s.Outer != nil {
+		obj, ok = s.Outer.Resolve(name)
+		if !ok {
+			return obj, ok
+		}
+		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+			return obj, ok
+		}
+		return s.defineFree(obj), true
+	}
 	return obj, ok
 }
+
+// GlobalNames maps the global slots defined in s, and in the modules
+// compiled in it, to their names. Names from modules are qualified as
+// module.name. A slot whose name was redefined later keeps no name.
+func (s *SymbolTable) GlobalNames() map[int]string {
+	names := map[int]string{}
+	s.collectGlobalNames("", names)
+	return names
+}
+
+func (s *SymbolTable) collectGlobalNames(prefix string, names map[int]string) {
+	for name, symbol := range s.store {
+		if symbol.Scope == GlobalScope {
+			names[symbol.Index] = prefix + name
+		}
+	}
+	modules := make([]string, 0, len(s.modules))
+	for name := range s.modules {
+		modules = append(modules, name)
+	}
+	sort.Strings(modules)
+	for _, name := range modules {
+		s.modules[name].collectGlobalNames(prefix+name+".", names)
+	}
+}
@@ -19,6 +19,35 @@ func TestDefine(t *testing.T) {
 		t.Errorf("expected b=%+v, got=%+v", expected["b"], b)
 	}
 }
+
+func TestBlockDeclarations(t *testing.T) {
+	global := NewSymbolTable()
+	a := global.Define("a")
+	global.EnterBlock()
+	if again := global.Define("a"); again.Index != a.Index || MaybeUnset(again) {
+		t.Errorf("declaring a again should reuse its slot. got=%+v", again)
+	}
+	b := global.Define("b")
+	if MaybeUnset(b) {
+		t.Errorf("b is set in the block declaring it")
+	}
+	global.LeaveBlock()
+	if b, _ := global.Resolve("b"); !MaybeUnset(b) {
+		t.Errorf("b may be unset after the block declaring it")
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	local.EnterBlock()
+	shadow := local.Define("a")
+	local.LeaveBlock()
+	if !MaybeUnset(shadow) {
+		t.Fatalf("the local a may be unset after its block")
+	}
+	if fallback, ok := local.Fallback(shadow); !ok || fallback != a {
+		t.Errorf("the local a should fall back to the global. got=%+v, %v", fallback, ok)
+	}
+}
+
 func TestResolveGlobal(t *testing.T) {
 	global := NewSymbolTable()
 	global.Define("a")
@@ -39,3 +68,109 @@ func TestResolveGlobal(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveLocalAndFree(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	firstLocal := NewEnclosedSymbolTable(global)
+	firstLocal.Define("c")
+	secondLocal := NewEnclosedSymbolTable(firstLocal)
+	secondLocal.Define("e")
+
+	expected := []Symbol{
+		Symbol{Name: "a", Scope: GlobalScope, Index: 0},
+		Symbol{Name: "c", Scope: FreeScope, Index: 0},
+		Symbol{Name: "e", Scope: LocalScope, Index: 0},
+	}
+	for _, sym := range expected {
+		result, ok := secondLocal.Resolve(sym.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", sym.Name)
+			continue
+		}
+		if result != sym {
+			t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+		}
+	}
+	if len(secondLocal.FreeSymbols) != 1 || secondLocal.FreeSymbols[0].Scope != LocalScope {
+		t.Errorf("wrong free symbols. got=%+v", secondLocal.FreeSymbols)
+	}
+	if _, ok := secondLocal.Resolve("missing"); ok {
+		t.Errorf("name missing resolved, but was expected not to")
+	}
+}
+
+func TestDefineAndResolveFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineFunctionName("a")
+	expected := Symbol{Name: "a", Scope: FunctionScope, Index: 0}
+	result, ok := global.Resolve(expected.Name)
+	if !ok || result != expected {
+		t.Errorf("expected a to resolve to %+v, got=%+v", expected, result)
+	}
+}
+
+func TestDefineResolveBuiltins(t *testing.T) {
+	global := NewSymbolTable()
+	local := NewEnclosedSymbolTable(global)
+	expected := []Symbol{
+		{Name: "a", Scope: BuiltinScope, Index: 0},
+		{Name: "c", Scope: BuiltinScope, Index: 1},
+	}
+	for i, v := range expected {
+		global.DefineBuiltin(i, v.Name)
+	}
+	for _, table := range []*SymbolTable{global, local} {
+		for _, sym := range expected {
+			result, ok := table.Resolve(sym.Name)
+			if !ok || result != sym {
+				t.Errorf("expected %s to resolve to %+v, got=%+v", sym.Name, sym, result)
+			}
+		}
+	}
+	if len(local.FreeSymbols) != 0 {
+		t.Errorf("builtins must not be captured as free symbols, got=%+v", local.FreeSymbols)
+	}
+}
+
+func TestModuleSymbols(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	module := NewModuleSymbolTable(global, "m")
+	module.Define("a")
+	module.DefineConst("b")
+	module.Export("b")
+	global.DefineModule("m", module)
+	local := NewEnclosedSymbolTable(module)
+
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 1}
+	if result, ok := local.Resolve("a"); !ok || result != expected {
+		t.Errorf("expected a to resolve to %+v, got=%+v", expected, result)
+	}
+	if result, _ := global.Resolve("a"); result.Index != 0 {
+		t.Errorf("module definitions must not shadow the program's, got=%+v", result)
+	}
+	if mod, ok := local.ResolveModule("m"); !ok || mod != module {
+		t.Errorf("module m not resolved")
+	}
+	if _, ok, isMut := module.ResolveExport("a"); ok || !isMut {
+		t.Errorf("a must be private and mutable")
+	}
+	expected = Symbol{Name: "b", Scope: GlobalScope, Index: 2}
+	if result, ok, _ := module.ResolveExport("b"); !ok || result != expected {
+		t.Errorf("expected b to be exported as %+v, got=%+v", expected, result)
+	}
+}
+
+func TestConstSymbols(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineConst("a")
+	local := NewEnclosedSymbolTable(global)
+	if !local.IsConst("a") {
+		t.Errorf("expected a to be const in an enclosed table")
+	}
+	local.Define("a")
+	if local.IsConst("a") {
+		t.Errorf("expected local a to shadow the const")
+	}
+}
@@ -0,0 +1,217 @@
+// Package differential runs scripts through both execution engines, the
+// tree-walking evaluator and the bytecode compiler with its VM, and
+// reports where they disagree: in the value of the script, in what it
+// printed, or in the error it failed with.
+package differential
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pecet3/hmbk-script/ast"
+	"github.com/pecet3/hmbk-script/compiler"
+	"github.com/pecet3/hmbk-script/evaluation"
+	"github.com/pecet3/hmbk-script/lexer"
+	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/parser"
+	"github.com/pecet3/hmbk-script/token"
+	"github.com/pecet3/hmbk-script/vm"
+)
+
+// Outcome is what running a script with one engine produced. Value is
+// only set when the script ends with an expression, since the engines
+// have no common notion of the value of a statement.
+type Outcome struct {
+	Value  string
+	Output string
+	Error  string
+	// ErrorPos is where Error was raised, if the engine knows.
+	ErrorPos token.Position
+}
+
+func (o Outcome) String() string {
+	var out strings.Builder
+	if o.Error != "" {
+		fmt.Fprintf(&out, "error: %s", o.Error)
+		if o.ErrorPos.IsValid() {
+			fmt.Fprintf(&out, " at %s", o.ErrorPos)
+		}
+	} else {
+		fmt.Fprintf(&out, "value: %s", o.Value)
+	}
+	if o.Output != "" {
+		fmt.Fprintf(&out, "\noutput: %q", o.Output)
+	}
+	return out.String()
+}
+
+// Diff is a script the engines disagree on.
+type Diff struct {
+	Name   string
+	Source string
+	Eval   Outcome
+	VM     Outcome
+	// Fields lists what differs: "value", "output" and/or "error".
+	Fields []string
+}
+
+func (d *Diff) String() string {
+	return fmt.Sprintf("%s: %s differ\n--- eval\n%s\n--- vm\n%s\n",
+		d.Name, strings.Join(d.Fields, ", "), d.Eval, d.VM)
+}
+
+// Compare parses source and runs it with both engines. It returns nil if
+// they agree, and an error if source does not parse or compile. It is safe
+// to call from several goroutines at once.
+//
+// Errors are compared by message and position. The few messages the
+// engines word differently are listed in acceptedWordings.
+func Compare(name, source string) (*Diff, error) {
+	p := parser.New(lexer.NewWithFile(source, name))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return nil, fmt.Errorf("%s: parser error: %s", name, p.Errors()[0])
+	}
+	bytecode, err := compile(program)
+	if err != nil {
+		return nil, fmt.Errorf("%s: compilation error: %s", name, err)
+	}
+
+	d := &Diff{Name: name, Source: source, Eval: RunEval(program), VM: RunVM(bytecode)}
+	if !endsWithExpression(program) {
+		d.Eval.Value, d.VM.Value = "", ""
+	}
+	if !sameError(d.Eval, d.VM) {
+		d.Fields = append(d.Fields, "error")
+	} else if d.Eval.Error == "" && d.Eval.Value != d.VM.Value {
+		d.Fields = append(d.Fields, "value")
+	}
+	if d.Eval.Output != d.VM.Output {
+		d.Fields = append(d.Fields, "output")
+	}
+	if len(d.Fields) == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// CompareFiles compares every .hmbk script in paths, which may be files or
+// directories.
+func CompareFiles(paths []string) ([]*Diff, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.hmbk"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+
+	var diffs []*Diff
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		d, err := Compare(file, string(data))
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+// acceptedWordings are the words the engines' error messages may differ
+// in: the evaluator's, and the VM's in its place.
+var acceptedWordings = []struct{ eval, vm string }{
+	// script functions are FUNCTION objects in the evaluator and CLOSURE
+	// objects on the VM
+	{"FUNCTION", "CLOSURE"},
+}
+
+func sameError(eval, vm Outcome) bool {
+	if eval.ErrorPos != vm.ErrorPos {
+		return false
+	}
+	message := eval.Error
+	for _, w := range acceptedWordings {
+		message = strings.ReplaceAll(message, w.eval, w.vm)
+	}
+	return message == vm.Error
+}
+
+func compile(program *ast.Program) (*compiler.Bytecode, error) {
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		return nil, err
+	}
+	return comp.Bytecode(), nil
+}
+
+func endsWithExpression(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+	_, ok := program.Statements[len(program.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
+// RunEval runs program with the evaluator.
+func RunEval(program *ast.Program) (o Outcome) {
+	var out bytes.Buffer
+	defer func() { o.Output = out.String() }()
+	defer recoverInto(&o)
+	env := object.NewEnvironment()
+	env.SetOutput(&out)
+	result := evaluation.Eval(program, env)
+	if ge, ok := result.(*object.GlobalError); ok {
+		o.Error, o.ErrorPos = ge.Message, ge.Pos
+		return o
+	}
+	o.Value = inspect(result)
+	return o
+}
+
+// RunVM runs bytecode on the VM.
+func RunVM(bytecode *compiler.Bytecode) (o Outcome) {
+	var out bytes.Buffer
+	defer func() { o.Output = out.String() }()
+	defer recoverInto(&o)
+	machine := vm.New(bytecode)
+	machine.SetOutput(&out)
+	if err := machine.Run(); err != nil {
+		o.Error, o.ErrorPos = err.Error(), machine.ErrorPosition(err)
+		return o
+	}
+	o.Value = inspect(machine.LastPoppedStackElem())
+	return o
+}
+
+func inspect(obj object.Object) string {
+	if obj == nil {
+		return object.NullValue.Inspect()
+	}
+	return obj.Inspect()
+}
+
+// recoverInto turns a panic in an engine into an error, which is always a
+// difference worth reporting.
+func recoverInto(o *Outcome) {
+	if r := recover(); r != nil {
+		o.Error = fmt.Sprintf("panic: %v", r)
+	}
+}
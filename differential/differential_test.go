@@ -0,0 +1,111 @@
+package differential
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/pecet3/hmbk-script/lexer"
+	"github.com/pecet3/hmbk-script/parser"
+	"github.com/pecet3/hmbk-script/token"
+)
+
+func TestCorpus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.hmbk"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no testdata: %v", err)
+	}
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			// each engine prints to its own buffer, so files run at once
+			t.Parallel()
+			diffs, err := CompareFiles([]string{file})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range diffs {
+				t.Errorf("%s", d)
+			}
+		})
+	}
+}
+
+func TestFuzz(t *testing.T) {
+	diffs, err := Fuzz(rand.New(rand.NewSource(1)), 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range diffs {
+		t.Errorf("%s\n%s", d, d.Source)
+	}
+}
+
+// TestFormat checks that generated programs parse back into the tree they
+// were printed from, by printing that tree again.
+func TestFormat(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		source := Generate(r)
+		p := parser.New(lexer.New(source))
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			t.Fatalf("parser errors: %v\n%s", p.Errors(), source)
+		}
+		if got := format(program); got != source {
+			t.Fatalf("printed differently after parsing:\n%s\nwant:\n%s", got, source)
+		}
+	}
+}
+
+func TestSameError(t *testing.T) {
+	pos := token.Position{Line: 1, Column: 3}
+	tests := []struct {
+		eval, vm Outcome
+		same     bool
+	}{
+		{Outcome{}, Outcome{}, true},
+		{Outcome{Error: "division by zero", ErrorPos: pos}, Outcome{Error: "division by zero", ErrorPos: pos}, true},
+		{Outcome{Error: "division by zero", ErrorPos: pos}, Outcome{Error: "division by zero"}, false},
+		{Outcome{Error: "division by zero"}, Outcome{Error: "unknown operator: NUMBER / NUMBER"}, false},
+		{Outcome{Error: "division by zero"}, Outcome{}, false},
+		{Outcome{Error: "type mismatch: NUMBER + FUNCTION"}, Outcome{Error: "type mismatch: NUMBER + CLOSURE"}, true},
+		{Outcome{Error: "type mismatch: NUMBER + FUNCTION"}, Outcome{Error: "type mismatch: CLOSURE + NUMBER"}, false},
+	}
+	for _, tt := range tests {
+		if got := sameError(tt.eval, tt.vm); got != tt.same {
+			t.Errorf("sameError(%q, %q) = %v, want %v", tt.eval, tt.vm, got, tt.same)
+		}
+	}
+}
+
+// FuzzEngines compares the programs generated from the fuzzed seeds; run
+// it with go test -fuzz=FuzzEngines ./differential.
+func FuzzEngines(f *testing.F) {
+	for seed := int64(0); seed < 8; seed++ {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		source := Generate(rand.New(rand.NewSource(seed)))
+		d, err := Compare("fuzz.hmbk", source)
+		if err != nil {
+			t.Fatalf("%s\n%s", err, source)
+		}
+		if d != nil {
+			t.Errorf("%s\n%s", d, d.Source)
+		}
+	})
+}
+
+func TestOutputIsCaptured(t *testing.T) {
+	program := parser.New(lexer.New(`print("a"); print(1 + 1);`)).ParseProgram()
+	bytecode, err := compile(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, o := range map[string]Outcome{"eval": RunEval(program), "vm": RunVM(bytecode)} {
+		if o.Output != "a\n2\n" {
+			t.Errorf("%s: wrong output. got=%q", name, o.Output)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package differential
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pecet3/hmbk-script/ast"
+)
+
+// format prints node as source that parses back into the same tree. The
+// String methods of the ast are for debugging and drop braces, quotes and
+// separators. Every infix and prefix expression is parenthesized, so no
+// precedence is needed, and every statement ends with a `;`, so the next
+// one cannot continue it.
+func format(node ast.Node) string {
+	switch node := node.(type) {
+	case *ast.Program:
+		return formatStatements(node.Statements)
+	case *ast.BlockStatement:
+		if len(node.Statements) == 0 {
+			return "{ }"
+		}
+		return "{\n" + formatStatements(node.Statements) + "}"
+	case *ast.ExpressionStatement:
+		if ifExpr, ok := node.Expression.(*ast.IfExpression); ok {
+			return formatIf(ifExpr)
+		}
+		return format(node.Expression)
+	case *ast.MutStatement:
+		return "mut " + node.Name.Value + " = " + format(node.Value)
+	case *ast.ConstStatement:
+		return "const " + node.Name.Value + " = " + format(node.Value)
+	case *ast.AssignmentStatement:
+		return node.Name.Value + " = " + format(node.Value)
+	case *ast.ReturnStatement:
+		return "return " + format(node.ReturnValue)
+	case *ast.ThrowStatement:
+		return "throw " + format(node.Value)
+	case *ast.BreakStatement:
+		return "break"
+	case *ast.ContinueStatement:
+		return "continue"
+	case *ast.WhileStatement:
+		return "while (" + format(node.Condition) + ") " + format(node.Body)
+	case *ast.ForInStatement:
+		vars := node.Value.Value
+		if node.Key != nil {
+			vars = node.Key.Value + ", " + vars
+		}
+		return "for (" + vars + " in " + format(node.Iterable) + ") " + format(node.Body)
+	case *ast.TryStatement:
+		out := "try " + format(node.Block)
+		if node.Catch != nil {
+			out += " catch "
+			if node.Param != nil {
+				out += "(" + node.Param.Value + ") "
+			}
+			out += format(node.Catch)
+		}
+		if node.Finally != nil {
+			out += " finally " + format(node.Finally)
+		}
+		return out
+	case *ast.IfExpression:
+		// parenthesized, since an if cannot be followed by `,` or `]`
+		return "(" + formatIf(node) + ")"
+	case *ast.FunctionLiteral:
+		params := make([]string, len(node.Parameters))
+		for i, p := range node.Parameters {
+			params[i] = p.Value
+		}
+		return "fn(" + strings.Join(params, ", ") + ") " + format(node.Body)
+	case *ast.CallExpression:
+		return format(node.Function) + "(" + formatList(node.Arguments) + ")"
+	case *ast.PrefixExpression:
+		return "(" + node.Operator + format(node.Right) + ")"
+	case *ast.InfixExpression:
+		return "(" + format(node.Left) + " " + node.Operator + " " + format(node.Right) + ")"
+	case *ast.IndexExpression:
+		return format(node.Left) + "[" + format(node.Index) + "]"
+	case *ast.ArrayLiteral:
+		return "[" + formatList(node.Elements) + "]"
+	case *ast.HashLiteral:
+		pairs := make([]string, 0, len(node.Pairs))
+		for key, value := range node.Pairs {
+			pairs = append(pairs, format(key)+": "+format(value))
+		}
+		// the order of the pairs is the order of the map, so sort it to
+		// print the same program every time
+		sort.Strings(pairs)
+		return "{" + strings.Join(pairs, ", ") + "}"
+	case *ast.TemplateLiteral:
+		var out strings.Builder
+		out.WriteString(`"`)
+		for _, part := range node.Parts {
+			if str, ok := part.(*ast.StringLiteral); ok {
+				out.WriteString(escape(str.Value))
+				continue
+			}
+			out.WriteString("${" + format(part) + "}")
+		}
+		out.WriteString(`"`)
+		return out.String()
+	case *ast.StringLiteral:
+		return `"` + escape(node.Value) + `"`
+	case *ast.Identifier:
+		return node.Value
+	case *ast.IntegerLiteral:
+		return strconv.FormatInt(node.Value, 10)
+	case *ast.FloatLiteral:
+		return strconv.FormatFloat(node.Value, 'f', -1, 64)
+	case *ast.Boolean:
+		return strconv.FormatBool(node.Value)
+	}
+	panic(fmt.Sprintf("format: unsupported node %T", node))
+}
+
+func formatStatements(statements []ast.Statement) string {
+	var out strings.Builder
+	for _, s := range statements {
+		out.WriteString(format(s))
+		out.WriteString(";\n")
+	}
+	return out.String()
+}
+
+func formatIf(node *ast.IfExpression) string {
+	out := "if (" + format(node.Condition) + ") " + format(node.Consequence)
+	if node.Alternative != nil {
+		out += " else " + format(node.Alternative)
+	}
+	return out
+}
+
+func formatList(expressions []ast.Expression) string {
+	items := make([]string, len(expressions))
+	for i, e := range expressions {
+		items[i] = format(e)
+	}
+	return strings.Join(items, ", ")
+}
+
+var escapes = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "\n", `\n`, "\t", `\t`, "\r", `\r`, "\x00", `\0`)
+
+// escape writes s for a double-quoted string, where ${ would start an
+// interpolation.
+func escape(s string) string {
+	return escapes.Replace(s)
+}
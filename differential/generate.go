@@ -0,0 +1,388 @@
+package differential
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/pecet3/hmbk-script/ast"
+)
+
+// Generate returns a random program built from the statement and
+// expression forms of the language: declarations, assignments, if, for,
+// try and throw, function definitions and calls, and nested expressions
+// over numbers, strings, booleans, arrays and hashes. The program is built
+// as an ast and printed as source, so Compare runs it like any script.
+//
+// The programs always terminate: loops only go over small ranges and
+// functions cannot call themselves. They may fail at run time, which is
+// part of what the engines have to agree on, down to the error message
+// and its position. Variables are also declared in blocks, which may not
+// run before the variable is used, and in functions, shadowing a global.
+func Generate(r *rand.Rand) string {
+	g := &generator{r: r}
+	program := &ast.Program{}
+	statements := 3 + r.Intn(8)
+	for i := 0; i < statements; i++ {
+		program.Statements = append(program.Statements, g.topLevelStatement())
+	}
+	program.Statements = append(program.Statements, expressionStatement(g.expression(0, g.randomKind())))
+	return format(program)
+}
+
+// Fuzz compares n generated programs. A program that does not parse or
+// compile is a bug in the generator and reported as an error.
+func Fuzz(r *rand.Rand, n int) ([]*Diff, error) {
+	var diffs []*Diff
+	for i := 0; i < n; i++ {
+		source := Generate(r)
+		d, err := Compare(fmt.Sprintf("fuzz-%d.hmbk", i), source)
+		if err != nil {
+			return nil, fmt.Errorf("%s\n%s", err, source)
+		}
+		if d != nil {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+const maxDepth = 3
+
+// kind is the type of value an expression is generated for. Most
+// expressions are well typed, so programs get past their first few
+// statements; anyKind mixes types, to compare how the engines fail.
+type kind int
+
+const (
+	numberKind kind = iota
+	stringKind
+	boolKind
+	anyKind
+)
+
+var (
+	variableNames = []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta"}
+	functionNames = []string{"fa", "fb", "fc", "fd"}
+	parameterList = []string{"pa", "pb"}
+	loopNames     = []string{"it", "jt", "kt"}
+	stringValues  = []string{"", "a", "b", "hello", "x y"}
+	arithmeticOps = []string{"+", "-", "*", "/", "%", "**"}
+	comparisonOps = []string{"==", "!=", "<", ">", "<=", ">="}
+	allInfixOps   = append(append([]string{"&&", "||"}, arithmeticOps...), comparisonOps...)
+)
+
+type variable struct {
+	name string
+	kind kind
+}
+
+type function struct {
+	name   string
+	params int
+	kind   kind
+}
+
+type generator struct {
+	r         *rand.Rand
+	variables []variable
+	functions []function
+	// locals are the parameters and loop variables in scope, all numbers
+	locals []string
+	loops  int
+}
+
+func (g *generator) pick(items []string) string {
+	return items[g.r.Intn(len(items))]
+}
+
+func (g *generator) randomKind() kind {
+	if g.r.Intn(10) == 0 {
+		return anyKind
+	}
+	return kind(g.r.Intn(3))
+}
+
+func (g *generator) topLevelStatement() ast.Statement {
+	switch n := g.r.Intn(10); {
+	case n < 3 && len(g.variables) < len(variableNames):
+		return g.declaration(g.undeclaredName(), 0)
+	case n < 4 && len(g.functions) < len(functionNames):
+		return g.functionDefinition()
+	default:
+		return g.statement(0)
+	}
+}
+
+func (g *generator) functionDefinition() ast.Statement {
+	f := function{name: functionNames[len(g.functions)], params: g.r.Intn(3), kind: kind(g.r.Intn(3))}
+	fn := &ast.FunctionLiteral{Body: &ast.BlockStatement{}}
+	for _, p := range parameterList[:f.params] {
+		fn.Parameters = append(fn.Parameters, identifier(p))
+	}
+	saved := g.locals
+	g.locals = append(append([]string{}, g.locals...), parameterList[:f.params]...)
+	body := fn.Body
+	if len(g.variables) > 0 && g.r.Intn(3) == 0 {
+		// a local that is only set if the block runs, and the global
+		// otherwise
+		v := g.variables[g.r.Intn(len(g.variables))]
+		shadow := &ast.MutStatement{Name: identifier(v.name), Value: g.expression(1, v.kind)}
+		body.Statements = append(body.Statements, ifStatement(g.expression(1, boolKind), shadow))
+	}
+	if g.r.Intn(2) == 0 {
+		ret := &ast.ReturnStatement{ReturnValue: g.expression(1, f.kind)}
+		body.Statements = append(body.Statements, ifStatement(g.expression(1, boolKind), ret))
+		body.Statements = append(body.Statements, expressionStatement(g.expression(1, f.kind)))
+	} else {
+		body.Statements = append(body.Statements, expressionStatement(g.expression(0, f.kind)))
+	}
+	g.locals = saved
+	g.functions = append(g.functions, f)
+	return &ast.ConstStatement{Name: identifier(f.name), Value: fn}
+}
+
+// declaration declares the variable name, or declares it again with the
+// same kind. In a block it may not run, so the variable may be unset
+// where it is used later.
+func (g *generator) declaration(name string, depth int) ast.Statement {
+	v, ok := g.variable(name)
+	if !ok {
+		v = variable{name: name, kind: kind(g.r.Intn(3))}
+	}
+	value := g.expression(depth, v.kind)
+	if !ok {
+		g.variables = append(g.variables, v)
+	}
+	return &ast.MutStatement{Name: identifier(v.name), Value: value}
+}
+
+func (g *generator) undeclaredName() string {
+	for _, name := range variableNames {
+		if _, ok := g.variable(name); !ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func (g *generator) variable(name string) (variable, bool) {
+	for _, v := range g.variables {
+		if v.name == name {
+			return v, true
+		}
+	}
+	return variable{}, false
+}
+
+func (g *generator) statement(depth int) ast.Statement {
+	n := g.r.Intn(10)
+	if depth >= maxDepth {
+		n = 0
+	}
+	switch {
+	case n < 2:
+		return expressionStatement(call("print", g.expression(depth, g.randomKind())))
+	case n < 4 && len(g.variables) > 0:
+		v := g.variables[g.r.Intn(len(g.variables))]
+		return &ast.AssignmentStatement{Name: identifier(v.name), Value: g.expression(depth, v.kind)}
+	case n < 5:
+		return expressionStatement(&ast.IfExpression{
+			Condition:   g.expression(depth, boolKind),
+			Consequence: g.block(depth + 1),
+			Alternative: g.block(depth + 1),
+		})
+	case n < 6 && g.loops < len(loopNames):
+		name := loopNames[g.loops]
+		g.loops++
+		saved := g.locals
+		g.locals = append(append([]string{}, g.locals...), name)
+		body := g.block(depth + 1)
+		if g.r.Intn(3) == 0 {
+			body.Statements = append(body.Statements, ifStatement(g.expression(depth+1, boolKind), &ast.BreakStatement{}))
+		}
+		g.locals = saved
+		g.loops--
+		return &ast.ForInStatement{
+			Value:    identifier(name),
+			Iterable: call("range", number(float64(g.r.Intn(4)))),
+			Body:     body,
+		}
+	case n < 7:
+		return &ast.TryStatement{
+			Block: g.block(depth + 1),
+			Param: identifier("err"),
+			Catch: blockOf(expressionStatement(call("print", str("caught")))),
+		}
+	case n < 8 && depth > 0:
+		return ifStatement(g.expression(depth, boolKind), &ast.ThrowStatement{Value: str(g.pick(stringValues))})
+	case n < 9 && depth > 0:
+		return g.declaration(g.pick(variableNames), depth)
+	default:
+		return expressionStatement(g.expression(depth, g.randomKind()))
+	}
+}
+
+func (g *generator) block(depth int) *ast.BlockStatement {
+	block := &ast.BlockStatement{}
+	for i := 1 + g.r.Intn(2); i > 0; i-- {
+		block.Statements = append(block.Statements, g.statement(depth))
+	}
+	return block
+}
+
+func (g *generator) expression(depth int, k kind) ast.Expression {
+	if depth >= maxDepth || g.r.Intn(4) == 0 {
+		return g.leaf(k)
+	}
+	next := depth + 1
+	switch n := g.r.Intn(10); {
+	case n < 1:
+		return &ast.IfExpression{
+			Condition:   g.expression(next, boolKind),
+			Consequence: blockOf(expressionStatement(g.expression(next, k))),
+			Alternative: blockOf(expressionStatement(g.expression(next, k))),
+		}
+	case n < 2:
+		return &ast.IndexExpression{
+			Left:  &ast.ArrayLiteral{Elements: []ast.Expression{g.expression(next, k), g.expression(next, k)}},
+			Index: number(float64(g.r.Intn(2))),
+		}
+	case n < 3:
+		return &ast.IndexExpression{
+			Left:  &ast.HashLiteral{Pairs: map[ast.Expression]ast.Expression{str("k"): g.expression(next, k)}},
+			Index: str("k"),
+		}
+	case n < 4:
+		if f, ok := g.function(k); ok {
+			args := make([]ast.Expression, f.params)
+			for i := range args {
+				args[i] = g.expression(next, numberKind)
+			}
+			return call(f.name, args...)
+		}
+	}
+
+	switch k {
+	case numberKind:
+		switch g.r.Intn(4) {
+		case 0:
+			return &ast.PrefixExpression{Operator: "-", Right: g.expression(next, numberKind)}
+		case 1:
+			return call("len", g.expression(next, stringKind))
+		default:
+			op, right := g.pick(arithmeticOps), g.expression(next, numberKind)
+			if (op == "/" || op == "%") && g.r.Intn(4) > 0 {
+				// mostly a divisor that is not zero, or most programs stop at
+				// their first division
+				right = number(float64(1 + g.r.Intn(9)))
+			}
+			return infix(g.expression(next, numberKind), op, right)
+		}
+	case stringKind:
+		switch g.r.Intn(5) {
+		case 0:
+			return call("to_string", g.expression(next, g.randomKind()))
+		case 1:
+			return call("typeof", g.expression(next, g.randomKind()))
+		case 2:
+			return &ast.TemplateLiteral{Parts: []ast.Expression{str("t "), g.expression(next, g.randomKind())}}
+		case 3:
+			return infix(g.expression(next, stringKind), "+", g.expression(next, numberKind))
+		default:
+			return infix(g.expression(next, stringKind), "+", g.expression(next, stringKind))
+		}
+	case boolKind:
+		switch g.r.Intn(4) {
+		case 0:
+			return &ast.PrefixExpression{Operator: "!", Right: g.expression(next, g.randomKind())}
+		case 1:
+			return infix(g.expression(next, boolKind), g.pick([]string{"&&", "||"}), g.expression(next, boolKind))
+		case 2:
+			return infix(g.expression(next, stringKind), g.pick([]string{"==", "!="}), g.expression(next, stringKind))
+		default:
+			return infix(g.expression(next, numberKind), g.pick(comparisonOps), g.expression(next, numberKind))
+		}
+	default:
+		return infix(g.expression(next, g.randomKind()), g.pick(allInfixOps), g.expression(next, g.randomKind()))
+	}
+}
+
+// function returns a function whose result has kind k, if there is one.
+func (g *generator) function(k kind) (function, bool) {
+	var matching []function
+	for _, f := range g.functions {
+		if f.kind == k || k == anyKind {
+			matching = append(matching, f)
+		}
+	}
+	if len(matching) == 0 {
+		return function{}, false
+	}
+	return matching[g.r.Intn(len(matching))], true
+}
+
+// leaf returns a literal or a variable of kind k.
+func (g *generator) leaf(k kind) ast.Expression {
+	if k == anyKind {
+		k = kind(g.r.Intn(3))
+	}
+	var names []string
+	for _, v := range g.variables {
+		if v.kind == k {
+			names = append(names, v.name)
+		}
+	}
+	if k == numberKind {
+		names = append(names, g.locals...)
+	}
+	if len(names) > 0 && g.r.Intn(2) == 0 {
+		return identifier(g.pick(names))
+	}
+	switch k {
+	case numberKind:
+		if g.r.Intn(4) == 0 {
+			return number(float64(g.r.Intn(10)) + 0.5)
+		}
+		return number(float64(g.r.Intn(10)))
+	case stringKind:
+		return str(g.pick(stringValues))
+	default:
+		return &ast.Boolean{Value: g.r.Intn(2) == 0}
+	}
+}
+
+func identifier(name string) *ast.Identifier {
+	return &ast.Identifier{Value: name}
+}
+
+func number(value float64) ast.Expression {
+	if value == float64(int64(value)) {
+		return &ast.IntegerLiteral{Value: int64(value)}
+	}
+	return &ast.FloatLiteral{Value: value}
+}
+
+func str(value string) *ast.StringLiteral {
+	return &ast.StringLiteral{Value: value}
+}
+
+func call(name string, args ...ast.Expression) *ast.CallExpression {
+	return &ast.CallExpression{Function: identifier(name), Arguments: args}
+}
+
+func infix(left ast.Expression, operator string, right ast.Expression) *ast.InfixExpression {
+	return &ast.InfixExpression{Left: left, Operator: operator, Right: right}
+}
+
+func expressionStatement(e ast.Expression) *ast.ExpressionStatement {
+	return &ast.ExpressionStatement{Expression: e}
+}
+
+func blockOf(statements ...ast.Statement) *ast.BlockStatement {
+	return &ast.BlockStatement{Statements: statements}
+}
+
+// ifStatement is `if (condition) { body }`, without an else.
+func ifStatement(condition ast.Expression, body ast.Statement) *ast.ExpressionStatement {
+	return expressionStatement(&ast.IfExpression{Condition: condition, Consequence: blockOf(body)})
+}
@@ -1,6 +1,7 @@
 package evaluation
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/pecet3/hmbk-script/lexer"
@@ -34,6 +35,14 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"10 % 3", 1},
+		{"-7 % 3", -1},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"(-2) ** 2", 4},
+		{"2 ** -1", 0.5},
+		{"1 + 2 * 3 ** 2 % 5", 4},
 	}
 	for _, tt := range tests {
 		evaluated := testEval(tt.input)
@@ -54,7 +63,7 @@ func testIntegerObject(t *testing.T, obj object.Object, expected float64) bool {
 		return false
 	}
 	if result.Value != expected {
-		t.Errorf("object has wrong value. got=%d, want=%d",
+		t.Errorf("object has wrong value. got=%g, want=%g",
 			result.Value, expected)
 		return false
 	}
@@ -180,11 +189,11 @@ func TestErrorHandling(t *testing.T) {
 	}{
 		{
 			"5 + true;",
-			"type mismatch: INTEGER + BOOL",
+			"type mismatch: NUMBER + BOOL",
 		},
 		{
 			"5 + true; 5;",
-			"type mismatch: INTEGER + BOOL",
+			"type mismatch: NUMBER + BOOL",
 		},
 		{
 			"-true",
@@ -221,10 +230,22 @@ func TestErrorHandling(t *testing.T) {
 			`"Hello" - "World"`,
 			"unknown operator: STRING - STRING",
 		},
+		{
+			`1 - "a"`,
+			"unknown operator: NUMBER - STRING",
+		},
+		{
+			"10 / 0",
+			"division by zero",
+		},
+		{
+			"10 % 0",
+			"division by zero",
+		},
 	}
 	for _, tt := range tests {
 		evaluated := testEval(tt.input)
-		errObj, ok := evaluated.(*object.Error)
+		errObj, ok := evaluated.(*object.GlobalError)
 		if !ok {
 			t.Errorf("no error object returned. got=%T(%+v)",
 				evaluated, evaluated)
@@ -242,10 +263,10 @@ func TestLetStatements(t *testing.T) {
 		input    string
 		expected float64
 	}{
-		{"let a = 5; a;", 5},
-		{"let a = 5 * 5; a;", 25},
-		{"let a = 5; let b = a; b;", 5},
-		{"let a = 5; let b = a; let c = a + b + 5; c;", 15},
+		{"mut a = 5; a;", 5},
+		{"mut a = 5 * 5; a;", 25},
+		{"mut a = 5; mut b = a; b;", 5},
+		{"mut a = 5; mut b = a; mut c = a + b + 5; c;", 15},
 	}
 	for _, tt := range tests {
 		testIntegerObject(t, testEval(tt.input), tt.expected)
@@ -276,11 +297,11 @@ func TestFunctionApplication(t *testing.T) {
 		input    string
 		expected float64
 	}{
-		{"let identity = fn(x) { x; }; identity(5);", 5},
-		{"let identity = fn(x) { return x; }; identity(5);", 5},
-		{"let double = fn(x) { x * 2; }; double(5);", 10},
-		{"let add = fn(x, y) { x + y; }; add(5, 5);", 10},
-		{"let add = fn(x, y) { x + y; }; add(5 + 5, add(5, 5));", 20},
+		{"mut identity = fn(x) { x; }; identity(5);", 5},
+		{"mut identity = fn(x) { return x; }; identity(5);", 5},
+		{"mut double = fn(x) { x * 2; }; double(5);", 10},
+		{"mut add = fn(x, y) { x + y; }; add(5, 5);", 10},
+		{"mut add = fn(x, y) { x + y; }; add(5 + 5, add(5, 5));", 20},
 		{"fn(x) { x; }(5)", 5},
 	}
 	for _, tt := range tests {
@@ -288,6 +309,27 @@ func TestFunctionApplication(t *testing.T) {
 	}
 }
 
+func TestScoping(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		// a declaration in a function is local to it
+		{"mut y = 1; mut f = fn() { mut y = 2; y }; f(); y", 1},
+		{"mut f = fn() { mut y = 1; mut g = fn() { mut y = 2; y }; g(); y }; f()", 1},
+		// an assignment goes to the nearest binding, however far out
+		{"mut g = 0; mut h = fn() { mut inc = fn() { g = g + 1 }; inc() }; h(); g", 1},
+		{"mut f = fn() { mut a = 1; mut g = fn() { mut h = fn() { a = a + 1 }; h(); a }; g() }; f()", 2},
+		// blocks don't open a scope
+		{"if (true) { mut z = 3 }; z", 3},
+		// a catch parameter is declared where the try statement is
+		{"mut y = 1; mut f = fn() { try { throw \"x\" } catch (y) { }; 2 }; f() + y", 3},
+	}
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
 func TestStringLiteral(t *testing.T) {
 	input := `"Hello World!"`
 	evaluated := testEval(input)
@@ -312,6 +354,28 @@ func TestStringConcatenation(t *testing.T) {
 	}
 }
 
+func TestNumberStringConcatenation(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`1 + "a"`, "1a"},
+		{`"a" + 1`, "a1"},
+		{`"n=" + 2.5`, "n=2.5"},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		str, ok := evaluated.(*object.String)
+		if !ok {
+			t.Errorf("object is not String. got=%T (%+v)", evaluated, evaluated)
+			continue
+		}
+		if str.Value != tt.expected {
+			t.Errorf("String has wrong value. expected=%q, got=%q", tt.expected, str.Value)
+		}
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -320,7 +384,7 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
-		{`len(1)`, "argument to `len` not supported, got INTEGER"},
+		{`len(1)`, "argument to `len` not supported, got NUMBER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
 	}
 	for _, tt := range tests {
@@ -329,7 +393,7 @@ func TestBuiltinFunctions(t *testing.T) {
 		case int:
 			testIntegerObject(t, evaluated, float64(expected))
 		case string:
-			errObj, ok := evaluated.(*object.Error)
+			errObj, ok := evaluated.(*object.GlobalError)
 			if !ok {
 				t.Errorf("object is not Error. got=%T (%+v)",
 					evaluated, evaluated)
@@ -377,7 +441,7 @@ func TestArrayIndexExpressions(t *testing.T) {
 			3,
 		},
 		{
-			"let i = 0; [1][i];",
+			"mut i = 0; [1][i];",
 			1,
 		},
 		{
@@ -385,15 +449,15 @@ func TestArrayIndexExpressions(t *testing.T) {
 			3,
 		},
 		{
-			"let myArray = [1, 2, 3]; myArray[2];",
+			"mut myArray = [1, 2, 3]; myArray[2];",
 			3,
 		},
 		{
-			"let myArray = [1, 2, 3]; myArray[0] + myArray[1] + myArray[2];",
+			"mut myArray = [1, 2, 3]; myArray[0] + myArray[1] + myArray[2];",
 			6,
 		},
 		{
-			"let myArray = [1, 2, 3]; let i = myArray[0]; myArray[i]",
+			"mut myArray = [1, 2, 3]; mut i = myArray[0]; myArray[i]",
 			2,
 		},
 		{
@@ -417,7 +481,7 @@ func TestArrayIndexExpressions(t *testing.T) {
 }
 
 func TestHashLiterals(t *testing.T) {
-	input := `let two = "two";
+	input := `mut two = "two";
 {
 "one": 10 - 9,
 two: 1 + 1,
@@ -465,7 +529,7 @@ func TestHashIndexExpressions(t *testing.T) {
 			nil,
 		},
 		{
-			`let key = "foo"; {"foo": 5}[key]`,
+			`mut key = "foo"; {"foo": 5}[key]`,
 			5,
 		},
 		{
@@ -495,3 +559,328 @@ func TestHashIndexExpressions(t *testing.T) {
 		}
 	}
 }
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedInspect string
+	}{
+		{"mut a = 1;\nmut b = a + true;", "GLOBAL ERROR: 2:11: type mismatch: NUMBER + BOOL"},
+		{"mut f = fn(x) {\n  return -x;\n};\nf(true);", "GLOBAL ERROR: 2:10: unknown operator: -BOOL"},
+		{"\n\n   missing", "GLOBAL ERROR: 3:4: identifier not found: missing"},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		errObj, ok := evaluated.(*object.GlobalError)
+		if !ok {
+			t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+			continue
+		}
+		if errObj.Inspect() != tt.expectedInspect {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedInspect, errObj.Inspect())
+		}
+	}
+}
+
+func TestStringInterpolation(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`mut name = "world"; "Hello ${name}!"`, "Hello world!"},
+		{`mut user = {"name": "Ala", "age": 30}; "Hello ${user["name"]}, you are ${user["age"]}"`, "Hello Ala, you are 30"},
+		{`"${1 + 2} = ${3}"`, "3 = 3"},
+		{`mut f = fn(x) { x * 2 }; "<p>${f(21)}</p>"`, "<p>42</p>"},
+		{`"list: ${[1, 2]} ${true}"`, "list: [1, 2] true"},
+		{`"${"a" + "${"b"}"}"`, "ab"},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		str, ok := evaluated.(*object.String)
+		if !ok {
+			t.Errorf("object is not String. got=%T (%+v)", evaluated, evaluated)
+			continue
+		}
+		if str.Value != tt.expected {
+			t.Errorf("String has wrong value. expected=%q, got=%q", tt.expected, str.Value)
+		}
+	}
+
+	evaluated := testEval(`"value: ${missing}"`)
+	errObj, ok := evaluated.(*object.GlobalError)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+	}
+	if errObj.Inspect() != "GLOBAL ERROR: 1:11: identifier not found: missing" {
+		t.Errorf("wrong error. got=%q", errObj.Inspect())
+	}
+}
+
+func TestLogicalAndComparisonOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		{"null_value() || 5", true},
+		{`"ab" != "a" + "b"`, false},
+		{`"ab" != "ba"`, true},
+	}
+	for _, tt := range tests {
+		input := "mut null_value = fn() { if (false) { 1 } };" + tt.input
+		testBOOLObject(t, testEval(input), tt.expected)
+	}
+}
+
+func TestLogicalShortCircuit(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		// the right operand would be a GlobalError if it was evaluated
+		{"false && missing", false},
+		{"true || missing", true},
+		{"mut called = [];  mut f = fn() { append(called, 1); true }; false && f(); len(called) == 0", true},
+		{"mut called = [];  mut f = fn() { append(called, 1); true }; false || f(); len(called) == 1", true},
+	}
+	for _, tt := range tests {
+		testBOOLObject(t, testEval(tt.input), tt.expected)
+	}
+
+	evaluated := testEval("true && missing")
+	if _, ok := evaluated.(*object.GlobalError); !ok {
+		t.Errorf("expected GlobalError from evaluated right operand. got=%T", evaluated)
+	}
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"mut i = 0; while (i < 5) { i = i + 1; } i", 5},
+		{"mut i = 0; while (true) { i = i + 1; if (i == 3) { break; } } i", 3},
+		{"mut sum = 0; for (x in [1, 2, 3]) { sum = sum + x; } sum", 6},
+		{"mut sum = 0; for (i, x in [10, 20]) { sum = sum + i * x; } sum", 20},
+		{"mut sum = 0; for (x in range(5)) { if (x % 2 == 0) { continue; } sum = sum + x; } sum", 4},
+		{"mut sum = 0; for (x in range(10, 0, -3)) { sum = sum + x; } sum", 22},
+		{"mut sum = 0; for (k, v in {1: 10, 2: 20}) { sum = sum + k * v; } sum", 50},
+		{"len(range(2, 8, 2))", 3},
+		{"mut f = fn() { for (x in [1, 2, 3]) { if (x == 2) { return x * 10; } } 0 }; f()", 20},
+		{"mut n = 0; for (x in [1, 2]) { for (y in [1, 2, 3]) { if (y == 2) { break; } n = n + 1; } } n", 2},
+		{"mut x = 5; for (x in range(2)) {} x", 5},
+		{"mut k = 5; for (k, v in [1, 2]) { k = 9; } k", 5},
+		{"mut f = fn() { mut x = 7; for (x in range(3)) { mut y = x; } x + y }; f()", 9},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+
+	// a function ending with a loop returns null, as an empty one does
+	testNullObject(t, testEval("mut f = fn() { while (false) {} }; f()"))
+	testNullObject(t, testEval("mut f = fn() { for (x in [1]) {} }; f()"))
+	testNullObject(t, testEval("mut f = fn() {}; f()"))
+
+	evaluated := testEval("for (x in range(2)) {} x")
+	if errObj, ok := evaluated.(*object.GlobalError); !ok || errObj.Message != "identifier not found: x" {
+		t.Errorf("expected the loop variable to be out of scope. got=%s", evaluated.Inspect())
+	}
+
+	evaluated = testEval(`mut keys = ""; for (k in {"b": 1, "a": 2, 1: 3, true: 4}) { keys = "${keys}${k}"; } keys`)
+	str, ok := evaluated.(*object.String)
+	if !ok || str.Value != "true1ab" {
+		t.Errorf("wrong hash iteration order. got=%s", evaluated.Inspect())
+	}
+
+	evaluated = testEval("for (x in 5) { x; }")
+	errObj, ok := evaluated.(*object.GlobalError)
+	if !ok || errObj.Message != "cannot iterate over NUMBER" {
+		t.Errorf("expected iteration GlobalError. got=%s", evaluated.Inspect())
+	}
+
+	for _, input := range []string{
+		"const c = 1; for (c in [5]) {} c",
+		"const c = 1; for (c, x in [5]) {} c",
+		"const c = 1; mut f = fn() { for (c in [5]) {} }; f()",
+	} {
+		evaluated = testEval(input)
+		errObj, ok = evaluated.(*object.GlobalError)
+		if !ok || errObj.Message != "assignment to const variable: c" {
+			t.Errorf("expected const GlobalError for %q. got=%s", input, evaluated.Inspect())
+		}
+	}
+}
+
+func TestIndexAssignment(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"mut a = [1, 2, 3]; a[1] = 5; a[1]", 5},
+		{"mut a = [1, 2, 3]; mut b = a; b[0] = 9; a[0]", 9},
+		{`mut h = {"a": 1}; h["b"] = 2; h["a"] + h["b"]`, 3},
+		{`mut h = {"a": 1}; h.a = 7; h.a`, 7},
+		{`mut h = {"user": {"age": 1}}; h["user"]["age"] = 30; h.user.age`, 30},
+		{`mut h = {"xs": [1, 2]}; h.xs[1] = 4; h["xs"][1]`, 4},
+		{"mut a = [0, 0]; for (i, x in a) { a[i] = i + 10; } a[0] + a[1]", 21},
+		{"mut a = [1]; mut f = fn() { a[0] = 2; }; f(); a[0]", 2},
+	}
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+
+	errorTests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"const a = [1]; a[0] = 2;", "assignment to const variable: a"},
+		{`const h = {"a": {}}; h.a["b"] = 2;`, "assignment to const variable: h"},
+		{"const h = {}; mut f = fn() { h.x = 1; }; f();", "assignment to const variable: h"},
+		{"mut a = [1]; a[3] = 2;", "index 3 out of range for array of length 1"},
+		{`mut a = [1]; a["x"] = 2;`, "array index must be a Number, got STRING"},
+		{"mut n = 1; n[0] = 2;", "index assignment not supported: NUMBER"},
+		{"const a = 1; mut f = fn() { a = 2; }; f();", "assignment to const variable: a"},
+	}
+	for _, tt := range errorTests {
+		evaluated := testEval(tt.input)
+		errObj, ok := evaluated.(*object.GlobalError)
+		if !ok {
+			t.Errorf("no error object returned for %q. got=%T(%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expectedMessage {
+			t.Errorf("wrong error message. expected=%q, got=%q", tt.expectedMessage, errObj.Message)
+		}
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`mut r = 0; try { r = 1; } catch (e) { r = 2; } r`, 1},
+		{`mut r = ""; try { len(1, 2); } catch (e) { r = e.message; } r`, "wrong number of arguments. got=2, want=1"},
+		{`mut r = ""; try { missing; } catch (e) { r = "${e.kind} ${e.line}:${e.column}"; } r`, "runtime 1:19"},
+		{`mut r = ""; try { throw "boom"; } catch (e) { r = "${e.kind}: ${e.message}"; } r`, "error: boom"},
+		{`mut r = ""; try { throw error("bad", "ValueError"); } catch (e) { r = e["kind"]; } r`, "ValueError"},
+		{`mut r = 0; try { throw "x"; } catch { r = 5; } r`, 5},
+		{`mut log = ""; try { try { throw "a"; } finally { log = log + "f"; } } catch (e) { log = log + e.message; } log`, "fa"},
+		{`mut log = ""; try { log = "t"; } catch (e) { log = "c"; } finally { log = log + "f"; } log`, "tf"},
+		{`mut n = 0; for (x in [1, 2, 3]) { try { if (x == 2) { continue; } n = n + x; } finally { n = n + 10; } } n`, 34},
+		{`mut f = fn() { try { return 1; } finally { print("cleanup"); } }; f()`, 1},
+		{`mut f = fn() { try { throw "x"; } catch (e) { return is_err(e); } }; f()`, true},
+		// a try is a statement, with no value of its own
+		{`mut f = fn() { try { 1; } catch (e) { 2; } }; f()`, nil},
+		{`mut f = fn() { try { throw "x"; } catch (e) { 2; } }; f()`, nil},
+		// a rethrown error keeps the position where it was first raised
+		{"mut r = 0;\ntry { try { throw \"x\"; } catch (e) { throw e; } } catch (e) { r = e.line * 100 + e.column; } r", 213},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case nil:
+			testNullObject(t, evaluated)
+		case int:
+			testIntegerObject(t, evaluated, float64(expected))
+		case bool:
+			testBOOLObject(t, evaluated, expected)
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("String has wrong value. got=%q, want=%q", str.Value, expected)
+			}
+		}
+	}
+
+	evaluated := testEval(`throw error("not caught", "IOError");`)
+	errObj, ok := evaluated.(*object.GlobalError)
+	if !ok || errObj.Message != "not caught" || errObj.Kind != "IOError" {
+		t.Errorf("expected uncaught GlobalError. got=%s", evaluated.Inspect())
+	}
+
+	for _, input := range []string{
+		`const e = 1; try { throw "x"; } catch (e) {} e`,
+		`const e = 1; try {} catch (e) {} e`,
+	} {
+		evaluated = testEval(input)
+		errObj, ok = evaluated.(*object.GlobalError)
+		if !ok || errObj.Message != "assignment to const variable: e" {
+			t.Errorf("expected const GlobalError for %q. got=%s", input, evaluated.Inspect())
+		}
+	}
+}
+
+func TestStackTraces(t *testing.T) {
+	input := `module util {
+  @ const check = fn(x) {
+    if (x > 1) { missing }
+  };
+}
+const inner = fn(x) {
+  util.check(x)
+};
+const outer = fn(x) {
+  mut y = x * 2;
+  inner(y)
+};
+outer(1);`
+
+	l := lexer.NewWithFile(input, "main.hmbk")
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	evaluated := Eval(program, object.NewEnvironment())
+	errObj, ok := evaluated.(*object.GlobalError)
+	if !ok {
+		t.Fatalf("expected GlobalError. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	expected := `GLOBAL ERROR: main.hmbk:3:18: identifier not found: missing
+    at util.check (main.hmbk:3:18)
+    at inner (main.hmbk:7:3)
+    at outer (main.hmbk:11:3)
+    at <main> (main.hmbk:13:1)`
+	if errObj.Traceback() != expected {
+		t.Errorf("wrong traceback.\nwant=%s\ngot=%s", expected, errObj.Traceback())
+	}
+
+	// a caught and rethrown error keeps the frames it already went through
+	evaluated = testEval(`const f = fn() { missing };
+const g = fn() { try { f() } catch (e) { throw e } };
+g();`)
+	errObj, ok = evaluated.(*object.GlobalError)
+	if !ok {
+		t.Fatalf("expected GlobalError. got=%T (%+v)", evaluated, evaluated)
+	}
+	names := []string{}
+	for _, frame := range errObj.Trace {
+		names = append(names, frame.Function)
+	}
+	if strings.Join(names, ",") != "f,g" {
+		t.Errorf("wrong frames. want=f,g got=%s", strings.Join(names, ","))
+	}
+
+	evaluated = testEval("mut f = fn() { fn() { missing }() }; f();")
+	errObj, ok = evaluated.(*object.GlobalError)
+	if !ok || len(errObj.Trace) != 2 || errObj.Trace[0].Function != "<anonymous>" {
+		t.Errorf("expected anonymous frame. got=%+v", evaluated)
+	}
+}
@@ -1,27 +1,44 @@
 package evaluation
 
 import (
+	"math"
+	"strings"
+
 	"github.com/pecet3/hmbk-script/ast"
 	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/token"
 )
 
 var (
 	TRUE  = &object.Bool{Value: true}
 	FALSE = &object.Bool{Value: false}
-	NULL  = &object.Null{}
+	NULL  = object.NullValue
+
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
 func Eval(n ast.Node, env *object.Environment) object.Object {
-	if len(builtinFunctions) == 0 {
-		initBuiltInFunctions()
-		initModules()
+	initModulesOnce.Do(initModules)
+	result := eval(n, env)
+	// the innermost node that produced the error is the first to see it,
+	// so outer nodes never overwrite an already known position
+	if ge, ok := result.(*object.GlobalError); ok && !ge.Pos.IsValid() {
+		ge.Pos = n.Pos()
 	}
+	return result
+}
+
+func eval(n ast.Node, env *object.Environment) object.Object {
 	switch node := n.(type) {
 	case *ast.Program:
 		return evalProgram(node.Statements, env)
 	case *ast.Module:
-		modEnv := object.NewClosedEnvironment(env)
-		evalProgram(node.Statements, modEnv)
+		modEnv := object.NewModuleEnvironment(env, node.Name)
+		result := evalProgram(node.Statements, modEnv)
+		if isGlobalError(result) {
+			return result
+		}
 		mod, ok := n.(*ast.Module)
 		if !ok {
 			return nil
@@ -45,6 +62,9 @@ func Eval(n ast.Node, env *object.Environment) object.Object {
 	case *ast.Boolean:
 		return boolToObject(node.Value)
 	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, env)
+		}
 		left := Eval(node.Left, env)
 		if isGlobalError(left) {
 			return left
@@ -58,6 +78,18 @@ func Eval(n ast.Node, env *object.Environment) object.Object {
 		return evalBlockStatement(node.Statements, env)
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+	case *ast.ForInStatement:
+		return evalForInStatement(node, env)
+	case *ast.TryStatement:
+		return evalTryStatement(node, env)
+	case *ast.ThrowStatement:
+		return evalThrowStatement(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
 		if isGlobalError(val) {
@@ -69,12 +101,14 @@ func Eval(n ast.Node, env *object.Environment) object.Object {
 		if isGlobalError(val) {
 			return val
 		}
-		env.Set(node.Name.Value, val)
+		nameFunction(val, node.Name.Value)
+		env.Define(node.Name.Value, val)
 	case *ast.ConstStatement:
 		val := Eval(node.Value, env)
 		if isGlobalError(val) {
 			return val
 		}
+		nameFunction(val, node.Name.Value)
 		if node.IsExport {
 			env.SetPublicConst(node.Name.Value, val)
 		}
@@ -95,6 +129,9 @@ func Eval(n ast.Node, env *object.Environment) object.Object {
 		}
 		env.Set(node.Name.Value, val)
 
+	case *ast.IndexAssignmentStatement:
+		return evalIndexAssignmentStatement(node, env)
+
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
 	case *ast.FunctionLiteral:
@@ -111,9 +148,17 @@ func Eval(n ast.Node, env *object.Environment) object.Object {
 			return args[0]
 		}
 
-		return applyFunction(function, args)
+		result := applyFunction(function, args...)
+		if ge, ok := result.(*object.GlobalError); ok {
+			if fn, ok := function.(*object.Function); ok {
+				ge.Trace = append(ge.Trace, object.Frame{Function: functionName(fn), CallPos: callPos(node)})
+			}
+		}
+		return result
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
+	case *ast.TemplateLiteral:
+		return evalTemplateLiteral(node, env)
 
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
@@ -141,7 +186,7 @@ func Eval(n ast.Node, env *object.Environment) object.Object {
 			l := me.Index.Value
 			val, ok := bMod.Env.Get(l)
 			if !ok {
-				return newGlobalError("buildin module %s has no symbol %s", me.Left.String(), l)
+				return newGlobalError("builtin module %s has no symbol %s", me.Left.String(), l)
 			}
 			return val
 		}
@@ -152,7 +197,16 @@ func Eval(n ast.Node, env *object.Environment) object.Object {
 		}
 
 		l := me.Index.Value
-		mod := left.(*object.Module)
+		if hash, ok := left.(*object.Hash); ok {
+			return evalHashIndexExpression(hash, &object.String{Value: l})
+		}
+		if errVal, ok := left.(*object.Error); ok {
+			return evalErrorField(errVal, l)
+		}
+		mod, ok := left.(*object.Module)
+		if !ok {
+			return newGlobalError("member access not supported: %s", left.Type())
+		}
 
 		val, ok := mod.Env.GetPublic(l)
 		if !ok {
@@ -206,9 +260,47 @@ func isTruthy(obj object.Object) bool {
 
 // expression
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// nameFunction names an anonymous function after the variable it is first
+// bound to, for tracebacks.
+func nameFunction(val object.Object, name string) {
+	if fn, ok := val.(*object.Function); ok && fn.Name == "" {
+		fn.Name = name
+	}
+}
+
+func functionName(fn *object.Function) string {
+	name := fn.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	if module := fn.Env.ModuleName(); module != "" {
+		return module + "." + name
+	}
+	return name
+}
+
+// callPos is where a call starts: the callee name, or the module name for
+// calls such as `utils.helper()`.
+func callPos(node *ast.CallExpression) token.Position {
+	if me, ok := node.Function.(*ast.ModuleExpression); ok {
+		return me.Left.Pos()
+	}
+	return node.Function.Pos()
+}
+
+// Call runs fn with args and returns its result, as builtin modules do to
+// call back into the program.
+func Call(fn object.Object, args ...object.Object) object.Object {
+	return applyFunction(fn, args...)
+}
+
+func applyFunction(fn object.Object, args ...object.Object) object.Object {
 	switch fn := fn.(type) {
 	case *object.Function:
+		if len(args) != len(fn.Parameters) {
+			return newGlobalError("wrong number of arguments. got=%d, want=%d",
+				len(args), len(fn.Parameters))
+		}
 		extendedEnv := extendFunctionEnv(fn, args)
 		evaluated := Eval(fn.Body, extendedEnv)
 		return unwrapReturnValue(evaluated)
@@ -224,14 +316,20 @@ func extendFunctionEnv(
 ) *object.Environment {
 	env := object.NewClosedEnvironment(fn.Env)
 	for paramIdx, param := range fn.Parameters {
-		env.Set(param.Value, args[paramIdx])
+		env.Define(param.Value, args[paramIdx])
 	}
 	return env
 }
+
+// unwrapReturnValue returns the result of a function body. A body ending
+// with a loop, or empty, has no value and returns null.
 func unwrapReturnValue(obj object.Object) object.Object {
 	if returnValue, ok := obj.(*object.ReturnValue); ok {
 		return returnValue.Value
 	}
+	if obj == nil {
+		return NULL
+	}
 	return obj
 }
 
@@ -264,12 +362,26 @@ func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Obje
 	return &object.Hash{Pairs: pairs}
 }
 
+func evalTemplateLiteral(node *ast.TemplateLiteral, env *object.Environment) object.Object {
+	var out strings.Builder
+	for _, part := range node.Parts {
+		val := Eval(part, env)
+		if isGlobalError(val) {
+			return val
+		}
+		out.WriteString(val.Inspect())
+	}
+	return &object.String{Value: out.String()}
+}
+
 func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY && index.Type() == object.NUMBER:
 		return evalArrayIndexExpression(left, index)
 	case left.Type() == object.HASH:
 		return evalHashIndexExpression(left, index)
+	case left.Type() == object.ERROR && index.Type() == object.STRING:
+		return evalErrorField(left.(*object.Error), index.(*object.String).Value)
 	case left.Type() == object.MODULE:
 		strIdx, ok := index.(*object.String)
 		if !ok {
@@ -282,7 +394,7 @@ func evalIndexExpression(left, index object.Object) object.Object {
 		}
 		return val
 	default:
-		return newGlobalError("index operator must be an Number, not: %s", left.Type())
+		return newGlobalError("index operator not supported: %s", left.Type())
 	}
 }
 
@@ -313,6 +425,43 @@ func evalArrayIndexExpression(left, index object.Object) object.Object {
 	return array.Elements[idx]
 }
 
+func evalIndexAssignmentStatement(node *ast.IndexAssignmentStatement, env *object.Environment) object.Object {
+	if root := node.Root(); root != nil && env.IsConst(root.Value) {
+		return newGlobalError("assignment to const variable: %s", root.Value)
+	}
+
+	var left, index object.Object
+	switch target := node.Target.(type) {
+	case *ast.IndexExpression:
+		left = Eval(target.Left, env)
+		if isGlobalError(left) {
+			return left
+		}
+		index = Eval(target.Index, env)
+		if isGlobalError(index) {
+			return index
+		}
+	case *ast.ModuleExpression:
+		if _, ok := builtInModules[target.Left.String()]; ok {
+			return newGlobalError("cannot assign to symbol %s of module %s", target.Index.Value, target.Left.String())
+		}
+		left = Eval(target.Left, env)
+		if isGlobalError(left) {
+			return left
+		}
+		index = &object.String{Value: target.Index.Value}
+	}
+
+	val := Eval(node.Value, env)
+	if isGlobalError(val) {
+		return val
+	}
+	if err := object.SetIndex(left, index, val); err != nil {
+		return newGlobalError("%s", err)
+	}
+	return nil
+}
+
 func evalExpressions(
 	exps []ast.Expression,
 	env *object.Environment,
@@ -340,7 +489,10 @@ func evalIdentifier(
 	if ok {
 		return val
 	}
-	if builtin, ok := builtinFunctions[node.Value]; ok {
+	if builtin, ok := env.GetBuiltin(node.Value); ok {
+		return builtin
+	}
+	if builtin := object.GetBuiltinByName(node.Value); builtin != nil {
 		return builtin
 	}
 
@@ -355,7 +507,7 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 		switch result := result.(type) {
 		case *object.ReturnValue:
 			return result.Value
-		case *object.Error:
+		case *object.Error, *object.GlobalError:
 			return result
 		}
 	}
@@ -369,7 +521,8 @@ func evalBlockStatement(stmts []ast.Statement, env *object.Environment) object.O
 		result = Eval(stmt, env)
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE || rt == object.ERROR {
+			if rt == object.RETURN_VALUE || rt == object.ERROR || rt == object.GLOBAL_ERROR ||
+				rt == object.BREAK || rt == object.CONTINUE {
 				return result
 			}
 		}
@@ -391,6 +544,146 @@ func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Obje
 	return NULL
 }
 
+// evalLoopBody runs one iteration and reports whether the loop should stop.
+// A non-nil result is a return value or an error to hand back to the caller.
+func evalLoopBody(body *ast.BlockStatement, env *object.Environment) (object.Object, bool) {
+	result := Eval(body, env)
+	if result == nil {
+		return nil, false
+	}
+	switch result.Type() {
+	case object.BREAK:
+		return nil, true
+	case object.RETURN_VALUE, object.ERROR, object.GLOBAL_ERROR:
+		return result, true
+	}
+	return nil, false
+}
+
+func evalWhileStatement(ws *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(ws.Condition, env)
+		if isGlobalError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return nil
+		}
+		if result, stop := evalLoopBody(ws.Body, env); stop {
+			return result
+		}
+	}
+}
+
+// checkNotConst returns an error if one of the identifiers a loop or a
+// catch block binds names a const, which it would otherwise overwrite. A
+// nil identifier is skipped.
+func checkNotConst(env *object.Environment, idents ...*ast.Identifier) object.Object {
+	for _, ident := range idents {
+		if ident != nil && env.IsConst(ident.Value) {
+			return newGlobalError("assignment to const variable: %s", ident.Value)
+		}
+	}
+	return nil
+}
+
+func evalForInStatement(fs *ast.ForInStatement, env *object.Environment) object.Object {
+	iterable := Eval(fs.Iterable, env)
+	if isGlobalError(iterable) {
+		return iterable
+	}
+	it, ok := object.NewIterator(iterable)
+	if !ok {
+		return newGlobalError("cannot iterate over %s", iterable.Type())
+	}
+	if err := checkNotConst(env, fs.Key, fs.Value); err != nil {
+		return err
+	}
+	names := []string{fs.Value.Value}
+	if fs.Key != nil {
+		names = append(names, fs.Key.Value)
+	}
+	env = object.NewLoopEnvironment(env, names...)
+	for {
+		if fs.Key != nil {
+			key, value, ok := it.Next()
+			if !ok {
+				return nil
+			}
+			env.Define(fs.Key.Value, key)
+			env.Define(fs.Value.Value, value)
+		} else {
+			value, ok := it.NextValue()
+			if !ok {
+				return nil
+			}
+			env.Define(fs.Value.Value, value)
+		}
+		if result, stop := evalLoopBody(fs.Body, env); stop {
+			return result
+		}
+	}
+}
+
+// evalTryStatement hands a GlobalError raised in the try block to the
+// catch block as an error value. The finally block runs on every exit and
+// its own return, break or error replaces the pending result.
+func evalTryStatement(ts *ast.TryStatement, env *object.Environment) object.Object {
+	if err := checkNotConst(env, ts.Param); err != nil {
+		return err
+	}
+	result := Eval(ts.Block, env)
+	if ge, ok := result.(*object.GlobalError); ok && ts.Catch != nil {
+		if ts.Param != nil {
+			env.Define(ts.Param.Value, ge.AsError())
+		}
+		result = Eval(ts.Catch, env)
+	}
+	if ts.Finally != nil {
+		final := Eval(ts.Finally, env)
+		if final != nil {
+			switch final.Type() {
+			case object.RETURN_VALUE, object.GLOBAL_ERROR, object.BREAK, object.CONTINUE:
+				return final
+			}
+		}
+	}
+	// a try is a statement: only what leaves it gets out, not the value of
+	// its last expression, so a function ending with one returns null
+	if result != nil {
+		switch result.Type() {
+		case object.RETURN_VALUE, object.GLOBAL_ERROR, object.BREAK, object.CONTINUE:
+			return result
+		}
+	}
+	return nil
+}
+
+// evalThrowStatement raises a string as a new error, or rethrows an error
+// value keeping its kind and original position.
+func evalThrowStatement(ts *ast.ThrowStatement, env *object.Environment) object.Object {
+	val := Eval(ts.Value, env)
+	if isGlobalError(val) {
+		return val
+	}
+	switch val := val.(type) {
+	case *object.Error:
+		return &object.GlobalError{Message: val.Message, Kind: val.Kind, Pos: val.Pos, Trace: val.Trace}
+	case *object.String:
+		return &object.GlobalError{Message: val.Value, Kind: object.ThrownErrorKind}
+	default:
+		return newGlobalError("throw expects a string or an error, got %s", val.Type())
+	}
+}
+
+func evalErrorField(errVal *object.Error, name string) object.Object {
+	field, ok := errVal.Field(name)
+	if !ok {
+		return newGlobalError("error has no field %s", name)
+	}
+	return field
+}
+
 func evalPrefixExpression(operator string, right object.Object) object.Object {
 	switch operator {
 	case "!":
@@ -435,14 +728,18 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 		}
 		return boolToObject(left == right)
 	case operator == "!=":
+		if left.Type() == object.STRING && right.Type() == object.STRING {
+			return boolToObject(left.Inspect() != right.Inspect())
+		}
 		return boolToObject(left != right)
 	case left.Type() == object.STRING && right.Type() == object.STRING:
 		return evalStringsInfixExpression(operator, left, right)
 	case left.Type() == object.NUMBER && right.Type() == object.STRING:
-		left := left.(*object.Number)
-		right := right.(*object.String)
-
-		return evalStringAndNumberInfixExpression(operator, right, left)
+		if operator != "+" {
+			return newGlobalError("unknown operator: %s %s %s",
+				left.Type(), operator, right.Type())
+		}
+		return &object.String{Value: left.Inspect() + right.(*object.String).Value}
 	case left.Type() == object.STRING && right.Type() == object.NUMBER:
 		left := left.(*object.String)
 		right := right.(*object.Number)
@@ -457,6 +754,26 @@ func evalInfixExpression(operator string, left, right object.Object) object.Obje
 	}
 }
 
+// evalLogicalExpression evaluates && and || with short-circuiting:
+// the right operand is only evaluated when it decides the result.
+func evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isGlobalError(left) {
+		return left
+	}
+	if node.Operator == "&&" && !isTruthy(left) {
+		return FALSE
+	}
+	if node.Operator == "||" && isTruthy(left) {
+		return TRUE
+	}
+	right := Eval(node.Right, env)
+	if isGlobalError(right) {
+		return right
+	}
+	return boolToObject(isTruthy(right))
+}
+
 func evalNumberInfixExpression(
 	operator string, left, right object.Object,
 ) object.Object {
@@ -470,11 +787,25 @@ func evalNumberInfixExpression(
 	case "*":
 		return &object.Number{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newGlobalError("division by zero")
+		}
 		return &object.Number{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newGlobalError("division by zero")
+		}
+		return &object.Number{Value: math.Mod(leftVal, rightVal)}
+	case "**":
+		return &object.Number{Value: math.Pow(leftVal, rightVal)}
 	case "<":
 		return boolToObject(leftVal < rightVal)
 	case ">":
 		return boolToObject(leftVal > rightVal)
+	case "<=":
+		return boolToObject(leftVal <= rightVal)
+	case ">=":
+		return boolToObject(leftVal >= rightVal)
 	case "==":
 		return boolToObject(leftVal == rightVal)
 	case "!=":
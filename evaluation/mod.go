@@ -1,16 +1,20 @@
 package evaluation
 
 import (
+	"sync"
+
+	"github.com/pecet3/hmbk-script/modules"
 	"github.com/pecet3/hmbk-script/object"
 )
 
-var builtInModules map[string]*object.Module
+var (
+	builtInModules  map[string]*object.Module
+	initModulesOnce sync.Once
+)
 
 func initModules() {
-	builtInModules = map[string]*object.Module{
-		"http": {
-			Name: "http",
-			Env:  ModHttp(),
-		},
+	builtInModules = map[string]*object.Module{}
+	for _, name := range object.BuiltinModules {
+		builtInModules[name], _ = modules.New(name, applyFunction)
 	}
 }
@@ -16,7 +16,7 @@ mut add = fn(x, y) {
 };
 
 mut result = add(five, ten);
-!-/*5;
+!-/ *5;
 5 < 10 > 5;
 
 if (5 < 10) {
@@ -151,3 +151,176 @@ const a = import
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := "mut a = 5;\n  \"zażółć\" + b\n"
+
+	tests := []struct {
+		expectedType token.TokenType
+		expectedLine int
+		expectedCol  int
+	}{
+		{token.MUT, 1, 1},
+		{token.IDENT, 1, 5},
+		{token.ASSIGN, 1, 7},
+		{token.INT, 1, 9},
+		{token.SEMICOLON, 1, 10},
+		{token.STRING, 2, 3},
+		{token.PLUS, 2, 12},
+		{token.IDENT, 2, 14},
+		{token.EOF, 3, 1},
+	}
+
+	l := lexer.NewWithFile(input, "main.hmbk")
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Pos.Line != tt.expectedLine || tok.Pos.Column != tt.expectedCol {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLine, tt.expectedCol, tok.Pos.Line, tok.Pos.Column)
+		}
+		if tok.Pos.File != "main.hmbk" {
+			t.Fatalf("tests[%d] - file wrong. got=%q", i, tok.Pos.File)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// line comment
+mut a = 1; // trailing
+/* block
+   comment */ a / 2;
+/// doc line
+////// not a doc
+#
+/* never closed`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.MUT, "mut"},
+		{token.IDENT, "a"},
+		{token.ASSIGN, "="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.DOC_COMMENT, "doc line"},
+		{token.ILLEGAL, "#"},
+		{token.EOF, ""},
+	}
+
+	l := lexer.New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+
+	errors := l.Errors()
+	if len(errors) != 1 || errors[0] != "8:1: unterminated block comment" {
+		t.Fatalf("wrong lexer errors. got=%q", errors)
+	}
+}
+
+func TestStringLiterals(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedString string
+		expectedErrors []string
+	}{
+		{`"hello world"`, "hello world", nil},
+		{`"say \"hi\""`, `say "hi"`, nil},
+		{`"a\nb\tc\\d"`, "a\nb\tc\\d", nil},
+		{`"\u{48}\u{15b}\u{1F600}"`, "H\u015b\U0001F600", nil},
+		{"`raw \\n \"quoted\"\nsecond line`", "raw \\n \"quoted\"\nsecond line", nil},
+		{`"<a href=\"/\">home</a>"`, `<a href="/">home</a>`, nil},
+		{`"bad \q escape"`, "bad q escape", []string{"1:6: unknown escape sequence \\q"}},
+		{`"\u{110000}"`, "", []string{"1:2: invalid unicode escape \\u{110000}"}},
+		{"mut a = \"never closed", "never closed", []string{"1:9: unterminated string"}},
+		{"\n  `never closed", "never closed", []string{"2:3: unterminated raw string"}},
+	}
+
+	for i, tt := range tests {
+		l := lexer.New(tt.input)
+		tok := l.NextToken()
+		for tok.Type != token.STRING && tok.Type != token.EOF {
+			tok = l.NextToken()
+		}
+		if tok.Type != token.STRING {
+			t.Fatalf("tests[%d] - no string token found", i)
+		}
+		if tok.Literal != tt.expectedString {
+			t.Errorf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedString, tok.Literal)
+		}
+		if next := l.NextToken(); next.Type != token.EOF {
+			t.Errorf("tests[%d] - expected EOF after string, got=%q", i, next.Type)
+		}
+		errors := l.Errors()
+		if len(errors) != len(tt.expectedErrors) {
+			t.Fatalf("tests[%d] - wrong errors. expected=%q, got=%q",
+				i, tt.expectedErrors, errors)
+		}
+		for j, msg := range tt.expectedErrors {
+			if errors[j] != msg {
+				t.Errorf("tests[%d] - wrong error. expected=%q, got=%q", i, msg, errors[j])
+			}
+		}
+	}
+}
+
+func TestOperators(t *testing.T) {
+	input := `a <= b >= c && d || e % f ** g < h * i & |`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.LT_EQ, "<="},
+		{token.IDENT, "b"},
+		{token.GT_EQ, ">="},
+		{token.IDENT, "c"},
+		{token.AND, "&&"},
+		{token.IDENT, "d"},
+		{token.OR, "||"},
+		{token.IDENT, "e"},
+		{token.PERCENT, "%"},
+		{token.IDENT, "f"},
+		{token.POWER, "**"},
+		{token.IDENT, "g"},
+		{token.LT, "<"},
+		{token.IDENT, "h"},
+		{token.ASTERISK, "*"},
+		{token.IDENT, "i"},
+		{token.ILLEGAL, "&"},
+		{token.ILLEGAL, "|"},
+		{token.EOF, ""},
+	}
+
+	l := lexer.New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package lexer
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/pecet3/hmbk-script/token"
 )
@@ -11,18 +14,63 @@ type Lexer struct {
 	position     int  // current position in input (points to current char)
 	readPosition int  // current reading position in input (after current char)
 	ch           byte // current char under examination
+	file         string
+	line         int // line of current char
+	column       int // column of current char, counted in runes
+	errors       []string
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewWithFile(input, "")
+}
+
+func NewWithFile(input string, file string) *Lexer {
+	l := &Lexer{input: input, file: file, line: 1}
+	l.readChar()
+	return l
+}
+
+// NewAt creates a lexer for a fragment of a larger source, e.g. the body of a
+// ${...} interpolation, so that its tokens report positions in that source.
+func NewAt(input string, pos token.Position) *Lexer {
+	if !pos.IsValid() {
+		return NewWithFile(input, pos.File)
+	}
+	l := &Lexer{input: input, file: pos.File, line: pos.Line, column: pos.Column - 1}
 	l.readChar()
 	return l
 }
 
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{File: l.file, Line: l.line, Column: l.column}
+}
+
+// Errors returns problems found while scanning, e.g. unterminated comments,
+// each prefixed with its position like parser errors.
+func (l *Lexer) Errors() []string {
+	return l.errors
+}
+
+func (l *Lexer) addError(pos token.Position, msg string) {
+	l.errors = append(l.errors, pos.String()+": "+msg)
+}
+
 func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
 	l.skipWhitespace()
+	for l.isComment() && !l.isDocComment() {
+		l.skipComment()
+		l.skipWhitespace()
+	}
+	pos := l.currentPosition()
+
+	if l.isDocComment() {
+		tok.Type = token.DOC_COMMENT
+		tok.Literal = l.readDocComment()
+		tok.Pos = pos
+		return tok
+	}
 
 	switch l.ch {
 	case '=':
@@ -50,11 +98,37 @@ func (l *Lexer) NextToken() token.Token {
 	case '/':
 		tok = newToken(token.SLASH, l.ch)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '*' {
+			tok = l.readTwoCharToken(token.POWER)
+		} else {
+			tok = newToken(token.ASTERISK, l.ch)
+		}
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			tok = l.readTwoCharToken(token.LT_EQ)
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			tok = l.readTwoCharToken(token.GT_EQ)
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
+	case '&':
+		if l.peekChar() == '&' {
+			tok = l.readTwoCharToken(token.AND)
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			tok = l.readTwoCharToken(token.OR)
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ',':
@@ -78,8 +152,10 @@ func (l *Lexer) NextToken() token.Token {
 	case '@':
 		tok = newToken(token.EXPORT, l.ch)
 	case '"':
+		tok = l.readString()
+	case '`':
 		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok.Literal = l.readRawString()
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -87,6 +163,7 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Pos = pos
 			return tok
 		} else if isDigit(l.ch) {
 			tok.Literal = l.readNumber()
@@ -95,6 +172,7 @@ func (l *Lexer) NextToken() token.Token {
 			} else {
 				tok.Type = token.INT
 			}
+			tok.Pos = pos
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
@@ -102,20 +180,227 @@ func (l *Lexer) NextToken() token.Token {
 	}
 
 	l.readChar()
+	tok.Pos = pos
 	return tok
 }
 
-func (l *Lexer) readString() string {
+// TemplatePart is a piece of a double-quoted string: either decoded text
+// or the source of an embedded ${...} expression.
+type TemplatePart struct {
+	Text   string
+	IsExpr bool
+	Pos    token.Position
+}
+
+// readString reads a double-quoted string. Strings without interpolations
+// become STRING tokens holding the decoded text; otherwise a TEMPLATE token
+// holds the raw source, to be split again with SplitTemplate.
+// The lexer stops on the closing quote, which NextToken then consumes.
+func (l *Lexer) readString() token.Token {
 	position := l.position + 1
+	parts := l.scanString()
+	for _, part := range parts {
+		if part.IsExpr {
+			end := min(l.position, len(l.input))
+			return token.Token{Type: token.TEMPLATE, Literal: l.input[position:end]}
+		}
+	}
+	var text string
+	if len(parts) > 0 {
+		text = parts[0].Text
+	}
+	return token.Token{Type: token.STRING, Literal: text}
+}
+
+// SplitTemplate splits the literal of a TEMPLATE token into its parts.
+// Errors in the literal were already reported when the token was read.
+func SplitTemplate(tok token.Token) []TemplatePart {
+	l := NewAt(`"`+tok.Literal+`"`, tok.Pos)
+	return l.scanString()
+}
+
+func (l *Lexer) scanString() []TemplatePart {
+	start := l.currentPosition()
+	parts := []TemplatePart{}
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 || len(parts) == 0 {
+			parts = append(parts, TemplatePart{Text: text.String(), Pos: start})
+		}
+		text.Reset()
+	}
+	for {
+		l.readChar()
+		switch {
+		case l.ch == '"':
+			flush()
+			return parts
+		case l.ch == 0:
+			l.addError(start, "unterminated string")
+			flush()
+			return parts
+		case l.ch == '\\':
+			l.readEscape(&text)
+		case l.ch == '$' && l.peekChar() == '{':
+			if text.Len() > 0 {
+				flush()
+			}
+			l.readChar()
+			parts = append(parts, l.readInterpolation())
+		default:
+			text.WriteByte(l.ch)
+		}
+	}
+}
+
+// readInterpolation reads the source of a ${...} expression, starting on
+// its '{' and stopping on the matching '}'.
+func (l *Lexer) readInterpolation() TemplatePart {
+	open := l.currentPosition()
+	l.readChar()
+	part := TemplatePart{IsExpr: true, Pos: l.currentPosition()}
+	begin := l.position
+	depth := 0
 	for {
+		switch l.ch {
+		case 0:
+			l.addError(open, "unterminated ${ in string")
+			part.Text = l.input[begin:min(l.position, len(l.input))]
+			return part
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				part.Text = l.input[begin:l.position]
+				return part
+			}
+			depth--
+		case '"':
+			l.scanString()
+		case '`':
+			l.readRawString()
+		}
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
+	}
+}
+
+// readRawString reads a backtick string. Its content is taken verbatim,
+// so it may span lines and contain quotes and backslashes.
+func (l *Lexer) readRawString() string {
+	start := l.currentPosition()
+	position := l.position + 1
+	for {
+		l.readChar()
+		if l.ch == '`' {
+			break
+		}
+		if l.ch == 0 {
+			l.addError(start, "unterminated raw string")
 			break
 		}
 	}
 	return l.input[position:l.position]
 }
 
+var simpleEscapes = map[byte]byte{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'0':  0,
+	'"':  '"',
+	'\'': '\'',
+	'\\': '\\',
+	'$':  '$',
+}
+
+func (l *Lexer) readEscape(out *strings.Builder) {
+	pos := l.currentPosition()
+	l.readChar()
+	if ch, ok := simpleEscapes[l.ch]; ok {
+		out.WriteByte(ch)
+		return
+	}
+	switch l.ch {
+	case 'u':
+		if l.peekChar() != '{' {
+			l.addError(pos, "expected '{' after \\u")
+			return
+		}
+		l.readChar()
+		digits := l.position + 1
+		for isHexDigit(l.peekChar()) {
+			l.readChar()
+		}
+		hex := l.input[digits : l.position+1]
+		if l.peekChar() != '}' {
+			l.addError(pos, "expected '}' to close \\u escape")
+			return
+		}
+		l.readChar()
+		code, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) > 6 || !utf8.ValidRune(rune(code)) {
+			l.addError(pos, fmt.Sprintf("invalid unicode escape \\u{%s}", hex))
+			return
+		}
+		out.WriteRune(rune(code))
+	case 0:
+		// the caller sees EOF on its next read and reports the unterminated string
+	default:
+		l.addError(pos, fmt.Sprintf("unknown escape sequence \\%c", l.ch))
+		out.WriteByte(l.ch)
+	}
+}
+
+func (l *Lexer) isComment() bool {
+	return l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*')
+}
+
+// isDocComment reports whether the current char starts a `///` comment.
+// Four or more slashes are treated as a plain line comment.
+func (l *Lexer) isDocComment() bool {
+	if l.ch != '/' {
+		return false
+	}
+	rest := l.input[l.position:]
+	return strings.HasPrefix(rest, "///") && !strings.HasPrefix(rest, "////")
+}
+
+func (l *Lexer) skipComment() {
+	if l.peekChar() == '/' {
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+		return
+	}
+
+	pos := l.currentPosition()
+	l.readChar()
+	l.readChar()
+	for !(l.ch == '*' && l.peekChar() == '/') {
+		if l.ch == 0 {
+			l.addError(pos, "unterminated block comment")
+			return
+		}
+		l.readChar()
+	}
+	l.readChar()
+	l.readChar()
+}
+
+func (l *Lexer) readDocComment() string {
+	for i := 0; i < 3; i++ {
+		l.readChar()
+	}
+	if l.ch == ' ' {
+		l.readChar()
+	}
+	position := l.position
+	for l.ch != '\n' && l.ch != 0 {
+		l.readChar()
+	}
+	return strings.TrimRight(l.input[position:l.position], "\r")
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		l.readChar()
@@ -123,6 +408,10 @@ func (l *Lexer) skipWhitespace() {
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -130,6 +419,10 @@ func (l *Lexer) readChar() {
 	}
 	l.position = l.readPosition
 	l.readPosition += 1
+	// UTF-8 continuation bytes belong to the previous rune
+	if l.ch&0xC0 != 0x80 {
+		l.column++
+	}
 }
 
 func (l *Lexer) peekChar() byte {
@@ -171,6 +464,16 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+func (l *Lexer) readTwoCharToken(tokenType token.TokenType) token.Token {
+	ch := l.ch
+	l.readChar()
+	return token.Token{Type: tokenType, Literal: string(ch) + string(l.ch)}
+}
+
 func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
@@ -1,26 +1,85 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/pecet3/hmbk-script/evaluation"
+	"github.com/pecet3/hmbk-script/compiler"
+	"github.com/pecet3/hmbk-script/differential"
 	"github.com/pecet3/hmbk-script/lexer"
 	"github.com/pecet3/hmbk-script/object"
 	"github.com/pecet3/hmbk-script/parser"
 	"github.com/pecet3/hmbk-script/repl"
+	"github.com/pecet3/hmbk-script/runner"
+	"github.com/pecet3/hmbk-script/vm"
 )
 
 func main() {
 	args := os.Args[1:]
 
-	if len(args) <= 0 {
-		repl.Start(os.Stdin, os.Stdout)
+	if len(args) > 0 {
+		switch args[0] {
+		case "build":
+			os.Exit(build(args[1:]))
+		case "disasm":
+			os.Exit(disasm(args[1:]))
+		case "difftest":
+			os.Exit(difftest(args[1:]))
+		}
+	}
+	fs := flag.NewFlagSet("hmbk", flag.ContinueOnError)
+	engine := fs.String("engine", "", "execution engine, eval or vm (default: eval for files, vm for the REPL)")
+	optimize := fs.Bool("O", false, "optimize the bytecode (vm engine only)")
+	var stats statsOptions
+	fs.BoolVar(&stats.atExit, "stats", false, "print the VM's memory stats to stderr when the script ends (vm engine only)")
+	fs.DurationVar(&stats.every, "stats-every", 0, "also print them at this interval, for long-running scripts")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: hmbk [-engine eval|vm] [-O] [-stats] [-stats-every 30s] [file.hmbk|file.hmbkc]")
+		fmt.Fprintln(os.Stderr, "       hmbk build|disasm|difftest ...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if fs.NArg() == 0 {
+		r, ok := newRunner(*engine, runner.VM)
+		if !ok {
+			os.Exit(2)
+		}
+		repl.Start(os.Stdin, os.Stdout, r, runner.Options{Optimize: *optimize})
 		return
 	}
-	fileName := args[0]
+	fileName := fs.Arg(0)
 	fileNameLower := strings.ToLower(fileName)
+	if strings.HasSuffix(fileNameLower, ".hmbkc") {
+		if _, ok := newRunner(*engine, runner.VM); !ok {
+			os.Exit(2)
+		}
+		if *engine != "" && runner.Engine(*engine) != runner.VM {
+			fmt.Fprintln(os.Stderr, "a .hmbkc file only runs on the vm engine")
+			os.Exit(2)
+		}
+		os.Exit(runBytecode(fileName, stats))
+	}
+	r, ok := newRunner(*engine, runner.Eval)
+	if !ok {
+		os.Exit(2)
+	}
+	options := runner.Options{Optimize: *optimize}
+	if stats.atExit || stats.every > 0 {
+		if runner.Engine(*engine) != runner.VM {
+			fmt.Fprintln(os.Stderr, "-stats needs the vm engine, run with -engine vm")
+			os.Exit(2)
+		}
+		options.Observe = stats.watch
+	}
 	if !strings.Contains(fileNameLower, ".hmbk") {
 		fmt.Println("Wrong file name, it must have a .hmbk extension")
 		return
@@ -31,8 +90,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	env := object.NewEnvironment()
-	l := lexer.New(string(data))
+	l := lexer.NewWithFile(string(data), fileName)
 	p := parser.New(l)
 	program := p.ParseProgram()
 	if len(p.Errors()) > 0 {
@@ -42,15 +100,251 @@ func main() {
 		os.Exit(1)
 	}
 
-	evaluated := evaluation.Eval(program, env)
+	if _, err := r.Run(program, options); err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+// printError prints a script error with its traceback, and any other error
+// as it is.
+func printError(err error) {
+	var ge *object.GlobalError
+	if errors.As(err, &ge) {
+		fmt.Fprintf(os.Stderr, "%s\n", ge.Traceback())
+	} else {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+}
+
+// newRunner returns a runner for the engine named by the -engine flag, or
+// for fallback when the flag is not set.
+func newRunner(engine string, fallback runner.Engine) (runner.Runner, bool) {
+	if engine == "" {
+		engine = string(fallback)
+	}
+	r, err := runner.New(runner.Engine(engine))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return nil, false
+	}
+	return r, true
+}
+
+// disasm prints the bytecode of a script, or of a file written by build.
+// Global names are only known when compiling from source.
+func disasm(args []string) int {
+	fs := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	optimize := fs.Bool("O", false, "show the optimized bytecode")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: hmbk disasm [-O] file.hmbk|file.hmbkc")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	fileName := fs.Arg(0)
+	if strings.HasSuffix(strings.ToLower(fileName), ".hmbkc") {
+		bytecode, err := loadBytecode(fileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		compiler.Disassemble(os.Stdout, bytecode, nil)
+		return 0
+	}
+	comp, ok := compileFile(fileName)
+	if !ok {
+		return 1
+	}
+	bytecode, ok := optimizeIf(*optimize, comp.Bytecode())
+	if !ok {
+		return 1
+	}
+	compiler.Disassemble(os.Stdout, bytecode, comp.SymbolTable())
+	return 0
+}
+
+// difftest runs scripts, and with -fuzz generated programs, through both
+// the evaluator and the VM, and prints where they disagree.
+func difftest(args []string) int {
+	fs := flag.NewFlagSet("difftest", flag.ContinueOnError)
+	fuzz := fs.Int("fuzz", 0, "also compare this many generated programs")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "seed for the generated programs")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: hmbk difftest [-fuzz n] [-seed s] [file.hmbk|dir ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || (fs.NArg() == 0 && *fuzz == 0) {
+		fs.Usage()
+		return 2
+	}
+	diffs, err := differential.CompareFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	for _, d := range diffs {
+		fmt.Print(d)
+	}
+	if *fuzz > 0 {
+		fuzzDiffs, err := differential.Fuzz(rand.New(rand.NewSource(*seed)), *fuzz)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "seed %d: %s\n", *seed, err)
+			return 1
+		}
+		for _, d := range fuzzDiffs {
+			fmt.Printf("%s--- source (seed %d)\n%s\n", d, *seed, d.Source)
+		}
+		diffs = append(diffs, fuzzDiffs...)
+	}
+	if len(diffs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d scripts differ\n", len(diffs))
+		return 1
+	}
+	return 0
+}
+
+// optimizeIf runs the optimizer over bytecode when optimize is set, and
+// then replaces common instruction sequences by superinstructions.
+func optimizeIf(optimize bool, bytecode *compiler.Bytecode) (*compiler.Bytecode, bool) {
+	if !optimize {
+		return bytecode, true
+	}
+	optimized, err := compiler.Optimize(bytecode)
+	if err == nil {
+		optimized, err = compiler.Superinstructions(optimized)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Optimization error: %s\n", err)
+		return nil, false
+	}
+	return optimized, true
+}
 
-	if evaluated != nil {
-		_, isErr := evaluated.(*object.GlobalError)
-		if isErr {
-			fmt.Fprintf(os.Stderr, "%s\n", evaluated.Inspect())
-			os.Exit(1)
+// compileFile parses and compiles a script, reporting errors on stderr.
+func compileFile(fileName string) (*compiler.Compiler, bool) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read %s: %s\n", fileName, err)
+		return nil, false
+	}
+	p := parser.New(lexer.NewWithFile(string(data), fileName))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		for _, err := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "Parser error: %s\n", err)
 		}
+		return nil, false
+	}
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		fmt.Fprintf(os.Stderr, "Compilation error: %s\n", err)
+		return nil, false
+	}
+	return comp, true
+}
+
+func loadBytecode(fileName string) (*compiler.Bytecode, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", fileName, err)
+	}
+	defer f.Close()
+	bytecode, err := compiler.ReadBytecode(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s: %s", fileName, err)
+	}
+	return bytecode, nil
+}
 
+// build compiles a script to bytecode and writes it as a .hmbkc file, which
+// can then be run without lexing and parsing it again.
+func build(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	output := fs.String("o", "", "output file (default: the input with a .hmbkc extension)")
+	optimize := fs.Bool("O", false, "optimize the bytecode")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: hmbk build [-O] [-o output.hmbkc] file.hmbk")
+		fs.PrintDefaults()
 	}
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	fileName := fs.Arg(0)
+	comp, ok := compileFile(fileName)
+	if !ok {
+		return 1
+	}
+	bytecode, ok := optimizeIf(*optimize, comp.Bytecode())
+	if !ok {
+		return 1
+	}
+
+	out := *output
+	if out == "" {
+		out = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".hmbkc"
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot create %s: %s\n", out, err)
+		return 1
+	}
+	err = compiler.WriteBytecode(f, bytecode)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write %s: %s\n", out, err)
+		return 1
+	}
+	return 0
+}
 
+// statsOptions says when runBytecode reports the VM's memory use.
+type statsOptions struct {
+	atExit bool
+	every  time.Duration
+}
+
+// watch prints the memory stats of machine to stderr every stats.every
+// while it runs, and once more when done is called if stats.atExit.
+func (stats statsOptions) watch(machine *vm.VM) (done func()) {
+	stop := make(chan struct{})
+	if stats.every > 0 {
+		ticker := time.NewTicker(stats.every)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					machine.Stats().WriteTo(os.Stderr)
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	return func() {
+		close(stop)
+		if stats.atExit {
+			machine.Stats().WriteTo(os.Stderr)
+		}
+	}
+}
+
+// runBytecode runs a file written by build on the VM.
+func runBytecode(fileName string, stats statsOptions) int {
+	bytecode, err := loadBytecode(fileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if err := runner.RunBytecode(bytecode, runner.Options{Observe: stats.watch}); err != nil {
+		printError(err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,9 @@
+package modules
+
+// The tests run scripts with the evaluator, which imports this package, so
+// they live in modules_test and reach the internals through these.
+var (
+	NewHttpModule = newHttpModule
+	HashGet       = hashGet
+	NewHash       = newHash
+)
@@ -0,0 +1,25 @@
+// Package modules implements the builtin modules, such as http, for both
+// execution engines.
+package modules
+
+import (
+	"github.com/pecet3/hmbk-script/object"
+)
+
+// Caller runs a script function on behalf of a builtin module, e.g. an
+// HTTP handler. The evaluator and the VM each pass their own.
+//
+// Modules call it from goroutines of their own, the http module once per
+// request, while the script may still be running. Whatever the engines
+// share between those calls must therefore be safe for concurrent use.
+type Caller func(fn object.Object, args ...object.Object) object.Object
+
+// New creates the builtin module called name. Script functions it is
+// given, such as HTTP handlers, are run through call.
+func New(name string, call Caller) (*object.Module, bool) {
+	switch name {
+	case "http":
+		return &object.Module{Name: name, Env: ModHttp(call)}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,792 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pecet3/hmbk-script/object"
+)
+
+func ModHttp(call Caller) *object.Environment {
+	env, _ := newHttpModule(call)
+	return env
+}
+
+// newHttpModule creates the http module and the server its handlers are
+// registered on.
+func newHttpModule(call Caller) (*object.Environment, *server) {
+	env := object.NewEnvironment()
+	srv := newServer(call)
+
+	// -------------------------------
+	// get_json(req)
+	// -------------------------------
+	env.SetConst("get_json", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newGlobalError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+			req, err := requestArg(args[0])
+			if err != nil {
+				return err
+			}
+			body, ok := hashGet(req, "body").(*object.String)
+			if !ok {
+				return newError("request has no body")
+			}
+			var parsed interface{}
+			if err := json.Unmarshal([]byte(body.Value), &parsed); err != nil {
+				return newError("invalid JSON: %s", err)
+			}
+			return goValueToObject(parsed)
+		},
+	})
+
+	// -------------------------------
+	// get_param(req, key)
+	// -------------------------------
+	env.SetConst("get_param", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			return requestValue("get_param", "query", args, func(key string) string { return key })
+		},
+	})
+
+	// -------------------------------
+	// get_header(req, key)
+	// -------------------------------
+	env.SetConst("get_header", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			return requestValue("get_header", "headers", args, http.CanonicalHeaderKey)
+		},
+	})
+
+	// -------------------------------
+	// handle(pattern, fn), use(middleware...), group(prefix, middleware...)
+	// logger(), recover(), cors(options), basic_auth(users, realm)
+	// -------------------------------
+	for name, fn := range srv.root.builtins() {
+		env.SetConst(name, fn)
+	}
+	for name, fn := range srv.middlewares() {
+		env.SetConst(name, fn)
+	}
+
+	// -------------------------------
+	// set_limits(limits), listen(addr), listen_tls(addr, cert, key),
+	// shutdown(grace), addr()
+	// -------------------------------
+	for name, fn := range srv.lifecycle() {
+		env.SetConst(name, fn)
+	}
+	// listen and listen_tls of the default server serve until it is shut
+	// down, as scripts ending with them expect
+	for _, name := range []string{"listen", "listen_tls"} {
+		start, _ := env.Get(name)
+		env.SetConst(name, &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				result := start.(*object.Builtin).Fn(args...)
+				if result == NULL {
+					srv.wait()
+				}
+				return result
+			},
+		})
+	}
+
+	// -------------------------------
+	// server(options)
+	// -------------------------------
+	env.SetConst("server", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) > 1 {
+				return newGlobalError("wrong number of arguments. got=%d, want=0 or 1", len(args))
+			}
+			s := newServer(call)
+			if len(args) == 1 {
+				options, ok := args[0].(*object.Hash)
+				if !ok {
+					return newError("argument must be a hash of server options")
+				}
+				if err := s.configure(options); err != nil {
+					return err
+				}
+			}
+			values := s.root.builtins()
+			for name, fn := range s.lifecycle() {
+				values[name] = fn
+			}
+			return newHash(values)
+		},
+	})
+
+	// -------------------------------
+	// wait()
+	// -------------------------------
+	env.SetConst("wait", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 0 {
+				return newGlobalError("wrong number of arguments. got=%d, want=0", len(args))
+			}
+			live.wait()
+			return NULL
+		},
+	})
+
+	// -------------------------------
+	// write_json(res, obj)
+	// -------------------------------
+	env.SetConst("write_json", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 2 {
+				return newGlobalError("wrong number of arguments. got=%d, want=2", len(args))
+			}
+			res, err := responseArg(args[0])
+			if err != nil {
+				return err
+			}
+			data := objectToGoValue(args[1])
+			jsonBytes, marshalErr := json.Marshal(data)
+			if marshalErr != nil {
+				return newError("json marshal error: %s", marshalErr)
+			}
+			res.Header().Set("Content-Type", "application/json")
+			res.Write(jsonBytes)
+			return NULL
+		},
+	})
+
+	// -------------------------------
+	// set_status(res, status)
+	// -------------------------------
+	env.SetConst("set_status", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 2 {
+				return newGlobalError("wrong number of arguments. got=%d, want=2", len(args))
+			}
+			res, err := responseArg(args[0])
+			if err != nil {
+				return err
+			}
+			status, err := statusArg(args[1])
+			if err != nil {
+				return err
+			}
+			if res.wroteHeader {
+				return newError("status already sent")
+			}
+			res.status = status
+			return NULL
+		},
+	})
+
+	// -------------------------------
+	// set_header(res, name, value)
+	// -------------------------------
+	env.SetConst("set_header", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 3 {
+				return newGlobalError("wrong number of arguments. got=%d, want=3", len(args))
+			}
+			res, err := responseArg(args[0])
+			if err != nil {
+				return err
+			}
+			name, ok := args[1].(*object.String)
+			if !ok {
+				return newError("second argument must be a string header name")
+			}
+			if res.wroteHeader {
+				return newError("headers already sent")
+			}
+			res.Header().Set(name.Value, headerValue(args[2]))
+			return NULL
+		},
+	})
+
+	// -------------------------------
+	// set_cookie(res, name, value, options)
+	// -------------------------------
+	env.SetConst("set_cookie", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 3 && len(args) != 4 {
+				return newGlobalError("wrong number of arguments. got=%d, want=3 or 4", len(args))
+			}
+			res, err := responseArg(args[0])
+			if err != nil {
+				return err
+			}
+			name, ok := args[1].(*object.String)
+			if !ok {
+				return newError("second argument must be a string cookie name")
+			}
+			value, ok := args[2].(*object.String)
+			if !ok {
+				return newError("third argument must be a string cookie value")
+			}
+			cookie := &http.Cookie{Name: name.Value, Value: value.Value, Path: "/"}
+			if len(args) == 4 {
+				options, ok := args[3].(*object.Hash)
+				if !ok {
+					return newError("fourth argument must be a hash of cookie options")
+				}
+				if err := setCookieOptions(cookie, options); err != nil {
+					return err
+				}
+			}
+			if err := cookie.Valid(); err != nil {
+				return newError("invalid cookie: %s", err)
+			}
+			if res.wroteHeader {
+				return newError("headers already sent")
+			}
+			http.SetCookie(res, cookie)
+			return NULL
+		},
+	})
+
+	// -------------------------------
+	// get_cookie(req, name)
+	// -------------------------------
+	env.SetConst("get_cookie", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 2 {
+				return newGlobalError("wrong number of arguments. got=%d, want=2", len(args))
+			}
+			req, err := requestArg(args[0])
+			if err != nil {
+				return err
+			}
+			name, ok := args[1].(*object.String)
+			if !ok {
+				return newError("second argument must be a string cookie name")
+			}
+			cookies, _ := hashGet(req, "cookies").(*object.Hash)
+			if cookies == nil {
+				return NULL
+			}
+			return hashGet(cookies, name.Value)
+		},
+	})
+
+	// -------------------------------
+	// redirect(res, url, status)
+	// -------------------------------
+	env.SetConst("redirect", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 2 && len(args) != 3 {
+				return newGlobalError("wrong number of arguments. got=%d, want=2 or 3", len(args))
+			}
+			res, err := responseArg(args[0])
+			if err != nil {
+				return err
+			}
+			url, ok := args[1].(*object.String)
+			if !ok {
+				return newError("second argument must be a string url")
+			}
+			status := http.StatusFound
+			if len(args) == 3 {
+				if status, err = statusArg(args[2]); err != nil {
+					return err
+				}
+				if status < 300 || status > 399 {
+					return newError("redirect status must be 3xx, got %d", status)
+				}
+			}
+			if res.wroteHeader {
+				return newError("headers already sent")
+			}
+			http.Redirect(res, res.req, url.Value, status)
+			return NULL
+		},
+	})
+
+	// -------------------------------
+	// respond(res, status, body, headers)
+	// -------------------------------
+	env.SetConst("respond", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) < 2 || len(args) > 4 {
+				return newGlobalError("wrong number of arguments. got=%d, want=2 to 4", len(args))
+			}
+			res, err := responseArg(args[0])
+			if err != nil {
+				return err
+			}
+			status, err := statusArg(args[1])
+			if err != nil {
+				return err
+			}
+			var body object.Object = NULL
+			if len(args) >= 3 {
+				body = args[2]
+			}
+			var headers *object.Hash
+			if len(args) == 4 {
+				h, ok := args[3].(*object.Hash)
+				if !ok {
+					return newError("fourth argument must be a hash of headers")
+				}
+				headers = h
+			}
+			if err := respond(res, status, body, headers); err != nil {
+				return err
+			}
+			return NULL
+		},
+	})
+
+	// -------------------------------
+	// get(url)
+	// -------------------------------
+	env.SetConst("get", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 1 {
+				return newGlobalError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+			urlObj, ok := args[0].(*object.String)
+			if !ok {
+				return newError("argument must be string")
+			}
+			resp, err := http.Get(urlObj.Value)
+			if err != nil {
+				return newError("GET error: %s", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				return newError("Read body error:%s", err)
+			}
+			return &object.String{Value: string(body)}
+		},
+	})
+
+	// -------------------------------
+	// post_json(url, obj)
+	// -------------------------------
+	env.SetConst("post_json", &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 2 {
+				return newGlobalError("wrong number of arguments. got=%d, want=2", len(args))
+			}
+			urlObj, ok := args[0].(*object.String)
+			if !ok {
+				return newError("first argument must be url string")
+			}
+			data := objectToGoValue(args[1])
+			jsonBytes, err := json.Marshal(data)
+			if err != nil {
+				return newError("json marshal error: %s", err)
+			}
+			resp, err := http.Post(urlObj.Value, "application/json", bytes.NewBuffer(jsonBytes))
+			if err != nil {
+				return newError("POST error: %s", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return &object.String{Value: string(body)}
+		},
+	})
+
+	return env, srv
+}
+
+// response wraps the http.ResponseWriter a handler gets as res. The status
+// set with set_status is only sent with the first write, so headers can
+// still be set after it.
+type response struct {
+	http.ResponseWriter
+	req         *http.Request
+	status      int // set with set_status, not sent yet
+	wroteHeader bool
+	code        int // the status sent
+}
+
+func (r *response) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.wroteHeader = true
+	r.code = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *response) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(r.statusOrOK())
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// flush sends a status set with set_status when nothing was written.
+func (r *response) flush() {
+	if !r.wroteHeader && r.status != 0 {
+		r.WriteHeader(r.status)
+	}
+}
+
+func (r *response) statusOrOK() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func responseArg(obj object.Object) (*response, *object.Error) {
+	resObj, ok := obj.(*object.BuiltinObject)
+	if !ok {
+		return nil, newError("first argument must be a response")
+	}
+	res, ok := resObj.Value.(*response)
+	if !ok {
+		return nil, newError("wrong response type")
+	}
+	return res, nil
+}
+
+func statusArg(obj object.Object) (int, *object.Error) {
+	n, ok := obj.(*object.Number)
+	if !ok || n.Value != float64(int(n.Value)) || n.Value < 100 || n.Value > 999 {
+		return 0, newError("status must be a number from 100 to 999, got %s", obj.Inspect())
+	}
+	return int(n.Value), nil
+}
+
+// headerValue is the text of a header value: strings as they are, other
+// values as they print.
+func headerValue(obj object.Object) string {
+	if s, ok := obj.(*object.String); ok {
+		return s.Value
+	}
+	return obj.Inspect()
+}
+
+func setCookieOptions(cookie *http.Cookie, options *object.Hash) *object.Error {
+	for _, pair := range options.Pairs {
+		key := pair.Key.Inspect()
+		switch key {
+		case "path", "domain", "same_site":
+			value, ok := pair.Value.(*object.String)
+			if !ok {
+				return newError("cookie option %s must be a string", key)
+			}
+			switch key {
+			case "path":
+				cookie.Path = value.Value
+			case "domain":
+				cookie.Domain = value.Value
+			case "same_site":
+				switch strings.ToLower(value.Value) {
+				case "lax":
+					cookie.SameSite = http.SameSiteLaxMode
+				case "strict":
+					cookie.SameSite = http.SameSiteStrictMode
+				case "none":
+					cookie.SameSite = http.SameSiteNoneMode
+				default:
+					return newError("cookie option same_site must be lax, strict or none, got %s", value.Value)
+				}
+			}
+		case "max_age":
+			value, ok := pair.Value.(*object.Number)
+			if !ok {
+				return newError("cookie option max_age must be a number of seconds")
+			}
+			cookie.MaxAge = int(value.Value)
+			if cookie.MaxAge == 0 {
+				// 0 would leave the attribute out, deleting is negative
+				cookie.MaxAge = -1
+			}
+		case "secure", "http_only":
+			value, ok := pair.Value.(*object.Bool)
+			if !ok {
+				return newError("cookie option %s must be a bool", key)
+			}
+			if key == "secure" {
+				cookie.Secure = value.Value
+			} else {
+				cookie.HttpOnly = value.Value
+			}
+		default:
+			return newError("unknown cookie option %s", key)
+		}
+	}
+	return nil
+}
+
+// respond sends a whole response. A string body is sent as it is, null as
+// no body and anything else as JSON.
+func respond(res *response, status int, body object.Object, headers *object.Hash) *object.Error {
+	if res.wroteHeader {
+		return newError("headers already sent")
+	}
+	if headers != nil {
+		for _, pair := range headers.Pairs {
+			res.Header().Set(pair.Key.Inspect(), headerValue(pair.Value))
+		}
+	}
+	var data []byte
+	switch body := body.(type) {
+	case *object.Null:
+	case *object.String:
+		data = []byte(body.Value)
+	default:
+		encoded, err := json.Marshal(objectToGoValue(body))
+		if err != nil {
+			return newError("json marshal error: %s", err)
+		}
+		data = encoded
+		if res.Header().Get("Content-Type") == "" {
+			res.Header().Set("Content-Type", "application/json")
+		}
+	}
+	res.WriteHeader(status)
+	res.Write(data)
+	return nil
+}
+
+// isResponseHash reports whether a handler's result is a response to
+// send, {status, headers, body} or some of them, rather than a value to
+// print.
+func isResponseHash(hash *object.Hash) bool {
+	if len(hash.Pairs) == 0 {
+		return false
+	}
+	for _, pair := range hash.Pairs {
+		switch pair.Key.Inspect() {
+		case "status", "headers", "body":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func respondWithHash(res *response, hash *object.Hash) *object.Error {
+	status := res.statusOrOK()
+	var body object.Object = NULL
+	var headers *object.Hash
+	for _, pair := range hash.Pairs {
+		switch pair.Key.Inspect() {
+		case "status":
+			s, err := statusArg(pair.Value)
+			if err != nil {
+				return err
+			}
+			status = s
+		case "headers":
+			h, ok := pair.Value.(*object.Hash)
+			if !ok {
+				return newError("response headers must be a hash")
+			}
+			headers = h
+		case "body":
+			body = pair.Value
+		}
+	}
+	return respond(res, status, body, headers)
+}
+
+// requestLimits bound what newRequestObject reads of a request. Handlers
+// read them while set_limits may change them.
+type requestLimits struct {
+	maxBody atomic.Int64 // the whole body, forms and files included
+	maxFile atomic.Int64 // each uploaded file
+}
+
+// set changes the limits given in a hash of max_body and max_file.
+func (l *requestLimits) set(limits *object.Hash) *object.Error {
+	for _, pair := range limits.Pairs {
+		n, ok := pair.Value.(*object.Number)
+		if !ok || n.Value < 1 {
+			return newError("limit %s must be a positive number of bytes", pair.Key.Inspect())
+		}
+		switch pair.Key.Inspect() {
+		case "max_body":
+			l.maxBody.Store(int64(n.Value))
+		case "max_file":
+			l.maxFile.Store(int64(n.Value))
+		default:
+			return newError("unknown limit %s", pair.Key.Inspect())
+		}
+	}
+	return nil
+}
+
+func newRequestLimits() *requestLimits {
+	l := &requestLimits{}
+	l.maxBody.Store(32 << 20)
+	l.maxFile.Store(10 << 20)
+	return l
+}
+
+// newRequestObject reads r into the hash handlers get as req:
+//
+//	method, url, path, host, remote_addr  strings
+//	query, headers, cookies, form         hashes of strings
+//	files                                 field name => {filename, content_type, size, content}
+//	body                                  the raw body
+//	path_value(name)                      a wildcard of the route pattern
+//
+// Only the first value of a repeated query parameter or form field is
+// kept. A body over the limits is answered with 413 before the handler
+// runs, a malformed form with 400.
+func newRequestObject(w http.ResponseWriter, r *http.Request, limits *requestLimits) (*object.Hash, int, error) {
+	maxBody, maxFile := limits.maxBody.Load(), limits.maxFile.Load()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("request body over %d bytes", maxBody)
+		}
+		return nil, http.StatusBadRequest, fmt.Errorf("cannot read request body: %s", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	form := map[string]object.Object{}
+	files := map[string]object.Object{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxBody); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid multipart form: %s", err)
+		}
+		defer r.MultipartForm.RemoveAll()
+		for name, headers := range r.MultipartForm.File {
+			file, err := readUpload(headers[0], maxFile)
+			if err != nil {
+				return nil, http.StatusRequestEntityTooLarge, err
+			}
+			files[name] = file
+		}
+		for name, values := range r.MultipartForm.Value {
+			form[name] = &object.String{Value: values[0]}
+		}
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid form: %s", err)
+		}
+		for name, values := range r.PostForm {
+			form[name] = &object.String{Value: values[0]}
+		}
+	}
+
+	query := map[string]object.Object{}
+	for name, values := range r.URL.Query() {
+		query[name] = &object.String{Value: values[0]}
+	}
+	headers := map[string]object.Object{}
+	for name, values := range r.Header {
+		headers[name] = &object.String{Value: strings.Join(values, ", ")}
+	}
+	cookies := map[string]object.Object{}
+	for _, cookie := range r.Cookies() {
+		cookies[cookie.Name] = &object.String{Value: cookie.Value}
+	}
+
+	return newHash(map[string]object.Object{
+		"method":      &object.String{Value: r.Method},
+		"url":         &object.String{Value: r.URL.String()},
+		"path":        &object.String{Value: r.URL.Path},
+		"host":        &object.String{Value: r.Host},
+		"remote_addr": &object.String{Value: r.RemoteAddr},
+		"query":       newHash(query),
+		"headers":     newHash(headers),
+		"cookies":     newHash(cookies),
+		"form":        newHash(form),
+		"files":       newHash(files),
+		"body":        &object.String{Value: string(body)},
+		"path_value": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newGlobalError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				name, ok := args[0].(*object.String)
+				if !ok {
+					return newError("argument must be a string wildcard name")
+				}
+				return &object.String{Value: r.PathValue(name.Value)}
+			},
+		},
+	}), 0, nil
+}
+
+func readUpload(header *multipart.FileHeader, maxFile int64) (*object.Hash, error) {
+	if header.Size > maxFile {
+		return nil, fmt.Errorf("file %s over %d bytes", header.Filename, maxFile)
+	}
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return newHash(map[string]object.Object{
+		"filename":     &object.String{Value: header.Filename},
+		"content_type": &object.String{Value: header.Header.Get("Content-Type")},
+		"size":         &object.Number{Value: float64(header.Size)},
+		"content":      &object.String{Value: string(content)},
+	}), nil
+}
+
+func requestArg(obj object.Object) (*object.Hash, *object.Error) {
+	req, ok := obj.(*object.Hash)
+	if !ok {
+		return nil, newError("first argument must be a request")
+	}
+	return req, nil
+}
+
+// requestValue looks up args[1], made canonical by key, in the hash field
+// of the request args[0]. Missing values are empty strings.
+func requestValue(name, field string, args []object.Object, key func(string) string) object.Object {
+	if len(args) != 2 {
+		return newGlobalError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+	req, err := requestArg(args[0])
+	if err != nil {
+		return err
+	}
+	keyObj, ok := args[1].(*object.String)
+	if !ok {
+		return newError("second argument to `%s` must be a string", name)
+	}
+	values, _ := hashGet(req, field).(*object.Hash)
+	if values == nil {
+		return &object.String{Value: ""}
+	}
+	value := hashGet(values, key(keyObj.Value))
+	if value == NULL {
+		return &object.String{Value: ""}
+	}
+	return value
+}
+
+func newHash(values map[string]object.Object) *object.Hash {
+	h := &object.Hash{Pairs: make(map[object.HashKey]object.HashPair, len(values))}
+	for k, v := range values {
+		key := &object.String{Value: k}
+		h.Pairs[key.HashKey()] = object.HashPair{Key: key, Value: v}
+	}
+	return h
+}
+
+// hashGet returns the value at a string key, or NULL.
+func hashGet(h *object.Hash, key string) object.Object {
+	pair, ok := h.Pairs[(&object.String{Value: key}).HashKey()]
+	if !ok {
+		return NULL
+	}
+	return pair.Value
+}
@@ -0,0 +1,329 @@
+package modules
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pecet3/hmbk-script/object"
+)
+
+// serverOptions are the timeouts of a server, set with http.server.
+type serverOptions struct {
+	readTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	// shutdownTimeout is how long shutdown waits for requests in flight
+	// when it is not given a grace period, and on SIGINT or SIGTERM
+	shutdownTimeout time.Duration
+}
+
+func defaultServerOptions() serverOptions {
+	return serverOptions{
+		readTimeout:       time.Minute,
+		readHeaderTimeout: 10 * time.Second,
+		writeTimeout:      time.Minute,
+		idleTimeout:       2 * time.Minute,
+		shutdownTimeout:   5 * time.Second,
+	}
+}
+
+// configure applies the options of http.server: the timeouts, in seconds,
+// and the request limits of set_limits.
+func (s *server) configure(options *object.Hash) *object.Error {
+	limits := newHash(nil)
+	for _, pair := range options.Pairs {
+		key := pair.Key.Inspect()
+		var timeout *time.Duration
+		switch key {
+		case "read_timeout":
+			timeout = &s.options.readTimeout
+		case "read_header_timeout":
+			timeout = &s.options.readHeaderTimeout
+		case "write_timeout":
+			timeout = &s.options.writeTimeout
+		case "idle_timeout":
+			timeout = &s.options.idleTimeout
+		case "shutdown_timeout":
+			timeout = &s.options.shutdownTimeout
+		case "max_body", "max_file":
+			limits.Pairs[pair.Key.(object.Hashable).HashKey()] = pair
+			continue
+		default:
+			return newError("unknown server option %s", key)
+		}
+		d, err := seconds(key, pair.Value)
+		if err != nil {
+			return err
+		}
+		*timeout = d
+	}
+	return s.limits.set(limits)
+}
+
+// maxSeconds is the longest duration in seconds.
+const maxSeconds = math.MaxInt64 / int64(time.Second)
+
+// seconds converts a number of seconds to a duration, 0 meaning none.
+func seconds(name string, obj object.Object) (time.Duration, *object.Error) {
+	n, ok := obj.(*object.Number)
+	// NaN fails every comparison, so it is let through by n.Value < 0
+	if !ok || !(n.Value >= 0 && n.Value <= float64(maxSeconds)) {
+		return 0, newError("%s must be a number of seconds from 0 to %d, got %s", name, maxSeconds, obj.Inspect())
+	}
+	return time.Duration(n.Value * float64(time.Second)), nil
+}
+
+// listen starts serving on addr in the background, with TLS if config is
+// not nil. Errors binding addr are returned; later ones are logged.
+func (s *server) listen(addr string, config *tls.Config) *object.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.httpServer != nil {
+		return newError("server is already listening on %s", s.addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return newError("%s", err)
+	}
+	hs := &http.Server{
+		Addr:              ln.Addr().String(),
+		Handler:           s,
+		TLSConfig:         config,
+		ReadTimeout:       s.options.readTimeout,
+		ReadHeaderTimeout: s.options.readHeaderTimeout,
+		WriteTimeout:      s.options.writeTimeout,
+		IdleTimeout:       s.options.idleTimeout,
+	}
+	s.httpServer, s.addr, s.done = hs, hs.Addr, make(chan struct{})
+	live.add(hs, s)
+	go func(done chan struct{}) {
+		var err error
+		if config != nil {
+			err = hs.ServeTLS(ln, "", "")
+		} else {
+			err = hs.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("server on %s: %s", hs.Addr, err)
+		}
+		s.mu.Lock()
+		if s.httpServer == hs {
+			s.httpServer = nil
+		}
+		s.mu.Unlock()
+		live.remove(hs)
+		close(done)
+	}(s.done)
+	return nil
+}
+
+// shutdown stops s from accepting connections and closes them once their
+// requests are done, or after grace. It does not wait, since a handler of
+// s may be the one calling it; wait does.
+func (s *server) shutdown(grace time.Duration) {
+	s.mu.Lock()
+	hs := s.httpServer
+	s.httpServer = nil
+	s.mu.Unlock()
+	if hs != nil {
+		go stop(hs, grace)
+	}
+}
+
+// stop shuts hs down, closing the connections still busy after grace.
+func stop(hs *http.Server, grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		log.Printf("server on %s: shutdown: %s", hs.Addr, err)
+		hs.Close()
+	}
+}
+
+// wait blocks until s stops serving, if it is.
+func (s *server) wait() {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// live are the servers serving. While there are any, SIGINT and SIGTERM
+// shut them down gracefully instead of killing the process; a second
+// signal during the shutdown does.
+var live = newLiveServers()
+
+// liveServers is keyed by the http.Server rather than the server, since a
+// server shut down can listen again before its old http.Server stopped.
+type liveServers struct {
+	mu      sync.Mutex
+	servers map[*http.Server]*server
+	empty   *sync.Cond // broadcast when the last server stops
+	signals chan os.Signal
+}
+
+func newLiveServers() *liveServers {
+	l := &liveServers{servers: map[*http.Server]*server{}}
+	l.empty = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *liveServers) add(hs *http.Server, s *server) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.signals == nil {
+		l.signals = make(chan os.Signal, 1)
+		go l.shutdownOnSignal()
+	}
+	if len(l.servers) == 0 {
+		signal.Notify(l.signals, syscall.SIGINT, syscall.SIGTERM)
+	}
+	l.servers[hs] = s
+}
+
+func (l *liveServers) remove(hs *http.Server) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.servers, hs)
+	if len(l.servers) == 0 {
+		signal.Stop(l.signals)
+		l.empty.Broadcast()
+	}
+}
+
+func (l *liveServers) shutdownOnSignal() {
+	for sig := range l.signals {
+		l.mu.Lock()
+		signal.Stop(l.signals)
+		servers := make(map[*http.Server]*server, len(l.servers))
+		for hs, s := range l.servers {
+			servers[hs] = s
+		}
+		l.mu.Unlock()
+		log.Printf("%s: shutting down %d server(s)", sig, len(servers))
+		for hs, s := range servers {
+			s.mu.Lock()
+			if s.httpServer == hs {
+				s.httpServer = nil
+			}
+			s.mu.Unlock()
+			go stop(hs, s.options.shutdownTimeout)
+		}
+	}
+}
+
+// wait blocks until no server is serving.
+func (l *liveServers) wait() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.servers) > 0 {
+		l.empty.Wait()
+	}
+}
+
+// lifecycle returns the builtins configuring, starting and stopping s.
+func (s *server) lifecycle() map[string]object.Object {
+	return map[string]object.Object{
+		// set_limits({max_body, max_file})
+		"set_limits": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newGlobalError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				options, ok := args[0].(*object.Hash)
+				if !ok {
+					return newError("argument must be a hash of limits")
+				}
+				if err := s.limits.set(options); err != nil {
+					return err
+				}
+				return NULL
+			},
+		},
+		// listen(addr)
+		"listen": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 1 {
+					return newGlobalError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				addr, ok := args[0].(*object.String)
+				if !ok {
+					return newError("argument must be string")
+				}
+				if err := s.listen(addr.Value, nil); err != nil {
+					return err
+				}
+				return NULL
+			},
+		},
+		// listen_tls(addr, cert_file, key_file)
+		"listen_tls": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 3 {
+					return newGlobalError("wrong number of arguments. got=%d, want=3", len(args))
+				}
+				var params [3]string
+				for i, arg := range args {
+					str, ok := arg.(*object.String)
+					if !ok {
+						return newError("arguments must be strings: address, certificate file and key file")
+					}
+					params[i] = str.Value
+				}
+				cert, err := tls.LoadX509KeyPair(params[1], params[2])
+				if err != nil {
+					return newError("%s", err)
+				}
+				if err := s.listen(params[0], &tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+					return err
+				}
+				return NULL
+			},
+		},
+		// shutdown(grace)
+		"shutdown": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) > 1 {
+					return newGlobalError("wrong number of arguments. got=%d, want=0 or 1", len(args))
+				}
+				grace := s.options.shutdownTimeout
+				if len(args) == 1 {
+					d, err := seconds("grace period", args[0])
+					if err != nil {
+						return err
+					}
+					grace = d
+				}
+				s.shutdown(grace)
+				return NULL
+			},
+		},
+		// addr()
+		"addr": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 0 {
+					return newGlobalError("wrong number of arguments. got=%d, want=0", len(args))
+				}
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if s.httpServer == nil {
+					return NULL
+				}
+				return &object.String{Value: s.addr}
+			},
+		},
+	}
+}
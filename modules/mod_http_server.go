@@ -0,0 +1,553 @@
+package modules
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pecet3/hmbk-script/object"
+)
+
+// server routes requests to script handlers. Requests pass through the
+// middlewares added with use, then the ServeMux, then the middlewares of
+// the groups around the matched route, and finally its handler:
+//
+//	use(a); use(b)
+//	const api = group("/api", c)
+//	api.handle("GET /users", h)     GET /api/users: a, b, c, h
+//	                                GET /missing:   a, b, 404
+//
+// so middlewares added with use also see requests no route matches, such
+// as CORS preflights.
+type server struct {
+	mux     *http.ServeMux
+	call    Caller
+	limits  *requestLimits
+	root    *router
+	options serverOptions
+
+	mu         sync.Mutex
+	httpServer *http.Server  // nil unless listening
+	addr       string        // what httpServer listens on
+	done       chan struct{} // closed when the last httpServer stopped
+}
+
+func newServer(call Caller) *server {
+	s := &server{mux: http.NewServeMux(), call: call, limits: newRequestLimits(), options: defaultServerOptions()}
+	s.root = &router{server: s}
+	return s
+}
+
+// exchange is what the handlers of one request share, passed from
+// ServeHTTP to the route through the request context.
+type exchange struct {
+	req    *object.Hash
+	res    *response
+	resObj *object.BuiltinObject
+	// result is what the route's chain returned, NULL if none matched
+	result object.Object
+}
+
+type exchangeKey struct{}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ex := &exchange{result: NULL}
+	r = r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex))
+	ex.res = &response{ResponseWriter: w, req: r}
+	ex.resObj = &object.BuiltinObject{Value: ex.res}
+	// path_value reads r, which the ServeMux fills in when it matches
+	req, status, err := newRequestObject(w, r, s.limits)
+	if err != nil {
+		http.Error(ex.res, err.Error(), status)
+		return
+	}
+	ex.req = req
+
+	result := s.runChain(s.root.own(), ex, func() object.Object {
+		s.mux.ServeHTTP(ex.res, r)
+		return ex.result
+	})
+	if ge, ok := result.(*object.GlobalError); ok {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", r.Method, r.URL.Path, ge.Traceback())
+		if !ex.res.wroteHeader {
+			http.Error(ex.res, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	ex.res.flush()
+}
+
+// runChain calls the middlewares in order, each with a next function
+// calling the rest of them, and last after the last one. What each
+// middleware returns is written as soon as it returns, so the ones around
+// it see the status it sent; next only passes errors back.
+func (s *server) runChain(middlewares []object.Object, ex *exchange, last func() object.Object) object.Object {
+	var run func(i int) object.Object
+	run = func(i int) object.Object {
+		if i == len(middlewares) {
+			return last()
+		}
+		next := &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 0 {
+					return newGlobalError("wrong number of arguments. got=%d, want=0", len(args))
+				}
+				return run(i + 1)
+			},
+		}
+		return writeResult(ex.res, s.call(middlewares[i], ex.req, ex.resObj, next))
+	}
+	return run(0)
+}
+
+// writeResult sends what a handler or a middleware returned: a response
+// hash, or any other value printed, unless it is null. Errors are
+// returned for the middlewares before it to see.
+func writeResult(res *response, result object.Object) object.Object {
+	if result == nil || result.Type() == object.NULL {
+		return NULL
+	}
+	if _, ok := result.(*object.GlobalError); ok {
+		return result
+	}
+	if hash, ok := result.(*object.Hash); ok && isResponseHash(hash) {
+		if err := respondWithHash(res, hash); err != nil {
+			return newGlobalError("%s", err.Message)
+		}
+		return NULL
+	}
+	res.Write([]byte(result.Inspect()))
+	return NULL
+}
+
+// router is the server itself or a group of its routes, which share a
+// path prefix and middlewares.
+type router struct {
+	server *server
+	parent *router
+	prefix string
+
+	mu          sync.RWMutex
+	middlewares []object.Object
+}
+
+// own returns the middlewares added to r itself.
+func (r *router) own() []object.Object {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]object.Object{}, r.middlewares...)
+}
+
+// chain returns the middlewares of the groups around a route of r,
+// outermost first. The server's own run before routing, so they are left
+// out.
+func (r *router) chain() []object.Object {
+	var middlewares []object.Object
+	for g := r; g.parent != nil; g = g.parent {
+		middlewares = append(g.own(), middlewares...)
+	}
+	return middlewares
+}
+
+// fullPrefix is the prefix of r after those of the groups around it.
+func (r *router) fullPrefix() string {
+	var prefix string
+	for g := r; g != nil; g = g.parent {
+		prefix = g.prefix + prefix
+	}
+	return prefix
+}
+
+// pattern puts the prefixes of r in front of the path of a ServeMux
+// pattern, "GET /users" in group "/api" being "GET /api/users".
+func (r *router) pattern(pattern string) string {
+	prefix := r.fullPrefix()
+	i := strings.Index(pattern, "/")
+	if i < 0 || prefix == "" {
+		return pattern
+	}
+	return pattern[:i] + prefix + pattern[i:]
+}
+
+func (r *router) handle(pattern string, fn object.Object) (err error) {
+	// the ServeMux panics on invalid and conflicting patterns
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	s := r.server
+	s.mux.HandleFunc(r.pattern(pattern), func(w http.ResponseWriter, req *http.Request) {
+		ex := req.Context().Value(exchangeKey{}).(*exchange)
+		ex.result = s.runChain(r.chain(), ex, func() object.Object {
+			// net/http runs every request on a goroutine of its own;
+			// call gives each one its own environment, with req and res
+			// bound to the handler's parameters
+			return writeResult(ex.res, s.call(fn, ex.req, ex.resObj))
+		})
+	})
+	return nil
+}
+
+// builtins returns handle, use and group acting on r.
+func (r *router) builtins() map[string]object.Object {
+	return map[string]object.Object{
+		// handle(pattern, fn(req, res))
+		"handle": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 2 {
+					return newGlobalError("wrong number of arguments. got=%d, want=2", len(args))
+				}
+				pattern, ok := args[0].(*object.String)
+				if !ok {
+					return newError("first argument must be string path")
+				}
+				if !isCallable(args[1]) {
+					return newError("second argument for handler should be a function")
+				}
+				if err := r.handle(pattern.Value, args[1]); err != nil {
+					return newError("invalid route %s: %s", pattern.Value, err)
+				}
+				return NULL
+			},
+		},
+		// use(fn(req, res, next)...)
+		"use": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) == 0 {
+					return newGlobalError("wrong number of arguments. got=0, want at least 1")
+				}
+				for _, mw := range args {
+					if !isCallable(mw) {
+						return newError("middleware should be a function, got %s", mw.Type())
+					}
+				}
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				r.middlewares = append(r.middlewares, args...)
+				return NULL
+			},
+		},
+		// group(prefix, fn(req, res, next)...)
+		"group": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) == 0 {
+					return newGlobalError("wrong number of arguments. got=0, want at least 1")
+				}
+				prefix, ok := args[0].(*object.String)
+				if !ok || !strings.HasPrefix(prefix.Value, "/") || strings.HasSuffix(prefix.Value, "/") {
+					return newError("group prefix must be a path like /api, got %s", args[0].Inspect())
+				}
+				for _, mw := range args[1:] {
+					if !isCallable(mw) {
+						return newError("middleware should be a function, got %s", mw.Type())
+					}
+				}
+				g := &router{server: r.server, parent: r, prefix: prefix.Value}
+				g.middlewares = append(g.middlewares, args[1:]...)
+				values := g.builtins()
+				values["prefix"] = &object.String{Value: g.fullPrefix()}
+				return newHash(values)
+			},
+		},
+	}
+}
+
+func isCallable(fn object.Object) bool {
+	switch fn.(type) {
+	case *object.Function, *object.Closure, *object.Builtin:
+		return true
+	}
+	return false
+}
+
+// middlewares returns the constructors of the built-in middlewares.
+func (s *server) middlewares() map[string]object.Object {
+	return map[string]object.Object{
+		// logger()
+		"logger": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 0 {
+					return newGlobalError("wrong number of arguments. got=%d, want=0", len(args))
+				}
+				return s.middleware(s.logRequest)
+			},
+		},
+		// recover()
+		"recover": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 0 {
+					return newGlobalError("wrong number of arguments. got=%d, want=0", len(args))
+				}
+				return s.middleware(s.recoverErrors)
+			},
+		},
+		// cors({origins, methods, headers, credentials, max_age})
+		"cors": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) > 1 {
+					return newGlobalError("wrong number of arguments. got=%d, want=0 or 1", len(args))
+				}
+				options := newHash(nil)
+				if len(args) == 1 {
+					h, ok := args[0].(*object.Hash)
+					if !ok {
+						return newError("argument must be a hash of CORS options")
+					}
+					options = h
+				}
+				c, err := newCorsOptions(options)
+				if err != nil {
+					return err
+				}
+				return s.middleware(c.handle)
+			},
+		},
+		// basic_auth({user: password}, realm)
+		"basic_auth": &object.Builtin{
+			Fn: func(args ...object.Object) object.Object {
+				if len(args) != 1 && len(args) != 2 {
+					return newGlobalError("wrong number of arguments. got=%d, want=1 or 2", len(args))
+				}
+				users, ok := args[0].(*object.Hash)
+				if !ok {
+					return newError("first argument must be a hash of users and passwords")
+				}
+				realm := "restricted"
+				if len(args) == 2 {
+					r, ok := args[1].(*object.String)
+					if !ok {
+						return newError("second argument must be a string realm")
+					}
+					realm = r.Value
+				}
+				passwords := map[string]string{}
+				for _, pair := range users.Pairs {
+					password, ok := pair.Value.(*object.String)
+					if !ok {
+						return newError("password of %s must be a string", pair.Key.Inspect())
+					}
+					passwords[pair.Key.Inspect()] = password.Value
+				}
+				return s.middleware(func(req *object.Hash, res *response, next func() object.Object) object.Object {
+					return basicAuth(passwords, realm, req, res, next)
+				})
+			},
+		},
+	}
+}
+
+// middleware turns a Go function into a middleware scripts can use.
+func (s *server) middleware(fn func(req *object.Hash, res *response, next func() object.Object) object.Object) *object.Builtin {
+	return &object.Builtin{
+		Fn: func(args ...object.Object) object.Object {
+			if len(args) != 3 {
+				return newGlobalError("wrong number of arguments. got=%d, want=3", len(args))
+			}
+			req, err := requestArg(args[0])
+			if err != nil {
+				return err
+			}
+			res, err := responseArg(args[1])
+			if err != nil {
+				return err
+			}
+			next := args[2]
+			return fn(req, res, func() object.Object { return s.call(next) })
+		},
+	}
+}
+
+// logRequest logs the method, path, status and duration of every request.
+func (s *server) logRequest(req *object.Hash, res *response, next func() object.Object) object.Object {
+	start := time.Now()
+	result := next()
+	status := res.status
+	_, failed := result.(*object.GlobalError)
+	switch {
+	case res.wroteHeader:
+		status = res.code
+	case failed:
+		status = http.StatusInternalServerError
+	case status == 0:
+		status = http.StatusOK
+	}
+	log.Printf("%s %s %d %s", hashGet(req, "method").Inspect(), hashGet(req, "path").Inspect(),
+		status, time.Since(start).Round(time.Microsecond))
+	return result
+}
+
+// recoverErrors answers 500 when a later handler fails, with a script
+// error or a Go panic, and logs the error.
+func (s *server) recoverErrors(req *object.Hash, res *response, next func() object.Object) (result object.Object) {
+	fail := func(message string) {
+		log.Printf("%s %s: %s", hashGet(req, "method").Inspect(), hashGet(req, "path").Inspect(), message)
+		if !res.wroteHeader {
+			http.Error(res, "internal server error", http.StatusInternalServerError)
+		}
+		result = NULL
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			fail(fmt.Sprintf("panic: %v", p))
+		}
+	}()
+	result = next()
+	if ge, ok := result.(*object.GlobalError); ok {
+		fail(ge.Traceback())
+	}
+	return result
+}
+
+type corsOptions struct {
+	origins     []string // "*" allows any
+	methods     string
+	headers     string // "" echoes what the preflight asks for
+	credentials bool
+	maxAge      int
+}
+
+func newCorsOptions(options *object.Hash) (*corsOptions, *object.Error) {
+	c := &corsOptions{
+		origins: []string{"*"},
+		methods: "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+	}
+	stringList := func(key string, value object.Object) ([]string, *object.Error) {
+		array, ok := value.(*object.Array)
+		if !ok {
+			return nil, newError("cors option %s must be an array of strings", key)
+		}
+		var values []string
+		for _, element := range array.Elements {
+			s, ok := element.(*object.String)
+			if !ok {
+				return nil, newError("cors option %s must be an array of strings", key)
+			}
+			values = append(values, s.Value)
+		}
+		return values, nil
+	}
+	for _, pair := range options.Pairs {
+		key := pair.Key.Inspect()
+		switch key {
+		case "origins":
+			values, err := stringList(key, pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			c.origins = values
+		case "methods", "headers":
+			values, err := stringList(key, pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			joined := strings.Join(values, ", ")
+			if key == "methods" {
+				c.methods = joined
+			} else {
+				c.headers = joined
+			}
+		case "credentials":
+			b, ok := pair.Value.(*object.Bool)
+			if !ok {
+				return nil, newError("cors option credentials must be a bool")
+			}
+			c.credentials = b.Value
+		case "max_age":
+			n, ok := pair.Value.(*object.Number)
+			if !ok {
+				return nil, newError("cors option max_age must be a number of seconds")
+			}
+			c.maxAge = int(n.Value)
+		default:
+			return nil, newError("unknown cors option %s", key)
+		}
+	}
+	return c, nil
+}
+
+// handle adds the CORS headers for allowed origins, and answers their
+// preflight requests itself.
+func (c *corsOptions) handle(req *object.Hash, res *response, next func() object.Object) object.Object {
+	headers, _ := hashGet(req, "headers").(*object.Hash)
+	header := func(name string) string {
+		if headers == nil {
+			return ""
+		}
+		if s, ok := hashGet(headers, name).(*object.String); ok {
+			return s.Value
+		}
+		return ""
+	}
+	origin := header("Origin")
+	allowed := ""
+	for _, o := range c.origins {
+		if o == "*" && !c.credentials {
+			allowed = "*"
+			break
+		}
+		if o == "*" || o == origin {
+			allowed = origin
+			break
+		}
+	}
+	if origin == "" || allowed == "" {
+		return next()
+	}
+
+	h := res.Header()
+	h.Set("Access-Control-Allow-Origin", allowed)
+	if allowed != "*" {
+		h.Add("Vary", "Origin")
+	}
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	method := header("Access-Control-Request-Method")
+	if hashGet(req, "method").Inspect() != http.MethodOptions || method == "" {
+		return next()
+	}
+	h.Set("Access-Control-Allow-Methods", c.methods)
+	if allowHeaders := c.headers; allowHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", allowHeaders)
+	} else if requested := header("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.maxAge > 0 {
+		h.Set("Access-Control-Max-Age", fmt.Sprint(c.maxAge))
+	}
+	res.WriteHeader(http.StatusNoContent)
+	return NULL
+}
+
+// basicAuth lets requests with one of the users and their password
+// through, and answers 401 to the others.
+func basicAuth(passwords map[string]string, realm string, req *object.Hash, res *response, next func() object.Object) object.Object {
+	var authorization string
+	if headers, ok := hashGet(req, "headers").(*object.Hash); ok {
+		if s, ok := hashGet(headers, "Authorization").(*object.String); ok {
+			authorization = s.Value
+		}
+	}
+	if encoded, ok := strings.CutPrefix(authorization, "Basic "); ok {
+		if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			user, password, _ := strings.Cut(string(decoded), ":")
+			want, known := passwords[user]
+			// compare even for unknown users, to take the same time
+			match := subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+			if known && match {
+				return next()
+			}
+		}
+	}
+	res.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	http.Error(res, "unauthorized", http.StatusUnauthorized)
+	return NULL
+}
@@ -0,0 +1,667 @@
+package modules_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pecet3/hmbk-script/evaluation"
+	"github.com/pecet3/hmbk-script/lexer"
+	"github.com/pecet3/hmbk-script/modules"
+	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/parser"
+)
+
+func testEval(input string) object.Object {
+	program := parser.New(lexer.New(input)).ParseProgram()
+	return evaluation.Eval(program, object.NewEnvironment())
+}
+
+func isError(obj object.Object) bool {
+	_, ok := obj.(*object.Error)
+	return ok
+}
+
+func isGlobalError(obj object.Object) bool {
+	_, ok := obj.(*object.GlobalError)
+	return ok
+}
+
+// newTestServer evaluates input, which defines handler, and registers
+// handler for pattern with an http module of its own. It returns the
+// server, the script's environment and the module.
+func newTestServer(t *testing.T, input, pattern string) (http.Handler, *object.Environment, *object.Environment) {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	env := object.NewEnvironment()
+	if result := evaluation.Eval(program, env); isGlobalError(result) {
+		t.Fatalf("eval error: %s", result.Inspect())
+	}
+	handler, _ := env.Get("handler")
+
+	module, srv := modules.NewHttpModule(evaluation.Call)
+	handle, _ := module.Get("handle")
+	if result := handle.(*object.Builtin).Fn(&object.String{Value: pattern}, handler); result != object.NullValue {
+		t.Fatalf("handle: %s", result.Inspect())
+	}
+	return srv, env, module
+}
+
+// TestConcurrentHandlers serves many requests at once, each on a goroutine
+// of its own as net/http does; run it with -race.
+func TestConcurrentHandlers(t *testing.T) {
+	input := `
+mut hits = 0;
+mut req = "global";
+const handler = fn(req, res) {
+	mut id = http.get_param(req, "id");
+	hits = hits + 1;
+	"id=" + id
+};`
+	mux, env, _ := newTestServer(t, input, "GET /item")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("/item?id=%d", i), nil))
+			if want := fmt.Sprintf("id=%d", i); rec.Body.String() != want {
+				t.Errorf("got %q, want %q", rec.Body.String(), want)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the parameters are the handler's own, not the global they shadow
+	if req, _ := env.Get("req"); req.Inspect() != "global" {
+		t.Errorf("global req = %s, want global", req.Inspect())
+	}
+}
+
+func TestResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler string
+		cookie  string // sent with the request
+		status  int
+		headers map[string]string
+		body    string
+	}{
+		{
+			name:    "string",
+			handler: `fn(req, res) { "hello" }`,
+			status:  200,
+			body:    "hello",
+		},
+		{
+			name:    "status and header before the body",
+			handler: `fn(req, res) { http.set_status(res, 400); http.set_header(res, "X-Reason", "bad"); "invalid JSON" }`,
+			status:  400,
+			headers: map[string]string{"X-Reason": "bad"},
+			body:    "invalid JSON",
+		},
+		{
+			name:    "status without a body",
+			handler: `fn(req, res) { http.set_status(res, 204) }`,
+			status:  204,
+		},
+		{
+			name:    "respond with a string",
+			handler: `fn(req, res) { http.respond(res, 201, "created", {"Location": "/item/1"}) }`,
+			status:  201,
+			headers: map[string]string{"Location": "/item/1"},
+			body:    "created",
+		},
+		{
+			name:    "respond with json",
+			handler: `fn(req, res) { http.respond(res, 200, {"id": 1}) }`,
+			status:  200,
+			headers: map[string]string{"Content-Type": "application/json"},
+			body:    `{"id":1}`,
+		},
+		{
+			name:    "write json after set_status",
+			handler: `fn(req, res) { http.set_status(res, 202); http.write_json(res, [1, "a"]); }`,
+			status:  202,
+			headers: map[string]string{"Content-Type": "application/json"},
+			body:    `[1,"a"]`,
+		},
+		{
+			name:    "response hash",
+			handler: `fn(req, res) { {"status": 404, "headers": {"X-Missing": "yes"}, "body": "not here"} }`,
+			status:  404,
+			headers: map[string]string{"X-Missing": "yes"},
+			body:    "not here",
+		},
+		{
+			name:    "other hashes print",
+			handler: `fn(req, res) { {"name": "x"} }`,
+			status:  200,
+			body:    "{name: x}",
+		},
+		{
+			name:    "redirect",
+			handler: `fn(req, res) { http.redirect(res, "/login", 303) }`,
+			status:  303,
+			headers: map[string]string{"Location": "/login"},
+		},
+		{
+			name:    "cookies",
+			handler: `fn(req, res) { http.set_cookie(res, "seen", "yes", {"max_age": 60, "http_only": true}); http.get_cookie(req, "session") }`,
+			cookie:  "session=abc",
+			status:  200,
+			headers: map[string]string{"Set-Cookie": "seen=yes; Path=/; Max-Age=60; HttpOnly"},
+			body:    "abc",
+		},
+		{
+			name:    "missing cookie",
+			handler: `fn(req, res) { typeof(http.get_cookie(req, "session")) }`,
+			status:  200,
+			body:    "null",
+		},
+		{
+			name:    "error",
+			handler: `fn(req, res) { http.set_status(res, 201); throw "boom" }`,
+			status:  500,
+			body:    "internal server error\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, _, _ := newTestServer(t, "const handler = "+tt.handler+";", "/")
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			for name, want := range tt.headers {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.status != 303 && rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestRequests(t *testing.T) {
+	multipartBody := func(fileSize int) (string, string) {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		w.WriteField("title", "report")
+		f, _ := w.CreateFormFile("upload", "data.txt")
+		f.Write(bytes.Repeat([]byte("x"), fileSize))
+		w.Close()
+		return body.String(), w.FormDataContentType()
+	}
+	upload, uploadType := multipartBody(5)
+	bigUpload, bigUploadType := multipartBody(200)
+
+	tests := []struct {
+		name        string
+		handler     string
+		method      string
+		target      string
+		contentType string
+		body        string
+		cookie      string
+		status      int
+		want        string
+	}{
+		{
+			name:    "method, path and path value",
+			handler: `fn(req, res) { req.method + " " + req.path + " " + req.path_value("id") }`,
+			method:  "POST",
+			target:  "/user/42",
+			status:  200,
+			want:    "POST /user/42 42",
+		},
+		{
+			name:    "query, url and remote address",
+			handler: `fn(req, res) { req.query.q + " " + http.get_param(req, "q") + " " + http.get_param(req, "none") + "|" + req.url + " " + req.remote_addr }`,
+			target:  "/user/1?q=go",
+			status:  200,
+			want:    "go go |/user/1?q=go 192.0.2.1:1234",
+		},
+		{
+			name:    "headers and cookies",
+			handler: `fn(req, res) { req.headers["X-Token"] + " " + http.get_header(req, "x-token") + " " + req.cookies.session }`,
+			cookie:  "session=abc",
+			status:  200,
+			want:    "t t abc",
+		},
+		{
+			name:        "raw body and json",
+			handler:     `fn(req, res) { req.body + " " + http.get_json(req)["a"] }`,
+			method:      "POST",
+			contentType: "application/json",
+			body:        `{"a": 1}`,
+			status:      200,
+			want:        `{"a": 1} 1`,
+		},
+		{
+			name:        "urlencoded form",
+			handler:     `fn(req, res) { req.form.name + " " + req.form.age }`,
+			method:      "POST",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "name=ann&age=30",
+			status:      200,
+			want:        "ann 30",
+		},
+		{
+			name:        "multipart form and file",
+			handler:     `fn(req, res) { mut f = req.files.upload; req.form.title + " " + f.filename + " " + f.size + " " + f.content }`,
+			method:      "POST",
+			contentType: uploadType,
+			body:        upload,
+			status:      200,
+			want:        "report data.txt 5 xxxxx",
+		},
+		{
+			name:        "file over the limit",
+			handler:     `fn(req, res) { "unreachable" }`,
+			method:      "POST",
+			contentType: bigUploadType,
+			body:        bigUpload,
+			status:      413,
+		},
+		{
+			name:    "body over the limit",
+			handler: `fn(req, res) { "unreachable" }`,
+			method:  "POST",
+			body:    strings.Repeat("x", 2000),
+			status:  413,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux, _, module := newTestServer(t, "const handler = "+tt.handler+";", "/user/{id}")
+			setLimits, _ := module.Get("set_limits")
+			limits := modules.NewHash(map[string]object.Object{
+				"max_body": &object.Number{Value: 1000},
+				"max_file": &object.Number{Value: 100},
+			})
+			if result := setLimits.(*object.Builtin).Fn(limits); result != object.NullValue {
+				t.Fatalf("set_limits: %s", result.Inspect())
+			}
+
+			method, target := tt.method, tt.target
+			if method == "" {
+				method = "GET"
+			}
+			if target == "" {
+				target = "/user/1"
+			}
+			req := httptest.NewRequest(method, target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			req.Header.Set("X-Token", "t")
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.want != "" && rec.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+// newScriptServer evaluates input with an http module of its own bound to
+// web, for scripts that set up their routes and middlewares themselves.
+func newScriptServer(t *testing.T, input string) http.Handler {
+	t.Helper()
+	module, srv := modules.NewHttpModule(evaluation.Call)
+	web := map[string]object.Object{}
+	for _, name := range []string{"handle", "use", "group", "logger", "recover", "cors", "basic_auth", "set_header"} {
+		web[name], _ = module.Get(name)
+	}
+	env := object.NewEnvironment()
+	env.SetConst("web", modules.NewHash(web))
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	if result := evaluation.Eval(program, env); isGlobalError(result) {
+		t.Fatalf("eval error: %s", result.Inspect())
+	}
+	return srv
+}
+
+func TestMiddleware(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	srv := newScriptServer(t, `
+mut trace = "";
+const a = fn(req, res, next) { trace = "a"; web.set_header(res, "X-Seen", "yes"); next() };
+const b = fn(req, res, next) { trace = trace + "b"; next() };
+const c = fn(req, res, next) { trace = trace + "c"; next() };
+const deny = fn(req, res, next) {
+	if (req.query.key == "secret") { return next() }
+	{"status": 403, "body": "denied"}
+};
+const after = fn(req, res, next) { next(); "after" };
+
+web.use(a, web.logger(), web.cors({"origins": ["https://example.com"], "max_age": 60}));
+web.handle("GET /{$}", fn(req, res) { trace + "h" });
+const api = web.group("/api", b);
+api.use(c);
+api.handle("GET /users/{id}", fn(req, res) { trace + "h " + req.path_value("id") + " " + api.prefix });
+const nested = api.group("/v1");
+nested.handle("GET /ping", fn(req, res) { trace + "h" });
+const private = web.group("/private", deny);
+private.handle("GET /", fn(req, res) { "secret" });
+const auth = web.group("/auth", web.basic_auth({"ann": "pw"}, "hmbk"));
+auth.handle("GET /", fn(req, res) { "welcome" });
+const failing = web.group("/fail", after, web.recover());
+failing.handle("GET /", fn(req, res) { throw "boom" });
+`)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		status  int
+		body    string
+		want    map[string]string // response headers
+	}{
+		{name: "server middlewares", target: "/", status: 200, body: "ah", want: map[string]string{"X-Seen": "yes"}},
+		{name: "group middlewares in order", target: "/api/users/7", status: 200, body: "abch 7 /api"},
+		{name: "nested group", target: "/api/v1/ping", status: 200, body: "abch"},
+		{name: "no route", target: "/missing", status: 404, want: map[string]string{"X-Seen": "yes"}},
+		{name: "middleware answers", target: "/private/", status: 403, body: "denied"},
+		{name: "middleware lets through", target: "/private/?key=secret", status: 200, body: "secret"},
+		{name: "basic auth without credentials", target: "/auth/", status: 401,
+			want: map[string]string{"WWW-Authenticate": `Basic realm="hmbk"`}},
+		{name: "basic auth with a wrong password", target: "/auth/", status: 401,
+			headers: map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("ann:no"))}},
+		{name: "basic auth", target: "/auth/", status: 200, body: "welcome",
+			headers: map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("ann:pw"))}},
+		{name: "recover", target: "/fail/", status: 500, body: "internal server error\nafter"},
+		{name: "cors", target: "/", status: 200, body: "ah",
+			headers: map[string]string{"Origin": "https://example.com"},
+			want:    map[string]string{"Access-Control-Allow-Origin": "https://example.com"}},
+		{name: "cors from another origin", target: "/", status: 200, body: "ah",
+			headers: map[string]string{"Origin": "https://evil.com"},
+			want:    map[string]string{"Access-Control-Allow-Origin": ""}},
+		{name: "cors preflight", method: "OPTIONS", target: "/api/users/7", status: 204,
+			headers: map[string]string{"Origin": "https://example.com", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Token"},
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://example.com",
+				"Access-Control-Allow-Methods": "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+				"Access-Control-Allow-Headers": "X-Token",
+				"Access-Control-Max-Age":       "60",
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			req := httptest.NewRequest(method, tt.target, nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.body)
+			}
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+
+	if !strings.Contains(logged.String(), "GET /api/users/7 200") || !strings.Contains(logged.String(), "GET /missing 404") ||
+		!strings.Contains(logged.String(), "GET /private/ 403") {
+		t.Errorf("missing request log lines in:\n%s", logged.String())
+	}
+}
+
+func TestInvalidRoute(t *testing.T) {
+	module, _ := modules.NewHttpModule(evaluation.Call)
+	handle, _ := module.Get("handle")
+	handler := &object.Builtin{Fn: func(args ...object.Object) object.Object { return object.NullValue }}
+	result := handle.(*object.Builtin).Fn(&object.String{Value: "GET /a/{"}, handler)
+	if _, ok := result.(*object.Error); !ok {
+		t.Errorf("got %v, want an error", result)
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	module, _ := modules.NewHttpModule(evaluation.Call)
+	call := func(obj object.Object, args ...object.Object) object.Object {
+		t.Helper()
+		result := evaluation.Call(obj, args...)
+		if isError(result) {
+			t.Fatalf("got error %s", result.Inspect())
+		}
+		return result
+	}
+	newServer := func(options string, body string) *object.Hash {
+		t.Helper()
+		server, _ := module.Get("server")
+		var args []object.Object
+		if options != "" {
+			args = append(args, testEval(options))
+		}
+		h, ok := call(server, args...).(*object.Hash)
+		if !ok {
+			t.Fatalf("server() did not return a hash")
+		}
+		call(modules.HashGet(h, "handle"), &object.String{Value: "GET /{$}"}, &object.Builtin{
+			Fn: func(args ...object.Object) object.Object { return &object.String{Value: body} },
+		})
+		return h
+	}
+	get := func(client *http.Client, url string) (string, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	a := newServer(`{"read_timeout": 5, "write_timeout": 5, "shutdown_timeout": 1, "max_body": 1024}`, "a")
+	b := newServer("", "b")
+	for _, srv := range []*object.Hash{a, b} {
+		if addr := call(modules.HashGet(srv, "addr")); addr != object.NullValue {
+			t.Fatalf("addr before listen = %s, want null", addr.Inspect())
+		}
+		call(modules.HashGet(srv, "listen"), &object.String{Value: "127.0.0.1:0"})
+	}
+	addrA := call(modules.HashGet(a, "addr")).Inspect()
+	addrB := call(modules.HashGet(b, "addr")).Inspect()
+
+	if result := evaluation.Call(modules.HashGet(a, "listen"), &object.String{Value: "127.0.0.1:0"}); !isError(result) {
+		t.Errorf("listening twice: got %s, want an error", result.Inspect())
+	}
+	for addr, want := range map[string]string{addrA: "a", addrB: "b"} {
+		if body, err := get(http.DefaultClient, "http://"+addr+"/"); err != nil || body != want {
+			t.Errorf("GET %s = %q, %v, want %q", addr, body, err, want)
+		}
+	}
+
+	// shutting down one server leaves the other serving
+	call(modules.HashGet(a, "shutdown"), &object.Number{Value: 1})
+	wait, _ := module.Get("wait")
+	done := make(chan struct{})
+	go func() {
+		wait.(*object.Builtin).Fn()
+		close(done)
+	}()
+	if _, err := get(http.DefaultClient, "http://"+addrA+"/"); err == nil {
+		t.Errorf("server a still serving after shutdown")
+	}
+	if body, err := get(http.DefaultClient, "http://"+addrB+"/"); err != nil || body != "b" {
+		t.Errorf("GET b after shutting down a = %q, %v", body, err)
+	}
+	select {
+	case <-done:
+		t.Fatalf("wait returned while b is serving")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// SIGINT and SIGTERM shut down every server
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait did not return after SIGTERM")
+	}
+	if _, err := get(http.DefaultClient, "http://"+addrB+"/"); err == nil {
+		t.Errorf("server b still serving after SIGTERM")
+	}
+
+	// a server can listen again after shutting down, here with TLS
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	pool := writeTestCertificate(t, certFile, keyFile)
+	if result := evaluation.Call(modules.HashGet(a, "listen_tls"), &object.String{Value: "127.0.0.1:0"},
+		&object.String{Value: keyFile}, &object.String{Value: certFile}); !isError(result) {
+		t.Errorf("listen_tls with swapped files: got %s, want an error", result.Inspect())
+	}
+	call(modules.HashGet(a, "listen_tls"), &object.String{Value: "127.0.0.1:0"},
+		&object.String{Value: certFile}, &object.String{Value: keyFile})
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	addrA = call(modules.HashGet(a, "addr")).Inspect()
+	if body, err := get(client, "https://"+addrA+"/"); err != nil || body != "a" {
+		t.Errorf("GET over TLS = %q, %v, want %q", body, err, "a")
+	}
+
+	// listening again right after a shutdown, the new listener still
+	// counts as live once the old one stopped, so a signal shuts it down
+	call(modules.HashGet(a, "shutdown"))
+	call(modules.HashGet(a, "listen"), &object.String{Value: "127.0.0.1:0"})
+	addrA = call(modules.HashGet(a, "addr")).Inspect()
+	time.Sleep(50 * time.Millisecond)
+	done = make(chan struct{})
+	go func() {
+		wait.(*object.Builtin).Fn()
+		close(done)
+	}()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait did not return after SIGTERM")
+	}
+	if _, err := get(http.DefaultClient, "http://"+addrA+"/"); err == nil {
+		t.Errorf("server a still serving after SIGTERM")
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	module, _ := modules.NewHttpModule(evaluation.Call)
+	server, _ := module.Get("server")
+	for _, options := range []string{
+		`{"timeout": 5}`,
+		`{"read_timeout": -1}`,
+		`{"write_timeout": "5s"}`,
+		`{"max_body": 0}`,
+		`5`,
+	} {
+		if result := evaluation.Call(server, testEval(options)); !isError(result) {
+			t.Errorf("server(%s) = %s, want an error", options, result.Inspect())
+		}
+	}
+
+	h := evaluation.Call(server).(*object.Hash)
+	for _, grace := range []float64{math.NaN(), math.Inf(1), 1e10} {
+		if result := evaluation.Call(modules.HashGet(h, "shutdown"), &object.Number{Value: grace}); !isError(result) {
+			t.Errorf("shutdown(%v) = %s, want an error", grace, result.Inspect())
+		}
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key, and returns a pool trusting it.
+func writeTestCertificate(t *testing.T, certFile, keyFile string) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
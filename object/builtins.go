@@ -0,0 +1,375 @@
+package object
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// NullValue is the null value. Builtins return it, and both the evaluator and
+// the VM compare against it, so there is only one.
+var NullValue = &Null{}
+
+// BuiltinDef is a builtin function and the name scripts call it by.
+type BuiltinDef struct {
+	Name    string
+	Builtin *Builtin
+}
+
+// Builtins are the functions available everywhere without an import. The
+// evaluator looks them up by name; the compiler refers to them by their
+// index in this slice, so new builtins go at the end.
+var Builtins = []BuiltinDef{
+	{
+		"is_err",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				return &Bool{
+					Value: args[0].Type() == ERROR,
+				}
+			},
+		},
+	},
+	{
+		"error",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) < 1 || len(args) > 2 {
+					return newError("wrong number of arguments. got=%d, want=1..2", len(args))
+				}
+				message, ok := args[0].(*String)
+				if !ok {
+					return newError("first argument to `error` must be a string, got %s", args[0].Type())
+				}
+				errVal := &Error{Message: message.Value, Kind: ThrownErrorKind}
+				if len(args) == 2 {
+					kind, ok := args[1].(*String)
+					if !ok {
+						return newError("second argument to `error` must be a string, got %s", args[1].Type())
+					}
+					errVal.Kind = kind.Value
+				}
+				return errVal
+			},
+		},
+	},
+	{
+		"typeof",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1", len(args))
+				}
+				return &String{
+					Value: strings.ToLower(fmt.Sprintf("%s", args[0].Type())),
+				}
+			},
+		},
+	},
+	{
+		"append",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) < 1 {
+					return newError("wrong number of arguments. got=%d, min=2",
+						len(args))
+				}
+				switch arg := args[0].(type) {
+				case *Array:
+					arg.Elements = append(arg.Elements, args[1:]...)
+					return NullValue
+				case *Hash:
+					if len(args) < 2 {
+						return newError("wrong number of arguments. got=%d, min=3",
+							len(args))
+					}
+					if key, ok := args[1].(Hashable); ok {
+						pair := HashPair{
+							Key:   args[1],
+							Value: args[2],
+						}
+						arg.Pairs[key.HashKey()] = pair
+						return NullValue
+					}
+				default:
+					return newError("first argument must be an array in push method")
+				}
+				return NullValue
+			},
+		},
+	},
+	{
+		"delete",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 2 {
+					return newError("wrong number of arguments. got=%d, want=2",
+						len(args))
+				}
+				switch arg := args[0].(type) {
+				case *Array:
+					seeking := args[1]
+					newElements := []Object{}
+					for _, element := range arg.Elements {
+						if element.Inspect() == seeking.Inspect() {
+							continue
+						}
+						newElements = append(newElements, element)
+					}
+					arg.Elements = newElements
+					return NullValue
+				case *Hash:
+					if key, ok := args[1].(Hashable); ok {
+						delete(arg.Pairs, key.HashKey())
+					}
+				default:
+					return newError("first argument must be an array in push method")
+				}
+				return NullValue
+			},
+		},
+	},
+	{
+		"delete_index",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 2 {
+					return newError("wrong number of arguments. got=%d, want=2",
+						len(args))
+				}
+				switch arg := args[0].(type) {
+				case *Array:
+					seeking, ok := args[1].(*Number)
+					if !ok {
+						return newError("second argument must be an integer")
+					}
+					if len(arg.Elements)-1 < int(seeking.Value) {
+						return newError("provided index is too high. array has more than %d elements", seeking.Int()+1)
+					}
+					left := arg.Elements[:seeking.Int()]
+					right := arg.Elements[seeking.Int()+1:]
+					newArr := []Object{}
+					newArr = append(newArr, left...)
+					newArr = append(newArr, right...)
+					arg.Elements = newArr
+					return NullValue
+				default:
+					return newError("first argument must be an array in push method")
+				}
+			},
+		},
+	},
+	{
+		"len",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1",
+						len(args))
+				}
+				switch arg := args[0].(type) {
+				case *String:
+					return &Number{Value: float64(len(arg.Value))}
+				case *Array:
+					return &Number{Value: float64(len(arg.Elements))}
+				case *Range:
+					return &Number{Value: float64(arg.Len())}
+				default:
+					return newError("argument to `len` not supported, got %s",
+						args[0].Type())
+				}
+			},
+		},
+	},
+	{
+		"range",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) < 1 || len(args) > 3 {
+					return newError("wrong number of arguments. got=%d, want=1..3",
+						len(args))
+				}
+				bounds := []float64{}
+				for _, arg := range args {
+					num, ok := arg.(*Number)
+					if !ok {
+						return newError("arguments to `range` must be numbers, got %s",
+							arg.Type())
+					}
+					bounds = append(bounds, num.Value)
+				}
+				r := &Range{Start: 0, End: bounds[0], Step: 1}
+				if len(bounds) > 1 {
+					r.Start, r.End = bounds[0], bounds[1]
+				}
+				if len(bounds) > 2 {
+					r.Step = bounds[2]
+				}
+				if r.Step == 0 {
+					return newError("`range` step cannot be zero")
+				}
+				return r
+			},
+		},
+	},
+	{"print", &Builtin{Fn: printTo(os.Stdout)}},
+	{
+		"input",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1",
+						len(args))
+				}
+				switch arg := args[0].(type) {
+				case *String:
+					reader := bufio.NewReader(os.Stdin)
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						if err != io.EOF {
+							return newError("error reading input: %s", err.Error())
+						}
+					}
+					line = strings.TrimRight(line, "\r\n")
+					arg.Value = line
+					return &String{Value: line}
+				default:
+					return newError("argument to `input` not supported, got %s",
+						args[0].Type())
+				}
+			},
+		},
+	},
+	{"bash", &Builtin{Fn: bashTo(os.Stdout)}},
+	{
+		"to_string",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1",
+						len(args))
+				}
+				return &String{
+					Value: args[0].Inspect(),
+				}
+			},
+		},
+	},
+	{
+		"to_number",
+		&Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 1 {
+					return newError("wrong number of arguments. got=%d, want=1",
+						len(args))
+				}
+				obj := args[0]
+				if obj.Type() == STRING {
+					val, err := strconv.ParseFloat(obj.Inspect(), 64)
+					if err != nil {
+						return newError("this string cannot be parset into float: %s",
+							args[0].Inspect())
+					}
+					return &Number{
+						Value: val,
+					}
+				}
+				if obj.Type() == BOOL {
+					b := obj.(*Bool)
+					if b.Value {
+						return &Number{
+							Value: 1.0,
+						}
+					}
+					return &Number{
+						Value: 0.0,
+					}
+				}
+				return newError("cannot convert value: %s to a number",
+					args[0].Inspect())
+			},
+		},
+	},
+}
+
+// NewBuiltins returns a copy of Builtins in which print and bash write to
+// stdout instead of os.Stdout, for running a script whose output is
+// captured (see Environment.SetOutput and vm.VM.SetOutput).
+func NewBuiltins(stdout io.Writer) []BuiltinDef {
+	defs := append([]BuiltinDef{}, Builtins...)
+	for i, def := range defs {
+		switch def.Name {
+		case "print":
+			defs[i].Builtin = &Builtin{Fn: printTo(stdout)}
+		case "bash":
+			defs[i].Builtin = &Builtin{Fn: bashTo(stdout)}
+		}
+	}
+	return defs
+}
+
+func printTo(stdout io.Writer) BuiltinFunction {
+	return func(args ...Object) Object {
+		if len(args) != 1 {
+			return newError("wrong number of arguments. got=%d, want=1",
+				len(args))
+		}
+		for i, arg := range args {
+			fmt.Fprint(stdout, arg.Inspect())
+			if i == len(args)-1 {
+				fmt.Fprintln(stdout)
+			}
+		}
+		return NullValue
+	}
+}
+
+func bashTo(stdout io.Writer) BuiltinFunction {
+	return func(args ...Object) Object {
+		if len(args) != 1 {
+			return newError("wrong number of arguments. got=%d, want=1",
+				len(args))
+		}
+		switch arg := args[0].(type) {
+		case *String:
+			cmd := exec.Command("bash", "-c", arg.Inspect())
+			if cmd.Err != nil {
+				return newError("%s", cmd.Err.Error())
+			}
+			output, err := cmd.Output()
+			if err != nil {
+				return newError("%s", err.Error())
+			}
+			fmt.Fprintln(stdout, string(output))
+		default:
+			return newError("argument to `bash` not supported, got %s",
+				args[0].Type())
+		}
+		return NullValue
+	}
+}
+
+// BuiltinModules are the modules available without an import, such as
+// http. The compiler refers to them by their index in this slice.
+var BuiltinModules = []string{"http"}
+
+// GetBuiltinByName returns the builtin called name, or nil.
+func GetBuiltinByName(name string) *Builtin {
+	for _, def := range Builtins {
+		if def.Name == name {
+			return def.Builtin
+		}
+	}
+	return nil
+}
+
+func newError(format string, a ...interface{}) *GlobalError {
+	return &GlobalError{Message: fmt.Sprintf(format, a...)}
+}
@@ -1,34 +1,60 @@
 package object
 
+import (
+	"io"
+	"sync"
+)
+
+// Environment binds names to values. The bindings are guarded by a lock,
+// for builtin modules calling back into the script (see modules.Caller);
+// the values themselves are not.
 type Environment struct {
+	mu             sync.RWMutex
+	moduleName     string
 	store          map[string]Object
 	consts         map[string]Object
 	modules        map[string]Object
 	public         map[string]Object
 	outer          *Environment
 	BuiltinObjects map[string]Object
+
+	// loopVars is set on the environment of a for-in body: only the loop
+	// variables are bound in it, everything else goes to outer.
+	loopVars map[string]bool
 }
 
-func (e *Environment) Get(name string) (Object, bool) {
-	obj, ok := e.store[name]
-	if !ok {
-		obj, ok = e.consts[name]
+// owner returns the environment a binding of name is made in, which is e
+// unless e is a loop environment and name isn't one of its variables.
+func (e *Environment) owner(name string) *Environment {
+	for e.loopVars != nil && !e.loopVars[name] {
+		e = e.outer
 	}
+	return e
+}
+
+func (e *Environment) Get(name string) (Object, bool) {
+	obj, ok := e.GetNoOuter(name)
 	if !ok && e.outer != nil {
 		obj, ok = e.outer.Get(name)
 		if !ok {
+			e.mu.RLock()
 			obj, ok = e.modules[name]
+			e.mu.RUnlock()
 		}
 	}
 	return obj, ok
 }
 
 func (e *Environment) GetPublic(name string) (Object, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	obj, ok := e.public[name]
 	return obj, ok
 }
 
 func (e *Environment) GetNoOuter(name string) (Object, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	obj, ok := e.store[name]
 	if !ok {
 		obj, ok = e.consts[name]
@@ -37,37 +63,98 @@ func (e *Environment) GetNoOuter(name string) (Object, bool) {
 }
 
 func (e *Environment) GetMutNoOuter(name string) (Object, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	obj, ok := e.store[name]
 	return obj, ok
 }
 
+// IsConst reports whether name resolves to a const, looking through outer
+// environments unless a mutable variable shadows it first.
 func (e *Environment) IsConst(name string) bool {
-	_, ok := e.consts[name]
-	return ok
+	e.mu.RLock()
+	_, isConst := e.consts[name]
+	_, isMut := e.store[name]
+	e.mu.RUnlock()
+	if isConst {
+		return true
+	}
+	if isMut {
+		return false
+	}
+	return e.outer != nil && e.outer.IsConst(name)
 }
 func (e *Environment) SetConst(name string, val Object) Object {
+	e = e.owner(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.consts[name] = val
 	return val
 }
 func (e *Environment) SetPublicConst(name string, val Object) Object {
+	e = e.owner(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.public[name] = val
 	return val
 }
+
+// Set assigns obj to the nearest mutable binding of name, in e or an outer
+// environment, or binds name in e if there is none.
 func (e *Environment) Set(name string, obj Object) {
-	if e.outer != nil {
-		_, ok := e.outer.store[name]
-		if ok {
-			e.outer.store[name] = obj
+	for env := e; env != nil; env = env.outer {
+		env.mu.Lock()
+		if _, ok := env.store[name]; ok {
+			env.store[name] = obj
+			env.mu.Unlock()
+			return
 		}
+		env.mu.Unlock()
 	}
+	e.Define(name, obj)
+}
+
+// Define binds name in e itself, never in an outer environment, as
+// declarations and function parameters are.
+func (e *Environment) Define(name string, obj Object) {
+	e = e.owner(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.store[name] = obj
 }
+
+// SetOutput makes print and bash write to w in scripts run in e.
+func (e *Environment) SetOutput(w io.Writer) {
+	for _, def := range NewBuiltins(w) {
+		e.BuiltinObjects[def.Name] = def.Builtin
+	}
+}
+
+// GetBuiltin returns the builtin name as set by SetOutput on e or an outer
+// environment.
+func (e *Environment) GetBuiltin(name string) (Object, bool) {
+	for env := e; env != nil; env = env.outer {
+		if builtin, ok := env.BuiltinObjects[name]; ok {
+			return builtin, true
+		}
+	}
+	return nil, false
+}
+
 func (e *Environment) GetModule(name string) (Object, bool) {
+	e.mu.RLock()
 	obj, ok := e.modules[name]
+	e.mu.RUnlock()
+	if !ok && e.outer != nil {
+		return e.outer.GetModule(name)
+	}
 	return obj, ok
 }
 
 func (e *Environment) SetModule(name string, val Object) Object {
+	e = e.owner(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.modules[name] = val
 	return val
 }
@@ -92,7 +179,40 @@ func NewClosedEnvironment(outer *Environment) *Environment {
 	return env
 }
 
+// NewLoopEnvironment creates the environment a for-in body runs in. The
+// loop variables names are bound in it, so they don't overwrite bindings of
+// the same name outside the loop; any other binding made in the body goes
+// to outer, as loops don't open a block scope.
+func NewLoopEnvironment(outer *Environment, names ...string) *Environment {
+	env := NewClosedEnvironment(outer)
+	env.loopVars = make(map[string]bool, len(names))
+	for _, name := range names {
+		env.loopVars[name] = true
+	}
+	return env
+}
+
+// NewModuleEnvironment creates the environment a module body runs in.
+func NewModuleEnvironment(outer *Environment, name string) *Environment {
+	env := NewClosedEnvironment(outer)
+	env.moduleName = name
+	return env
+}
+
+// ModuleName returns the name of the innermost module e belongs to, or ""
+// for the main program.
+func (e *Environment) ModuleName() string {
+	for env := e; env != nil; env = env.outer {
+		if env.moduleName != "" {
+			return env.moduleName
+		}
+	}
+	return ""
+}
+
 func (e *Environment) WithOnlyPublic() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.store = nil
 	newConsts := make(map[string]Object)
 	for k, v := range e.consts {
@@ -0,0 +1,144 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Range is a lazy sequence of numbers from Start up to, but not including, End.
+type Range struct {
+	Start float64
+	End   float64
+	Step  float64
+}
+
+func (r *Range) Type() ObjectType { return RANGE }
+func (r *Range) Inspect() string {
+	return fmt.Sprintf("range(%s, %s, %s)", formatNumber(r.Start), formatNumber(r.End), formatNumber(r.Step))
+}
+
+// Len returns ceil((End-Start)/Step), the number of elements the range
+// visits, without walking them.
+func (r *Range) Len() int {
+	n := math.Ceil((r.End - r.Start) / r.Step)
+	switch {
+	case !(n > 0): // also NaN, from a zero step or infinite bounds
+		return 0
+	case n >= math.MaxInt:
+		return math.MaxInt
+	}
+	return int(n)
+}
+
+// At returns the i-th element, computed from Start so a fractional step
+// doesn't accumulate rounding errors.
+func (r *Range) At(i int) float64 {
+	return r.Start + float64(i)*r.Step
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Iterator walks the elements visited by a for-in loop.
+type Iterator struct {
+	next     func() (key, value Object, ok bool)
+	keysOnly bool
+}
+
+func (it *Iterator) Type() ObjectType { return ITERATOR }
+func (it *Iterator) Inspect() string  { return "iterator" }
+
+// Next returns the next key/value pair: index and element for arrays,
+// strings and ranges, key and value for hashes.
+func (it *Iterator) Next() (key, value Object, ok bool) {
+	return it.next()
+}
+
+// NextValue returns what the single variable form `for (x in xs)` binds:
+// the key for hashes and the element for everything else.
+func (it *Iterator) NextValue() (Object, bool) {
+	key, value, ok := it.next()
+	if it.keysOnly {
+		return key, ok
+	}
+	return value, ok
+}
+
+// NewIterator returns an iterator over arrays, hashes, strings and ranges.
+// Arrays are iterated over a snapshot, so appending inside the loop
+// doesn't extend it.
+func NewIterator(obj Object) (*Iterator, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		elements := obj.Elements
+		i := 0
+		return &Iterator{next: func() (Object, Object, bool) {
+			if i >= len(elements) {
+				return nil, nil, false
+			}
+			i++
+			return &Number{Value: float64(i - 1)}, elements[i-1], true
+		}}, true
+	case *Hash:
+		pairs := obj.OrderedPairs()
+		i := 0
+		return &Iterator{keysOnly: true, next: func() (Object, Object, bool) {
+			if i >= len(pairs) {
+				return nil, nil, false
+			}
+			i++
+			return pairs[i-1].Key, pairs[i-1].Value, true
+		}}, true
+	case *String:
+		runes := []rune(obj.Value)
+		i := 0
+		return &Iterator{next: func() (Object, Object, bool) {
+			if i >= len(runes) {
+				return nil, nil, false
+			}
+			i++
+			return &Number{Value: float64(i - 1)}, &String{Value: string(runes[i-1])}, true
+		}}, true
+	case *Range:
+		n := obj.Len()
+		i := 0
+		return &Iterator{next: func() (Object, Object, bool) {
+			if i >= n {
+				return nil, nil, false
+			}
+			i++
+			return &Number{Value: float64(i - 1)}, &Number{Value: obj.At(i - 1)}, true
+		}}, true
+	default:
+		return nil, false
+	}
+}
+
+var hashKeyOrder = map[ObjectType]int{BOOL: 0, NUMBER: 1, STRING: 2}
+
+// OrderedPairs returns the pairs sorted by key, so iteration order is the
+// same on every run: booleans first, then numbers, then strings.
+func (h *Hash) OrderedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	for _, pair := range h.Pairs {
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		a, b := pairs[i].Key, pairs[j].Key
+		if a.Type() != b.Type() {
+			return hashKeyOrder[a.Type()] < hashKeyOrder[b.Type()]
+		}
+		switch a := a.(type) {
+		case *Number:
+			return a.Value < b.(*Number).Value
+		case *Bool:
+			return !a.Value && b.(*Bool).Value
+		default:
+			return a.Inspect() < b.Inspect()
+		}
+	})
+	return pairs
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/pecet3/hmbk-script/ast"
 	"github.com/pecet3/hmbk-script/code"
+	"github.com/pecet3/hmbk-script/token"
 )
 
 type ObjectType string
@@ -30,10 +31,19 @@ const (
 	MODULE            = "MODULE"
 	BULTIN_OBJECT     = "BUILTIN_OBJECT"
 	COMPILED_FUNCTION = "COMPILED_FUNCTION"
+	CLOSURE           = "CLOSURE"
+	RANGE             = "RANGE"
+	ITERATOR          = "ITERATOR"
+	BREAK             = "BREAK"
+	CONTINUE          = "CONTINUE"
 )
 
 type CompiledFunction struct {
-	Instructions code.Instructions
+	Instructions  code.Instructions
+	Positions     code.Positions // of Instructions
+	NumLocals     int
+	NumParameters int
+	Name          string
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION }
@@ -41,6 +51,18 @@ func (cf *CompiledFunction) Inspect() string {
 	return fmt.Sprintf("CompiledFunction[%p]", cf)
 }
 
+// Closure is a compiled function together with the free variables it
+// captured when it was created.
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() ObjectType { return CLOSURE }
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
+
 type BuiltinObject struct {
 	Value interface{}
 }
@@ -99,21 +121,111 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// Break and Continue are signals that unwind the evaluation of a loop body
+// up to the enclosing loop, like ReturnValue does for function bodies.
+type Break struct{}
+
+func (b *Break) Type() ObjectType { return BREAK }
+func (b *Break) Inspect() string  { return "break" }
+
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType { return CONTINUE }
+func (c *Continue) Inspect() string  { return "continue" }
+
+// Error kinds. Errors raised by the interpreter and builtins are runtime
+// errors, `throw "message"` raises a plain error, and error(message, kind)
+// can pick any kind.
+const (
+	RuntimeErrorKind = "runtime"
+	ThrownErrorKind  = "error"
+)
+
+// Error is an error value scripts can hold: returned by builtins such as
+// http.get_json, or bound by `catch (e)`.
 type Error struct {
 	Message string
+	Kind    string
+	Pos     token.Position
+	Trace   []Frame
 }
 
 func (e *Error) Type() ObjectType { return ERROR }
 func (e *Error) Inspect() string  { return "" + e.Message }
 
+// Field returns the members scripts read as e.message, e.kind, e.file,
+// e.line and e.column.
+func (e *Error) Field(name string) (Object, bool) {
+	switch name {
+	case "message":
+		return &String{Value: e.Message}, true
+	case "kind":
+		return &String{Value: e.Kind}, true
+	case "file":
+		return &String{Value: e.Pos.File}, true
+	case "line":
+		return &Number{Value: float64(e.Pos.Line)}, true
+	case "column":
+		return &Number{Value: float64(e.Pos.Column)}, true
+	}
+	return nil, false
+}
+
+// GlobalError aborts evaluation until a try statement catches it.
 type GlobalError struct {
 	Message string
+	Kind    string
+	Pos     token.Position
+	Trace   []Frame
+}
+
+// Frame is one function call a GlobalError propagated through.
+type Frame struct {
+	Function string         // "helper", "module.helper" or "<anonymous>"
+	CallPos  token.Position // where the function was called
 }
 
+// AsError turns a raised error into the value bound by `catch`. The trace
+// travels with it, so rethrowing continues the same traceback.
+func (e *GlobalError) AsError() *Error {
+	kind := e.Kind
+	if kind == "" {
+		kind = RuntimeErrorKind
+	}
+	return &Error{Message: e.Message, Kind: kind, Pos: e.Pos, Trace: e.Trace}
+}
+
+// Traceback renders the error followed by one line per call, innermost
+// first, each with the position reached inside that function.
+func (e *GlobalError) Traceback() string {
+	var out bytes.Buffer
+	out.WriteString(e.Inspect())
+	if len(e.Trace) == 0 {
+		return out.String()
+	}
+	pos := e.Pos
+	for _, frame := range e.Trace {
+		fmt.Fprintf(&out, "\n    at %s (%s)", frame.Function, pos)
+		pos = frame.CallPos
+	}
+	fmt.Fprintf(&out, "\n    at <main> (%s)", pos)
+	return out.String()
+}
+
+// Error makes a GlobalError usable as a Go error, for embedders running
+// scripts.
+func (e *GlobalError) Error() string { return e.Inspect() }
+
 func (e *GlobalError) Type() ObjectType { return GLOBAL_ERROR }
-func (e *GlobalError) Inspect() string  { return "GLOBAL ERROR: " + e.Message }
+func (e *GlobalError) Inspect() string {
+	if e.Pos.IsValid() {
+		return "GLOBAL ERROR: " + e.Pos.String() + ": " + e.Message
+	}
+	return "GLOBAL ERROR: " + e.Message
+}
 
 type Function struct {
+	Name       string // the variable it was first bound to, if any
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
@@ -144,9 +256,11 @@ func (f *Module) Type() ObjectType { return MODULE }
 func (f *Module) Inspect() string {
 	var out bytes.Buffer
 	params := []string{}
+	f.Env.mu.RLock()
 	for _, p := range f.Env.consts {
 		params = append(params, p.Inspect())
 	}
+	f.Env.mu.RUnlock()
 	out.WriteString("module ")
 	out.WriteString("{")
 	out.WriteString(strings.Join(params, ", "))
@@ -241,3 +355,32 @@ func (h *Hash) Inspect() string {
 type Hashable interface {
 	HashKey() HashKey
 }
+
+// SetIndex stores value in an array or hash in place, so every variable
+// referring to the collection sees the change. Both engines use it for
+// `a[i] = v` and `h.k = v`.
+func SetIndex(left, index, value Object) error {
+	switch left := left.(type) {
+	case *Array:
+		num, ok := index.(*Number)
+		if !ok {
+			return fmt.Errorf("array index must be a Number, got %s", index.Type())
+		}
+		i := num.Int()
+		if i < 0 || i >= int64(len(left.Elements)) {
+			return fmt.Errorf("index %d out of range for array of length %d", i, len(left.Elements))
+		}
+		left.Elements[i] = value
+	case *Hash:
+		key, ok := index.(Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = HashPair{Key: index, Value: value}
+	case *Module:
+		return fmt.Errorf("cannot assign to symbol %s of module %s", index.Inspect(), left.Name)
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+	return nil
+}
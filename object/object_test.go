@@ -1,6 +1,9 @@
 package object
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -17,3 +20,33 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("strings with different content have same hash keys")
 	}
 }
+
+func TestRangeLen(t *testing.T) {
+	tests := []struct {
+		r        *Range
+		expected int
+	}{
+		{&Range{Start: 0, End: 5, Step: 1}, 5},
+		{&Range{Start: 5, End: 0, Step: -2}, 3},
+		{&Range{Start: 0, End: 1, Step: 0.1}, 10},
+		{&Range{Start: 5, End: 0, Step: 1}, 0},
+		{&Range{Start: 0, End: 1e300, Step: 1}, math.MaxInt},
+		{&Range{Start: 0, End: math.Inf(1), Step: 1}, math.MaxInt},
+		{&Range{Start: math.Inf(1), End: math.Inf(1), Step: 1}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Len(); got != tt.expected {
+			t.Errorf("%s has wrong length. expected=%d, got=%d",
+				tt.r.Inspect(), tt.expected, got)
+		}
+	}
+
+	it, _ := NewIterator(&Range{Start: 0, End: 1, Step: 0.1})
+	n := 0
+	for _, ok := it.NextValue(); ok; _, ok = it.NextValue() {
+		n++
+	}
+	if n != 10 {
+		t.Errorf("range(0, 1, 0.1) visited %d elements, want 10", n)
+	}
+}
@@ -13,24 +13,33 @@ import (
 // precedences
 const (
 	LOWEST      = iota
+	OR          // ||
+	AND         // &&
 	EQUALS      // ==
 	LESSGREATER // > or <
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or !X
+	POWER       // **, binds tighter than a prefix: -2 ** 2 == -(2 ** 2)
 	CALL        // myFunction(X)
 	INDEX
 )
 
 var precedences = map[token.TokenType]int{
+	token.OR:       OR,
+	token.AND:      AND,
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
 	token.LT:       LESSGREATER,
 	token.GT:       LESSGREATER,
+	token.LT_EQ:    LESSGREATER,
+	token.GT_EQ:    LESSGREATER,
 	token.PLUS:     SUM,
 	token.MINUS:    SUM,
 	token.SLASH:    PRODUCT,
 	token.ASTERISK: PRODUCT,
+	token.PERCENT:  PRODUCT,
+	token.POWER:    POWER,
 	token.LPAREN:   CALL,
 	token.LBRACKET: INDEX,
 	token.DOT:      INDEX,
@@ -47,6 +56,13 @@ type Parser struct {
 	peekToken token.Token
 	errors    []string
 
+	// doc comments read directly before curToken and peekToken
+	curDoc  string
+	peekDoc string
+
+	// number of loops enclosing the current statement within its function
+	loopDepth int
+
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
 }
@@ -73,6 +89,7 @@ func New(l *lexer.Lexer) *Parser {
 
 	p.registerPrefixParseFn(token.BANG, p.parsePrefixExpression)
 	p.registerPrefixParseFn(token.STRING, p.parseStringLiteral)
+	p.registerPrefixParseFn(token.TEMPLATE, p.parseTemplateLiteral)
 	p.registerPrefixParseFn(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefixParseFn(token.TRUE, p.parseBoolean)
 	p.registerPrefixParseFn(token.FALSE, p.parseBoolean)
@@ -90,6 +107,12 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfixParseFn(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfixParseFn(token.LT, p.parseInfixExpression)
 	p.registerInfixParseFn(token.GT, p.parseInfixExpression)
+	p.registerInfixParseFn(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfixParseFn(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfixParseFn(token.PERCENT, p.parseInfixExpression)
+	p.registerInfixParseFn(token.POWER, p.parseInfixExpression)
+	p.registerInfixParseFn(token.AND, p.parseInfixExpression)
+	p.registerInfixParseFn(token.OR, p.parseInfixExpression)
 	p.registerInfixParseFn(token.LPAREN, p.parseCallExpression)
 	p.registerInfixParseFn(token.LBRACKET, p.parseIndexExpression)
 	p.registerInfixParseFn(token.DOT, p.parseModuleExpression)
@@ -117,7 +140,16 @@ func (p *Parser) curPrecedence() int {
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
+	p.curDoc = p.peekDoc
+	p.peekDoc = ""
 	p.peekToken = p.l.NextToken()
+	for p.peekToken.Type == token.DOC_COMMENT {
+		if p.peekDoc != "" {
+			p.peekDoc += "\n"
+		}
+		p.peekDoc += p.peekToken.Literal
+		p.peekToken = p.l.NextToken()
+	}
 }
 
 func (p *Parser) expectPeek(t token.TokenType) bool {
@@ -137,16 +169,25 @@ func (p *Parser) peekTokenIs(t token.TokenType) bool {
 }
 
 func (p *Parser) Errors() []string {
-	return p.errors
+	errors := append([]string{}, p.l.Errors()...)
+	return append(errors, p.errors...)
+}
+
+// addError records a parser error prefixed with the source position it refers to.
+func (p *Parser) addError(pos token.Position, format string, a ...interface{}) {
+	p.errors = append(p.errors, pos.String()+": "+fmt.Sprintf(format, a...))
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	p.errors = append(p.errors, fmt.Sprintf(`EXPECETED: %s GOT: %s`, t.String(), p.peekToken.Type.String()))
+	p.addError(p.peekToken.Pos, `EXPECETED: %s GOT: %s`, t.String(), p.peekToken.Type.String())
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	if t == token.ILLEGAL {
+		p.addError(p.curToken.Pos, "illegal character %q", p.curToken.Literal)
+		return
+	}
+	p.addError(p.curToken.Pos, "no prefix parse function for %s found", t)
 }
 
 // PARSER functions
@@ -173,8 +214,9 @@ func (p *Parser) ParseProgram() *ast.Program {
 }
 
 func (p *Parser) ParseModule() *ast.Module {
-	module := &ast.Module{}
+	module := &ast.Module{Token: p.curToken}
 	module.Statements = []ast.Statement{}
+	module.SetDoc(p.curDoc)
 
 	if !p.expectPeek(token.IDENT) {
 		return nil
@@ -202,34 +244,35 @@ func (p *Parser) ParseImportModule(mod *ast.Module) *ast.Module {
 	p.nextToken()
 
 	if !p.curTokenIs(token.IMPORT) {
-		p.errors = append(p.errors, "expected 'import' after module name")
+		p.addError(p.curToken.Pos, "expected 'import' after module name")
 		return nil
 	}
 
 	if !p.expectPeek(token.LBRACE) {
-		p.errors = append(p.errors, "expected '{' after import")
+		p.addError(p.curToken.Pos, "expected '{' after import")
 		return nil
 	}
 
 	if !p.expectPeek(token.STRING) {
-		p.errors = append(p.errors, "expected string literal after '{'")
+		p.addError(p.curToken.Pos, "expected string literal after '{'")
 		return nil
 	}
 	filePath := p.curToken.Literal
 	mod.Path = filePath
 	if !p.expectPeek(token.RBRACE) {
-		p.errors = append(p.errors, "expected '}' after import path")
+		p.addError(p.curToken.Pos, "expected '}' after import path")
 		return nil
 	}
 	inp, err := os.ReadFile(filePath)
 	if err != nil {
-		p.errors = append(p.errors, fmt.Sprintf("cannot read file %s: %v", filePath, err))
+		p.addError(p.curToken.Pos, "cannot read file %s: %v", filePath, err)
 		return nil
 	}
 
-	newLexer := lexer.New(string(inp))
+	newLexer := lexer.NewWithFile(string(inp), filePath)
 	newParser := New(newLexer)
 	imported := newParser.ParseProgram()
+	p.errors = append(p.errors, newParser.Errors()...)
 
 	if imported != nil {
 		mod.Statements = append(mod.Statements, imported.Statements...)
@@ -238,28 +281,199 @@ func (p *Parser) ParseImportModule(mod *ast.Module) *ast.Module {
 }
 
 func (p *Parser) parseStatement() ast.Statement {
+	doc := p.curDoc
+	stmt := p.parseBareStatement()
+	if d, ok := stmt.(ast.Documented); ok && doc != "" {
+		d.SetDoc(doc)
+	}
+	return stmt
+}
+
+func (p *Parser) parseBareStatement() ast.Statement {
 	switch p.curToken.Type {
 	case token.MUT:
-		stmt := p.parseMutStatement()
-		return stmt
+		if stmt := p.parseMutStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
 	case token.CONST:
-		stmt := p.parseConstStatement(false)
-		return stmt
+		if stmt := p.parseConstStatement(false); stmt != nil {
+			return stmt
+		}
+		return nil
 	case token.EXPORT:
 		p.nextToken()
 		if p.curToken.Type != token.CONST {
-			p.errors = append(p.errors, "expected 'const' after 'export'")
+			p.addError(p.curToken.Pos, "expected 'const' after 'export'")
 			return nil
 		}
-		stmt := p.parseConstStatement(true)
-		return stmt
+		if stmt := p.parseConstStatement(true); stmt != nil {
+			return stmt
+		}
+		return nil
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.WHILE:
+		if stmt := p.parseWhileStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
+	case token.FOR:
+		if stmt := p.parseForInStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
+	case token.BREAK, token.CONTINUE:
+		return p.parseLoopControlStatement()
+	case token.TRY:
+		if stmt := p.parseTryStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
+	case token.THROW:
+		if stmt := p.parseThrowStatement(); stmt != nil {
+			return stmt
+		}
+		return nil
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
+func (p *Parser) parseWhileStatement() *ast.WhileStatement {
+	stmt := &ast.WhileStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	p.nextToken()
+	stmt.Condition = p.parseExpression(LOWEST)
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseLoopBody()
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseForInStatement() *ast.ForInStatement {
+	stmt := &ast.ForInStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	stmt.Value = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	if p.peekTokenIs(token.COMMA) {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stmt.Key = stmt.Value
+		stmt.Value = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	}
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+	p.nextToken()
+	stmt.Iterable = p.parseExpression(LOWEST)
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseLoopBody()
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseLoopBody() *ast.BlockStatement {
+	p.loopDepth++
+	defer func() { p.loopDepth-- }()
+	return p.parseBlockStatement()
+}
+
+func (p *Parser) parseTryStatement() *ast.TryStatement {
+	stmt := &ast.TryStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Block = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+		if p.peekTokenIs(token.LPAREN) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			stmt.Param = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if !p.expectPeek(token.RPAREN) {
+				return nil
+			}
+		}
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		stmt.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		stmt.Finally = p.parseBlockStatement()
+	}
+
+	if stmt.Catch == nil && stmt.Finally == nil {
+		p.addError(stmt.Token.Pos, "try without catch or finally")
+		return nil
+	}
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseLoopControlStatement() ast.Statement {
+	tok := p.curToken
+	if p.loopDepth == 0 {
+		p.addError(tok.Pos, "%s outside of a loop", tok.Literal)
+	}
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	if tok.Type == token.BREAK {
+		return &ast.BreakStatement{Token: tok}
+	}
+	return &ast.ContinueStatement{Token: tok}
+}
+
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt := &ast.ReturnStatement{Token: p.curToken}
 	p.nextToken()
@@ -280,6 +494,9 @@ func (p *Parser) parseMutStatement() *ast.MutStatement {
 	}
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -297,6 +514,9 @@ func (p *Parser) parseConstStatement(isExport bool) *ast.ConstStatement {
 	}
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -324,13 +544,32 @@ func (p *Parser) parseAssignmentStatement(name ast.Expression) ast.Statement {
 	return stmt
 }
 
+func (p *Parser) parseIndexAssignmentStatement(target ast.Expression) ast.Statement {
+	p.nextToken()
+	stmt := &ast.IndexAssignmentStatement{Token: p.curToken, Target: target}
+
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseExpressionStatement() ast.Statement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 
 	stmt.Expression = p.parseExpression(LOWEST)
 
-	if ident, ok := stmt.Expression.(*ast.Identifier); ok && p.peekTokenIs(token.ASSIGN) {
-		return p.parseAssignmentStatement(ident)
+	if p.peekTokenIs(token.ASSIGN) {
+		switch target := stmt.Expression.(type) {
+		case *ast.Identifier:
+			return p.parseAssignmentStatement(target)
+		case *ast.IndexExpression, *ast.ModuleExpression:
+			return p.parseIndexAssignmentStatement(target)
+		}
 	}
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
@@ -364,6 +603,35 @@ func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+func (p *Parser) parseTemplateLiteral() ast.Expression {
+	tmpl := &ast.TemplateLiteral{Token: p.curToken}
+
+	for _, part := range lexer.SplitTemplate(p.curToken) {
+		if !part.IsExpr {
+			tok := token.Token{Type: token.STRING, Literal: part.Text, Pos: part.Pos}
+			tmpl.Parts = append(tmpl.Parts, &ast.StringLiteral{Token: tok, Value: part.Text})
+			continue
+		}
+
+		sub := New(lexer.NewAt(part.Text, part.Pos))
+		if sub.curTokenIs(token.EOF) {
+			p.addError(part.Pos, "empty ${} in string")
+			return nil
+		}
+		exp := sub.parseExpression(LOWEST)
+		if !sub.peekTokenIs(token.EOF) {
+			sub.addError(sub.peekToken.Pos, "unexpected %s in ${} expression", sub.peekToken.Type)
+		}
+		if len(sub.Errors()) > 0 {
+			// lexer errors inside the literal were already reported by our own lexer
+			p.errors = append(p.errors, sub.errors...)
+			return nil
+		}
+		tmpl.Parts = append(tmpl.Parts, exp)
+	}
+	return tmpl
+}
+
 func (p *Parser) parseIdentifier() ast.Expression {
 	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 }
@@ -374,7 +642,7 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 
 	if err != nil {
-		p.errors = append(p.errors, fmt.Sprintf(`cannot parse %q as integer`, p.curToken.Literal))
+		p.addError(p.curToken.Pos, `cannot parse %q as integer`, p.curToken.Literal)
 		return nil
 	}
 
@@ -389,7 +657,7 @@ func (p *Parser) parseFloatLiteral() ast.Expression {
 	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
 
 	if err != nil {
-		p.errors = append(p.errors, fmt.Sprintf(`cannot parse %q as float`, p.curToken.Literal))
+		p.addError(p.curToken.Pos, `cannot parse %q as float`, p.curToken.Literal)
 		return nil
 	}
 
@@ -415,6 +683,10 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 		Left:     left,
 	}
 	precedence := p.curPrecedence()
+	// ** is right-associative: 2 ** 3 ** 2 == 2 ** (3 ** 2)
+	if p.curTokenIs(token.POWER) {
+		precedence--
+	}
 	p.nextToken()
 	exp.Right = p.parseExpression(precedence)
 
@@ -495,7 +767,11 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
+	// break and continue cannot cross a function boundary
+	loopDepth := p.loopDepth
+	p.loopDepth = 0
 	lit.Body = p.parseBlockStatement()
+	p.loopDepth = loopDepth
 	return lit
 }
 
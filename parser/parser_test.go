@@ -99,9 +99,9 @@ func TestMutStatements(t *testing.T) {
 		expectedIdentifier string
 		expectedValue      interface{}
 	}{
-		{"let x = 5;", "x", 5},
-		{"let y = true;", "y", true},
-		{"let foobar = y;", "foobar", "y"},
+		{"mut x = 5;", "x", 5},
+		{"mut y = true;", "y", true},
+		{"mut foobar = y;", "foobar", "y"},
 	}
 
 	for _, tt := range tests {
@@ -285,6 +285,12 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"5 < 5;", 5, "<", 5},
 		{"5 == 5;", 5, "==", 5},
 		{"5 != 5;", 5, "!=", 5},
+		{"5 <= 5;", 5, "<=", 5},
+		{"5 >= 5;", 5, ">=", 5},
+		{"5 % 5;", 5, "%", 5},
+		{"5 ** 5;", 5, "**", 5},
+		{"true && false;", true, "&&", false},
+		{"true || false;", true, "||", false},
 		{"foobar + barfoo;", "foobar", "+", "barfoo"},
 		{"foobar - barfoo;", "foobar", "-", "barfoo"},
 		{"foobar * barfoo;", "foobar", "*", "barfoo"},
@@ -427,6 +433,42 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a + b + c * d / f + g)",
 			"add((((a + b) + ((c * d) / f)) + g))",
 		},
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a == b && c != d || e",
+			"(((a == b) && (c != d)) || e)",
+		},
+		{
+			"a <= b == c >= d",
+			"((a <= b) == (c >= d))",
+		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"2 ** 3 ** 2",
+			"(2 ** (3 ** 2))",
+		},
+		{
+			"a * b ** c",
+			"(a * (b ** c))",
+		},
+		{
+			"-a ** 2",
+			"(-(a ** 2))",
+		},
+		{
+			"2 ** -a",
+			"(2 ** (-a))",
+		},
+		{
+			"!a ** 2",
+			"(!(a ** 2))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -757,8 +799,8 @@ func TestCallExpressionParameterParsing(t *testing.T) {
 }
 
 func testMutStatement(t *testing.T, s ast.Statement, name string) bool {
-	if s.TokenLiteral() != "let" {
-		t.Errorf("s.TokenLiteral not 'let'. got=%q", s.TokenLiteral())
+	if s.TokenLiteral() != "mut" {
+		t.Errorf("s.TokenLiteral not 'mut'. got=%q", s.TokenLiteral())
 		return false
 	}
 
@@ -1038,3 +1080,262 @@ func TestParsingHashLiteralsWithExpressions(t *testing.T) {
 		testFunc(value)
 	}
 }
+
+func TestParserErrorPositions(t *testing.T) {
+	input := `mut a = 1;
+mut b = (a + 2;
+`
+	l := lexer.NewWithFile(input, "test.hmbk")
+	p := New(l)
+	p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) == 0 {
+		t.Fatalf("expected parser errors, got none")
+	}
+	expected := "test.hmbk:2:15: EXPECETED: ) GOT: ;"
+	if errors[0] != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, errors[0])
+	}
+}
+
+func TestDocComments(t *testing.T) {
+	input := `
+/// Adds two numbers.
+/// Returns their sum.
+const add = fn(x, y) {
+    /// inner value
+    mut sum = x + y;
+    // plain comment, not documentation
+    return sum;
+};
+
+add(1, 2); // trailing comment
+
+/// math helpers
+module math {
+}
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 3 {
+		t.Fatalf("program.Statements does not contain 3 statements. got=%d",
+			len(program.Statements))
+	}
+
+	constStmt, ok := program.Statements[0].(*ast.ConstStatement)
+	if !ok {
+		t.Fatalf("statement is not *ast.ConstStatement. got=%T", program.Statements[0])
+	}
+	if constStmt.Doc != "Adds two numbers.\nReturns their sum." {
+		t.Errorf("wrong doc on const. got=%q", constStmt.Doc)
+	}
+
+	fn := constStmt.Value.(*ast.FunctionLiteral)
+	inner := fn.Body.Statements[0].(*ast.MutStatement)
+	if inner.Doc != "inner value" {
+		t.Errorf("wrong doc on inner mut. got=%q", inner.Doc)
+	}
+	ret := fn.Body.Statements[1].(*ast.ReturnStatement)
+	if ret.Doc != "" {
+		t.Errorf("return statement should have no doc. got=%q", ret.Doc)
+	}
+
+	call := program.Statements[1].(*ast.ExpressionStatement)
+	if call.Doc != "" {
+		t.Errorf("call statement should have no doc. got=%q", call.Doc)
+	}
+
+	mod := program.Statements[2].(*ast.Module)
+	if mod.Documentation() != "math helpers" {
+		t.Errorf("wrong doc on module. got=%q", mod.Documentation())
+	}
+}
+
+func TestParsingTemplateLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		parts    int
+	}{
+		{`"Hello ${name}!"`, `"Hello ${name}!"`, 3},
+		{`"${a + b * 2}"`, `"${(a + (b * 2))}"`, 1},
+		{`"Hello ${user["name"]}, you are ${age}"`, `"Hello ${(user[name])}, you are ${age}"`, 4},
+		{`"nested ${"inner ${x}"}"`, `"nested ${"inner ${x}"}"`, 2},
+		{`"cost: \${price}"`, `cost: ${price}`, 0},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		if stmt.String() != tt.expected {
+			t.Errorf("wrong string. expected=%q, got=%q", tt.expected, stmt.String())
+		}
+		if tt.parts == 0 {
+			if _, ok := stmt.Expression.(*ast.StringLiteral); !ok {
+				t.Errorf("exp not *ast.StringLiteral. got=%T", stmt.Expression)
+			}
+			continue
+		}
+		tmpl, ok := stmt.Expression.(*ast.TemplateLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.TemplateLiteral. got=%T", stmt.Expression)
+		}
+		if len(tmpl.Parts) != tt.parts {
+			t.Errorf("wrong number of parts. expected=%d, got=%d", tt.parts, len(tmpl.Parts))
+		}
+	}
+}
+
+func TestTemplateLiteralErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`mut a = "x ${}";`, "1:14: empty ${} in string"},
+		{`mut a = "x ${b c}";`, "1:16: unexpected IDENTIFIER in ${} expression"},
+		{"mut a = \"x ${b\n", "1:13: unterminated ${ in string"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error. expected=%q, got=%q", tt.expected, errors[0])
+		}
+	}
+}
+
+func TestLoopStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"while (x < 10) { print(x); }", "while (x < 10) print(x)"},
+		{"for (x in xs) { print(x); }", "for (x in xs) print(x)"},
+		{"for (k, v in h) { break; }", "for (k, v in h) break;"},
+		{"while (true) { if (x) { continue; } }", "while true ifx continue;"},
+		{"while (x) { f(); };", "while x f()"},
+		{"for (x in xs) { 1 };", "for (x in xs) 1"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		if len(program.Statements) != 1 {
+			t.Fatalf("program has wrong number of statements. got=%d", len(program.Statements))
+		}
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("for (k, v in h) { v; }"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	stmt, ok := program.Statements[0].(*ast.ForInStatement)
+	if !ok {
+		t.Fatalf("statement is not *ast.ForInStatement. got=%T", program.Statements[0])
+	}
+	if stmt.Key == nil || stmt.Key.Value != "k" || stmt.Value.Value != "v" {
+		t.Errorf("wrong loop variables. got key=%v value=%v", stmt.Key, stmt.Value)
+	}
+	testIdentifier(t, stmt.Iterable, "h")
+}
+
+func TestLoopControlErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break;", "1:1: break outside of a loop"},
+		{"if (true) { continue; }", "1:13: continue outside of a loop"},
+		{"while (true) { mut f = fn() { break; }; }", "1:31: break outside of a loop"},
+		{"for (x xs) {}", "1:8: EXPECETED: in GOT: IDENTIFIER"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error. expected=%q, got=%q", tt.expected, errors[0])
+		}
+	}
+}
+
+func TestIndexAssignmentStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"arr[0] = 1;", "(arr[0]) = 1;"},
+		{`h["a"]["b"] = x + 1;`, "((h[a])[b]) = (x + 1);"},
+		{"h.k = true", "(h.k) = true;"},
+		{"h.a[1] = 2", "((h.a)[1]) = 2;"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		if len(program.Statements) != 1 {
+			t.Fatalf("program has wrong number of statements. got=%d", len(program.Statements))
+		}
+		if _, ok := program.Statements[0].(*ast.IndexAssignmentStatement); !ok {
+			t.Fatalf("statement is not *ast.IndexAssignmentStatement. got=%T", program.Statements[0])
+		}
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestTryStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { f(); } catch (e) { print(e); }", "try f() catch (e) print(e)"},
+		{"try { f(); } finally { g(); }", "try f() finally g()"},
+		{"try { f(); } catch { g(); } finally { h(); }", "try f() catch g() finally h()"},
+		{"try { 1 } catch (e) { 2 };", "try 1 catch (e) 2"},
+		{`throw "boom";`, `throw boom;`},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+		if len(program.Statements) != 1 {
+			t.Fatalf("program has wrong number of statements. got=%d", len(program.Statements))
+		}
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("try { f(); }"))
+	p.ParseProgram()
+	errors := p.Errors()
+	if len(errors) == 0 || errors[0] != "1:1: try without catch or finally" {
+		t.Errorf("expected try error. got=%v", errors)
+	}
+}
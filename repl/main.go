@@ -2,15 +2,11 @@ package repl
 
 import (
 	"bufio"
-	"fmt"
 	"io"
 
-	"github.com/pecet3/hmbk-script/compiler"
-	"github.com/pecet3/hmbk-script/evaluation"
 	"github.com/pecet3/hmbk-script/lexer"
-	"github.com/pecet3/hmbk-script/object"
 	"github.com/pecet3/hmbk-script/parser"
-	"github.com/pecet3/hmbk-script/vm"
+	"github.com/pecet3/hmbk-script/runner"
 )
 
 const PROMPT = brightBlack + ">> " + reset
@@ -43,50 +39,11 @@ const INFO = white + italic + brightCyan +
 	bold + magenta + `REPL
 ` + reset
 
-func StartEval(in io.Reader, out io.Writer) {
+// Start reads one line at a time from in, runs it with r and writes its
+// value or error to out. Definitions carry over from line to line.
+func Start(in io.Reader, out io.Writer, r runner.Runner, options runner.Options) {
 	io.WriteString(out, LOGO+"\n"+INFO+LINE+"\n")
 	scanner := bufio.NewScanner(in)
-	env := object.NewEnvironment()
-
-	for {
-		io.WriteString(out, PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
-			return
-		}
-		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
-
-		program := p.ParseProgram()
-		if len(p.Errors()) > 0 {
-			printParserErr(out, p.Errors())
-			continue
-		}
-
-		evaluated := evaluation.Eval(program, env)
-
-		if evaluated != nil {
-			_, isErr := evaluated.(*object.Error)
-			if isErr {
-				io.WriteString(out, red)
-			}
-			io.WriteString(out, bold+evaluated.Inspect()+reset)
-			io.WriteString(out, "\n")
-		}
-		io.WriteString(out, reset)
-		io.WriteString(out, LINE+"\n")
-
-	}
-}
-func Start(in io.Reader, out io.Writer) {
-	io.WriteString(out, LOGO+"\n"+INFO+LINE+"\n")
-
-	scanner := bufio.NewScanner(in)
-
-	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalSize)
-	symbolTable := compiler.NewSymbolTable()
 
 	for {
 		io.WriteString(out, PROMPT)
@@ -102,25 +59,15 @@ func Start(in io.Reader, out io.Writer) {
 			printParserErr(out, p.Errors())
 			continue
 		}
-		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
-		if err != nil {
-			fmt.Fprintf(out, "Compilation failed:\n %s\n", err)
-			continue
-		}
-		code := comp.Bytecode()
-		constants = code.Constants
-		machine := vm.NewWithGlobalsStore(code, globals)
-		err = machine.Run()
+		result, err := r.Run(program, options)
 		if err != nil {
-			fmt.Fprintf(out, "Executing bytecode failed:\n %s\n", err)
+			io.WriteString(out, red+err.Error()+reset+"\n")
 			continue
 		}
-		stackTop := machine.LastPoppedStackElem()
-		if stackTop == nil {
+		if result == nil {
 			continue
 		}
-		io.WriteString(out, stackTop.Inspect())
+		io.WriteString(out, bold+result.Inspect()+reset)
 		io.WriteString(out, "\n")
 	}
 }
@@ -0,0 +1,144 @@
+// Package runner runs parsed programs with either execution engine, the
+// tree-walking evaluator or the bytecode compiler with its VM, behind one
+// interface, so the CLI, the REPL and embedders switch engines the same
+// way.
+package runner
+
+import (
+	"fmt"
+
+	"github.com/pecet3/hmbk-script/ast"
+	"github.com/pecet3/hmbk-script/compiler"
+	"github.com/pecet3/hmbk-script/evaluation"
+	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/vm"
+)
+
+// Engine names an execution engine.
+type Engine string
+
+const (
+	Eval Engine = "eval"
+	VM   Engine = "vm"
+)
+
+// Engines lists the engines New accepts.
+var Engines = []Engine{Eval, VM}
+
+// Options configure one run.
+type Options struct {
+	// Optimize runs the bytecode optimizer and then replaces common
+	// instruction sequences by superinstructions. The evaluator ignores it.
+	Optimize bool
+	// Observe, if not nil, is called with the VM before it runs the
+	// program, and the function it returns once the VM is done, e.g. to
+	// report the VM's memory stats. The evaluator ignores it.
+	Observe func(machine *vm.VM) (done func())
+}
+
+// Runner runs programs. Each runner keeps its globals between runs, so a
+// program can use what earlier programs defined, as in the REPL.
+//
+// Run returns the value of the program's last statement if that is an
+// expression, and nil otherwise. A script error is an *object.GlobalError,
+// which carries a traceback, with either engine.
+type Runner interface {
+	Run(program *ast.Program, options Options) (object.Object, error)
+}
+
+// New returns a runner for engine.
+func New(engine Engine) (Runner, error) {
+	switch engine {
+	case Eval:
+		return &evalRunner{env: object.NewEnvironment()}, nil
+	case VM:
+		symbolTable := compiler.NewSymbolTable()
+		for i, v := range object.Builtins {
+			symbolTable.DefineBuiltin(i, v.Name)
+		}
+		return &vmRunner{
+			symbolTable: symbolTable,
+			globals:     make([]object.Object, vm.GlobalSize),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown engine %q, want one of %v", engine, Engines)
+}
+
+type evalRunner struct {
+	env *object.Environment
+}
+
+func (r *evalRunner) Run(program *ast.Program, options Options) (object.Object, error) {
+	result := evaluation.Eval(program, r.env)
+	if ge, ok := result.(*object.GlobalError); ok {
+		return nil, ge
+	}
+	if !endsWithExpression(program) {
+		return nil, nil
+	}
+	return result, nil
+}
+
+type vmRunner struct {
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+}
+
+func (r *vmRunner) Run(program *ast.Program, options Options) (object.Object, error) {
+	comp := compiler.NewWithState(r.symbolTable, r.constants)
+	if err := comp.Compile(program); err != nil {
+		return nil, fmt.Errorf("compilation error: %w", err)
+	}
+	bytecode := comp.Bytecode()
+	if options.Optimize {
+		// functions defined by earlier programs refer to the constants
+		// they were compiled with, so those keep their place
+		optimized, err := compiler.OptimizeFrom(bytecode, len(r.constants))
+		if err == nil {
+			optimized, err = compiler.Superinstructions(optimized)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("optimization error: %w", err)
+		}
+		bytecode = optimized
+	}
+	r.constants = bytecode.Constants
+
+	machine := vm.NewWithGlobalsStore(bytecode, r.globals)
+	err := run(machine, options)
+	r.globals = machine.Globals()
+	if err != nil {
+		return nil, err
+	}
+	if !endsWithExpression(program) {
+		return nil, nil
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// RunBytecode runs bytecode compiled earlier, e.g. loaded from a file
+// written by `hmbk build`, on the VM. Options.Optimize is ignored, since
+// build already optimized it if asked to.
+func RunBytecode(bytecode *compiler.Bytecode, options Options) error {
+	return run(vm.New(bytecode), options)
+}
+
+func run(machine *vm.VM, options Options) error {
+	if options.Observe != nil {
+		done := options.Observe(machine)
+		defer done()
+	}
+	if err := machine.Run(); err != nil {
+		return machine.GlobalError(err)
+	}
+	return nil
+}
+
+func endsWithExpression(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+	_, ok := program.Statements[len(program.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
@@ -0,0 +1,143 @@
+package runner
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pecet3/hmbk-script/ast"
+	"github.com/pecet3/hmbk-script/compiler"
+	"github.com/pecet3/hmbk-script/lexer"
+	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/parser"
+	"github.com/pecet3/hmbk-script/vm"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+func TestRunKeepsGlobals(t *testing.T) {
+	for _, engine := range Engines {
+		for _, optimize := range []bool{false, true} {
+			r, err := New(engine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := Options{Optimize: optimize}
+			steps := []struct {
+				input string
+				want  string // "" for no value
+			}{
+				{`mut x = 20;`, ""},
+				{`const double = fn(n) { n * 2 };`, ""},
+				{`x = double(x) + 2;`, ""},
+				{`x`, "42"},
+				{`"x=" + x`, "x=42"},
+				// the constants of greet stay where it finds them, after
+				// later programs are optimized
+				{`const greet = fn() { "hello" + "!" };`, ""},
+				{`"a"; "b"; 1 + 1`, "2"},
+				{`greet()`, "hello!"},
+			}
+			for _, step := range steps {
+				result, err := r.Run(parse(t, step.input), options)
+				if err != nil {
+					t.Fatalf("%s (optimize %v): %q: %s", engine, optimize, step.input, err)
+				}
+				got := ""
+				if result != nil {
+					got = result.Inspect()
+				}
+				if got != step.want {
+					t.Errorf("%s (optimize %v): %q = %q, want %q", engine, optimize, step.input, got, step.want)
+				}
+			}
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	for _, engine := range Engines {
+		r, err := New(engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Run(parse(t, `1 / 0`), Options{}); err == nil {
+			t.Errorf("%s: no error for division by zero", engine)
+		}
+		// a failed run leaves the runner usable
+		result, err := r.Run(parse(t, `1 + 1`), Options{})
+		if err != nil || result.Inspect() != "2" {
+			t.Errorf("%s: after an error, got %v, %v", engine, result, err)
+		}
+	}
+
+	input := `mut f = fn() {
+  throw "boom";
+};
+mut g = fn() { f() };
+g();`
+	// the VM knows where a call is by its `(`, the evaluator by the callee
+	wants := map[Engine]string{
+		Eval: `GLOBAL ERROR: 2:3: boom
+    at f (2:3)
+    at g (4:16)
+    at <main> (5:1)`,
+		VM: `GLOBAL ERROR: 2:3: boom
+    at f (2:3)
+    at g (4:17)
+    at <main> (5:2)`,
+	}
+	for engine, want := range wants {
+		r, _ := New(engine)
+		_, err := r.Run(parse(t, input), Options{})
+		var ge *object.GlobalError
+		if !errors.As(err, &ge) {
+			t.Errorf("%s: got %v, want a GlobalError", engine, err)
+			continue
+		}
+		if got := ge.Traceback(); got != want {
+			t.Errorf("%s: got traceback\n%s\nwant\n%s", engine, got, want)
+		}
+	}
+}
+
+func TestRunBytecode(t *testing.T) {
+	comp := compiler.New()
+	if err := comp.Compile(parse(t, `mut f = fn() { 1 / 0 }; f();`)); err != nil {
+		t.Fatal(err)
+	}
+	err := RunBytecode(comp.Bytecode(), Options{})
+	var ge *object.GlobalError
+	if !errors.As(err, &ge) || ge.Message != "division by zero" || len(ge.Trace) != 1 {
+		t.Errorf("got %#v, want a GlobalError with a trace through f", err)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	r, _ := New(VM)
+	var machine *vm.VM
+	var calls uint64
+	options := Options{Observe: func(m *vm.VM) func() {
+		machine = m
+		return func() { calls = m.Stats().Calls }
+	}}
+	if _, err := r.Run(parse(t, `mut f = fn() { 1 }; f(); f();`), options); err != nil {
+		t.Fatal(err)
+	}
+	if machine == nil || calls != 2 {
+		t.Errorf("observed VM %v with %d calls, want one with 2", machine, calls)
+	}
+}
+
+func TestUnknownEngine(t *testing.T) {
+	if _, err := New("js"); err == nil {
+		t.Error("no error for an unknown engine")
+	}
+}
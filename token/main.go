@@ -13,6 +13,7 @@ const (
 	INT
 	FLOAT
 	STRING
+	TEMPLATE // string containing ${...} interpolations
 	// Operators
 	ASSIGN
 	PLUS
@@ -20,13 +21,20 @@ const (
 	BANG
 	ASTERISK
 	SLASH
+	PERCENT
+	POWER
 
 	LT
 	GT
+	LT_EQ
+	GT_EQ
 
 	EQ
 	NOT_EQ
 
+	AND
+	OR
+
 	// Delimiters
 	COMMA
 	SEMICOLON
@@ -48,30 +56,76 @@ const (
 	IF
 	ELSE
 	RETURN
+	WHILE
+	FOR
+	IN
+	BREAK
+	CONTINUE
+	TRY
+	CATCH
+	FINALLY
+	THROW
 
 	IMPORT
 	MODULE
 	EXPORT
 
 	DOT
+
+	DOC_COMMENT // /// documentation attached to the next statement
 )
 
 type Token struct {
 	Type    TokenType
 	Literal string
+	Pos     Position
+}
+
+// Position points at the first character of a token in the source.
+// Line and Column are 1-based; a zero Line means the position is unknown.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.File != "" {
+			return p.File
+		}
+		return "-"
+	}
+	if p.File != "" {
+		return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"mut":    MUT,
-	"const":  CONST,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
-	"import": IMPORT,
-	"module": MODULE,
+	"fn":       FUNCTION,
+	"mut":      MUT,
+	"const":    CONST,
+	"true":     TRUE,
+	"false":    FALSE,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"while":    WHILE,
+	"for":      FOR,
+	"in":       IN,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"try":      TRY,
+	"catch":    CATCH,
+	"finally":  FINALLY,
+	"throw":    THROW,
+	"import":   IMPORT,
+	"module":   MODULE,
 }
 
 func LookupIdent(ident string) TokenType {
@@ -94,10 +148,16 @@ func (t TokenType) String() string {
 		BANG:      "!",
 		ASTERISK:  "*",
 		SLASH:     "/",
+		PERCENT:   "%",
+		POWER:     "**",
 		LT:        "<",
 		GT:        ">",
+		LT_EQ:     "<=",
+		GT_EQ:     ">=",
 		EQ:        "==",
 		NOT_EQ:    "!=",
+		AND:       "&&",
+		OR:        "||",
 		COMMA:     ",",
 		SEMICOLON: ";",
 		LPAREN:    "(",
@@ -112,14 +172,26 @@ func (t TokenType) String() string {
 		IF:        "if",
 		ELSE:      "else",
 		RETURN:    "return",
+		WHILE:     "while",
+		FOR:       "for",
+		IN:        "in",
+		BREAK:     "break",
+		CONTINUE:  "continue",
+		TRY:       "try",
+		CATCH:     "catch",
+		FINALLY:   "finally",
+		THROW:     "throw",
 		IMPORT:    "import",
 		MODULE:    "module",
 		STRING:    `""""`,
+		TEMPLATE:  "`${}`",
 		LBRACKET:  "[",
 		RBRACKET:  "]",
 		COLON:     ":",
 		DOT:       ".",
 		EXPORT:    "@",
+
+		DOC_COMMENT: "///",
 	}
 	if int(t) < len(names) {
 		return names[t]
@@ -0,0 +1,35 @@
+package vm
+
+import (
+	"github.com/pecet3/hmbk-script/code"
+	"github.com/pecet3/hmbk-script/object"
+)
+
+// Frame is one function call: the closure being run, its instruction
+// pointer, and where its arguments and locals start on the stack.
+type Frame struct {
+	cl          *object.Closure
+	ip          int
+	basePointer int
+}
+
+func NewFrame(cl *object.Closure, basePointer int) *Frame {
+	return &Frame{cl: cl, ip: -1, basePointer: basePointer}
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.cl.Fn.Instructions
+}
+
+// upvalue is a variable captured by a closure. While the function that
+// owns it is running it points at the variable's stack slot, so every
+// closure sees the same variable. When that function returns the value
+// is moved into the upvalue itself.
+type upvalue struct {
+	slot   int
+	open   bool
+	closed object.Object
+}
+
+func (uv *upvalue) Type() object.ObjectType { return "UPVALUE" }
+func (uv *upvalue) Inspect() string         { return "upvalue" }
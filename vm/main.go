@@ -1,49 +1,109 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math"
+	"strings"
 
 	"github.com/pecet3/hmbk-script/code"
 	"github.com/pecet3/hmbk-script/compiler"
 	"github.com/pecet3/hmbk-script/object"
+	"github.com/pecet3/hmbk-script/token"
 )
 
 var True = &object.Bool{Value: true}
 var False = &object.Bool{Value: false}
-var Null = &object.Null{}
+var Null = object.NullValue
 
 const (
 	stackSize  = 2048
 	GlobalSize = 65536
+	MaxFrames  = 1024
 )
 
 type VM struct {
-	consts       []object.Object
-	stack        []object.Object
-	sp           int
-	globals      []object.Object
-	instructions []byte
+	consts   []object.Object
+	stack    []object.Object
+	sp       int
+	shared   *shared
+	handlers []handler
+
+	frames       []*Frame
+	framesIndex  int
+	openUpvalues []*upvalue
+
+	allocs *allocCounters
+
+	// builtins are object.Builtins unless SetOutput replaced them
+	builtins []object.BuiltinDef
 }
 
 func New(bytecode *compiler.Bytecode) *VM {
+	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions, Positions: bytecode.Positions}
+	mainClosure := &object.Closure{Fn: mainFn}
+	frames := make([]*Frame, MaxFrames)
+	frames[0] = NewFrame(mainClosure, 0)
 	return &VM{
-		consts:       bytecode.Constants,
-		stack:        make([]object.Object, stackSize),
-		sp:           0,
-		globals:      make([]object.Object, GlobalSize),
-		instructions: bytecode.Instructions,
+		consts:      bytecode.Constants,
+		stack:       make([]object.Object, stackSize),
+		sp:          0,
+		shared:      newShared(make([]object.Object, GlobalSize)),
+		frames:      frames,
+		framesIndex: 1,
+		allocs:      &allocCounters{},
+		builtins:    object.Builtins,
 	}
 }
 
+// SetOutput makes print and bash write to w instead of os.Stdout.
+func (vm *VM) SetOutput(w io.Writer) {
+	vm.builtins = object.NewBuiltins(w)
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+// position returns where in the source the instruction being run comes
+// from, for the error values the VM creates.
+func (vm *VM) position() token.Position {
+	frame := vm.currentFrame()
+	return frame.cl.Fn.Positions.At(frame.ip)
+}
+
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= MaxFrames {
+		return fmt.Errorf("stack overflow")
+	}
+	vm.frames[vm.framesIndex] = f
+	vm.framesIndex++
+	return nil
+}
+
+func (vm *VM) popFrame() *Frame {
+	vm.framesIndex--
+	return vm.frames[vm.framesIndex]
+}
+
 func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
 	vm := New(bytecode)
-	vm.globals = s
+	vm.shared = newShared(s)
 	return vm
 }
 
+// Globals returns the globals store, which running may have grown, to
+// pass on to the next VM with NewWithGlobalsStore.
+func (vm *VM) Globals() []object.Object {
+	if vm.shared.locking.Load() {
+		vm.shared.mu.RLock()
+		defer vm.shared.mu.RUnlock()
+	}
+	return vm.shared.globals
+}
+
 func (vm *VM) LastPoppedStackElem() object.Object {
-	fmt.Println(vm.stack[vm.sp])
 	return vm.stack[vm.sp]
 }
 
@@ -55,14 +115,32 @@ func (vm *VM) StackTop() object.Object {
 }
 
 func (vm *VM) Run() error {
+	for {
+		err := vm.run()
+		if err == nil || len(vm.handlers) == 0 {
+			return err
+		}
+		vm.catch(err)
+	}
+}
+
+func (vm *VM) run() error {
+	var ip int
+	var op code.Opcode
+	// the current frame and its code, reloaded by the instructions that
+	// call or return
+	frame := vm.currentFrame()
+	ins := frame.Instructions()
 
-	for ip := 0; ip < len(vm.instructions); ip++ {
+	for frame.ip < len(ins)-1 {
+		frame.ip++
 
-		op := code.Opcode(vm.instructions[ip])
+		ip = frame.ip
+		op = code.Opcode(ins[ip])
 		switch op {
 		case code.OpConstant:
-			constIndex := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			constIndex := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
 			if constIndex >= len(vm.consts) {
 				return fmt.Errorf("constant index out of range: %d", constIndex)
 			}
@@ -76,7 +154,12 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpMinus:
+			err := vm.executeMinusOperator()
+			if err != nil {
+				return err
+			}
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
@@ -91,20 +174,20 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterEqual, code.OpLessThan, code.OpLessEqual:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
 			}
 		case code.OpJump:
-			pos := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip = pos - 1
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip = pos - 1
 		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
 			condition := vm.pop()
 			if !isTruthy(condition) {
-				ip = pos - 1
+				frame.ip = pos - 1
 			}
 		case code.OpNull:
 			err := vm.push(Null)
@@ -112,22 +195,22 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case code.OpSetGlobal:
-			globalIndex := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			globalIndex := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
 			if globalIndex >= GlobalSize {
 				return fmt.Errorf("global index out of range: %d", globalIndex)
 			}
-			vm.globals[globalIndex] = vm.StackTop()
+			vm.shared.setGlobal(globalIndex, vm.pop())
 		case code.OpGetGlobal:
-			globalIndex := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
-			err := vm.push(vm.globals[globalIndex])
+			globalIndex := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
+			err := vm.push(vm.shared.getGlobal(globalIndex))
 			if err != nil {
 				return err
 			}
 		case code.OpArray:
-			numElements := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
 			array := vm.buildArray(vm.sp-numElements, vm.sp)
 			vm.sp = vm.sp - numElements
 			err := vm.push(array)
@@ -135,8 +218,8 @@ func (vm *VM) Run() error {
 				return err
 			}
 		case code.OpHash:
-			numElements := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
 			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
 			if err != nil {
 				return err
@@ -146,6 +229,15 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpConcat:
+			numParts := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
+			str := vm.buildString(vm.sp-numParts, vm.sp)
+			vm.sp = vm.sp - numParts
+			err := vm.push(str)
+			if err != nil {
+				return err
+			}
 		case code.OpIndex:
 			index := vm.pop()
 			left := vm.pop()
@@ -153,6 +245,203 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+			err := object.SetIndex(left, index, value)
+			if err != nil {
+				return err
+			}
+		case code.OpSetupTry:
+			catchPos := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
+			vm.handlers = append(vm.handlers, handler{catchPos: catchPos, sp: vm.sp, framesIndex: vm.framesIndex})
+		case code.OpPopTry:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case code.OpThrow:
+			err := vm.executeThrow(vm.pop())
+			return err
+		case code.OpCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			frame.ip += 1
+			err := vm.callFunction(int(numArgs))
+			if err != nil {
+				return err
+			}
+			frame = vm.currentFrame()
+			ins = frame.Instructions()
+		case code.OpReturnValue:
+			returnValue := vm.pop()
+			if vm.framesIndex == 1 {
+				// a top level `return` ends the program with its value
+				return nil
+			}
+			returned := vm.popFrame()
+			vm.dropHandlers()
+			vm.closeUpvalues(returned.basePointer)
+			vm.sp = returned.basePointer - 1
+			err := vm.push(returnValue)
+			if err != nil {
+				return err
+			}
+			frame = vm.currentFrame()
+			ins = frame.Instructions()
+		case code.OpReturn:
+			if vm.framesIndex == 1 {
+				return nil
+			}
+			returned := vm.popFrame()
+			vm.dropHandlers()
+			vm.closeUpvalues(returned.basePointer)
+			vm.sp = returned.basePointer - 1
+			err := vm.push(Null)
+			if err != nil {
+				return err
+			}
+			frame = vm.currentFrame()
+			ins = frame.Instructions()
+		case code.OpGetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			frame.ip += 1
+			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			if err != nil {
+				return err
+			}
+		case code.OpSetLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			frame.ip += 1
+			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+		case code.OpClosure:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			numFree := code.ReadUint8(ins[ip+3:])
+			frame.ip += 3
+			err := vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+		case code.OpGetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			frame.ip += 1
+			uv := frame.cl.Free[freeIndex].(*upvalue)
+			err := vm.push(vm.readUpvalue(uv))
+			if err != nil {
+				return err
+			}
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			frame.ip += 1
+			uv := frame.cl.Free[freeIndex].(*upvalue)
+			vm.writeUpvalue(uv, vm.pop())
+		case code.OpCaptureLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			frame.ip += 1
+			slot := frame.basePointer + int(localIndex)
+			err := vm.push(vm.captureUpvalue(slot))
+			if err != nil {
+				return err
+			}
+		case code.OpCaptureFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			frame.ip += 1
+			err := vm.push(frame.cl.Free[freeIndex])
+			if err != nil {
+				return err
+			}
+		case code.OpGetBuiltin:
+			builtinIndex := int(code.ReadUint8(ins[ip+1:]))
+			frame.ip += 1
+			if builtinIndex >= len(vm.builtins) {
+				return fmt.Errorf("builtin index out of range: %d", builtinIndex)
+			}
+			err := vm.push(vm.builtins[builtinIndex].Builtin)
+			if err != nil {
+				return err
+			}
+		case code.OpGetBuiltinModule:
+			moduleIndex := int(code.ReadUint8(ins[ip+1:]))
+			frame.ip += 1
+			if moduleIndex >= len(object.BuiltinModules) {
+				return fmt.Errorf("builtin module index out of range: %d", moduleIndex)
+			}
+			err := vm.push(vm.builtinModule(moduleIndex))
+			if err != nil {
+				return err
+			}
+		case code.OpCheckDefined:
+			constIndex := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
+			err := vm.checkDefined(constIndex)
+			if err != nil {
+				return err
+			}
+		case code.OpJumpDefined:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			frame.ip += 2
+			if vm.stack[vm.sp-1] != nil {
+				frame.ip = pos - 1
+			} else {
+				vm.sp--
+			}
+		case code.OpCurrentClosure:
+			err := vm.push(frame.cl)
+			if err != nil {
+				return err
+			}
+		case code.OpIter:
+			iterable := vm.pop()
+			it, ok := object.NewIterator(iterable)
+			if !ok {
+				return fmt.Errorf("cannot iterate over %s", iterable.Type())
+			}
+			vm.allocs.iterators.Add(1)
+			err := vm.push(it)
+			if err != nil {
+				return err
+			}
+		case code.OpIterNext:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			count := int(code.ReadUint8(ins[ip+3:]))
+			frame.ip += 3
+			done, err := vm.executeIterNext(count)
+			if err != nil {
+				return err
+			}
+			if done {
+				frame.ip = pos - 1
+			}
+		case code.OpWide:
+			err := vm.executeWide(ins, ip)
+			if err != nil {
+				return err
+			}
+			// a wide OpCall enters a new frame
+			frame = vm.currentFrame()
+			ins = frame.Instructions()
+		case code.OpBinaryConst:
+			constIndex := int(code.ReadUint16(ins[ip+1:]))
+			binaryOp := code.Opcode(ins[ip+3])
+			frame.ip += 3
+			if constIndex >= len(vm.consts) {
+				return fmt.Errorf("constant index out of range: %d", constIndex)
+			}
+			vm.sp--
+			err := vm.executeBinary(binaryOp, vm.stack[vm.sp], vm.consts[constIndex])
+			if err != nil {
+				return err
+			}
+		case code.OpCompareJump:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			comparison := code.Opcode(ins[ip+3])
+			frame.ip += 3
+			vm.sp -= 2
+			result, err := compare(comparison, vm.stack[vm.sp], vm.stack[vm.sp+1])
+			if err != nil {
+				return err
+			}
+			if !result {
+				frame.ip = pos - 1
+			}
 
 		default:
 			return fmt.Errorf("unknown opcode: %d", op)
@@ -161,6 +450,398 @@ func (vm *VM) Run() error {
 	return nil
 }
 
+// handler is an active try block: where its catch code starts and how
+// deep the stack was when it was entered.
+type handler struct {
+	catchPos    int
+	sp          int
+	framesIndex int
+}
+
+// thrownError carries a value raised by OpThrow or a builtin, with the
+// calls it went through, to the handler that catches it.
+type thrownError struct {
+	value *object.Error
+}
+
+func (e *thrownError) Error() string { return e.value.Message }
+
+// ErrorPosition returns where err, an error Run returned, was raised: where
+// a thrown error was created or the instruction that failed.
+func (vm *VM) ErrorPosition(err error) token.Position {
+	if thrown, ok := err.(*thrownError); ok {
+		return thrown.value.Pos
+	}
+	return vm.position()
+}
+
+// GlobalError returns err, an error Run returned, as the GlobalError the
+// evaluator would have raised, with its position and traceback.
+func (vm *VM) GlobalError(err error) *object.GlobalError {
+	if thrown, ok := err.(*thrownError); ok {
+		return &object.GlobalError{Message: thrown.value.Message, Kind: thrown.value.Kind, Pos: thrown.value.Pos, Trace: thrown.value.Trace}
+	}
+	return &object.GlobalError{Message: err.Error(), Kind: object.RuntimeErrorKind, Pos: vm.position(), Trace: vm.trace(0)}
+}
+
+// trace lists the calls running above frame below, innermost first, with
+// where each was called from.
+func (vm *VM) trace(below int) []object.Frame {
+	var trace []object.Frame
+	for i := vm.framesIndex - 1; i > below; i-- {
+		name := vm.frames[i].cl.Fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+		caller := vm.frames[i-1]
+		trace = append(trace, object.Frame{Function: name, CallPos: caller.cl.Fn.Positions.At(caller.ip)})
+	}
+	return trace
+}
+
+// raise returns value as the error to throw, with the calls running now
+// added to its trace. A rethrown error keeps the calls it already went
+// through, as in the evaluator. The value itself is left as it is.
+func (vm *VM) raise(value *object.Error) error {
+	raised := *value
+	if !raised.Pos.IsValid() {
+		// like error("...") values, which get the position of the throw
+		raised.Pos = vm.position()
+	}
+	raised.Trace = append(value.Trace[:len(value.Trace):len(value.Trace)], vm.trace(0)...)
+	return &thrownError{value: &raised}
+}
+
+// catch unwinds the frames and the stack to the innermost handler, pushes
+// err as an error value and continues at the catch code.
+func (vm *VM) catch(err error) {
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	if h.framesIndex < vm.framesIndex {
+		vm.closeUpvalues(vm.frames[h.framesIndex].basePointer)
+	}
+	// the trace of the caught value ends with the function that catches it
+	var value *object.Error
+	if thrown, ok := err.(*thrownError); ok {
+		value = thrown.value
+		value.Trace = value.Trace[:len(value.Trace)-(h.framesIndex-1)]
+	} else {
+		value = &object.Error{Message: err.Error(), Kind: object.RuntimeErrorKind, Pos: vm.position(), Trace: vm.trace(h.framesIndex - 1)}
+		vm.allocs.errors.Add(1)
+	}
+	vm.framesIndex = h.framesIndex
+	vm.sp = h.sp
+
+	vm.stack[vm.sp] = value
+	vm.sp++
+	vm.currentFrame().ip = h.catchPos - 1
+}
+
+// dropHandlers forgets the try blocks of a frame that just returned.
+func (vm *VM) dropHandlers() {
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].framesIndex > vm.framesIndex {
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
+}
+
+func (vm *VM) callFunction(numArgs int) error {
+	switch callee := vm.stack[vm.sp-1-numArgs].(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	default:
+		return fmt.Errorf("not a function: %s", callee.Type())
+	}
+}
+
+// callBuiltin replaces the builtin and its arguments with its result. A
+// GlobalError from the builtin is raised like any other runtime error.
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+	result := builtin.Fn(args...)
+	vm.sp = vm.sp - numArgs - 1
+	if ge, ok := result.(*object.GlobalError); ok {
+		return vm.raise(ge.AsError())
+	}
+	if result == nil {
+		result = Null
+	}
+	return vm.push(result)
+}
+
+func (vm *VM) callClosure(callee *object.Closure, numArgs int) error {
+	if numArgs != callee.Fn.NumParameters {
+		return fmt.Errorf("wrong number of arguments. got=%d, want=%d",
+			numArgs, callee.Fn.NumParameters)
+	}
+	frame := NewFrame(callee, vm.sp-numArgs)
+	if frame.basePointer+callee.Fn.NumLocals >= stackSize {
+		return fmt.Errorf("stack overflow")
+	}
+	err := vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
+	vm.sp = frame.basePointer + callee.Fn.NumLocals
+	// locals declared in blocks that do not run must read as unset, not
+	// as what an earlier call left in their slots
+	clear(vm.stack[frame.basePointer+numArgs : vm.sp])
+	vm.allocs.calls.Add(1)
+	return nil
+}
+
+// checkDefined raises the error in the constant at constIndex if the top
+// of the stack is a variable that was never set.
+func (vm *VM) checkDefined(constIndex int) error {
+	if constIndex >= len(vm.consts) {
+		return fmt.Errorf("constant index out of range: %d", constIndex)
+	}
+	if vm.stack[vm.sp-1] != nil {
+		return nil
+	}
+	message, ok := vm.consts[constIndex].(*object.String)
+	if !ok {
+		return fmt.Errorf("constant %d is not a string", constIndex)
+	}
+	return errors.New(message.Value)
+}
+
+// builtinModule returns the builtin module at index, creating it on first
+// use. Script functions it calls, such as HTTP handlers, run through Call.
+func (vm *VM) builtinModule(index int) *object.Module {
+	return vm.shared.builtinModule(index, vm.Call)
+}
+
+// Call runs fn with args to completion and returns its result. It uses a
+// stack of its own but shares the globals, so builtins can call back into
+// the program, e.g. to handle an HTTP request. It is safe to call from
+// several goroutines at once. Errors are returned as a GlobalError.
+func (vm *VM) Call(fn object.Object, args ...object.Object) object.Object {
+	vm.shared.locking.Store(true)
+	ins := code.Make(code.OpCall, len(args))
+	ins = append(ins, code.Make(code.OpReturnValue)...)
+	caller := &VM{
+		consts:      vm.consts,
+		stack:       make([]object.Object, stackSize),
+		shared:      vm.shared,
+		frames:      make([]*Frame, MaxFrames),
+		framesIndex: 1,
+		allocs:      vm.allocs,
+		builtins:    vm.builtins,
+	}
+	caller.frames[0] = NewFrame(&object.Closure{Fn: &object.CompiledFunction{Instructions: ins}}, 0)
+	caller.stack[0] = fn
+	copy(caller.stack[1:], args)
+	caller.sp = len(args) + 1
+
+	err := caller.Run()
+	if err != nil {
+		return caller.GlobalError(err)
+	}
+	return caller.stack[caller.sp]
+}
+
+// executeWide runs the instruction after the OpWide prefix at ip. Only
+// very large scripts and functions need wide operands, so they take this
+// path instead of slowing down the main loop.
+func (vm *VM) executeWide(ins code.Instructions, ip int) error {
+	op, operands, size, err := code.ReadInstruction(ins, ip)
+	if err != nil {
+		return err
+	}
+	frame := vm.currentFrame()
+	frame.ip += size - 1
+	switch op {
+	case code.OpConstant:
+		if operands[0] >= len(vm.consts) {
+			return fmt.Errorf("constant index out of range: %d", operands[0])
+		}
+		return vm.push(vm.consts[operands[0]])
+	case code.OpJump:
+		frame.ip = operands[0] - 1
+	case code.OpJumpNotTruthy:
+		if !isTruthy(vm.pop()) {
+			frame.ip = operands[0] - 1
+		}
+	case code.OpSetGlobal:
+		if operands[0] >= compiler.MaxGlobals {
+			return fmt.Errorf("global index out of range: %d", operands[0])
+		}
+		vm.shared.setGlobal(operands[0], vm.pop())
+	case code.OpGetGlobal:
+		return vm.push(vm.shared.getGlobal(operands[0]))
+	case code.OpArray:
+		array := vm.buildArray(vm.sp-operands[0], vm.sp)
+		vm.sp = vm.sp - operands[0]
+		return vm.push(array)
+	case code.OpHash:
+		hash, err := vm.buildHash(vm.sp-operands[0], vm.sp)
+		if err != nil {
+			return err
+		}
+		vm.sp = vm.sp - operands[0]
+		return vm.push(hash)
+	case code.OpConcat:
+		str := vm.buildString(vm.sp-operands[0], vm.sp)
+		vm.sp = vm.sp - operands[0]
+		return vm.push(str)
+	case code.OpSetupTry:
+		vm.handlers = append(vm.handlers, handler{catchPos: operands[0], sp: vm.sp, framesIndex: vm.framesIndex})
+	case code.OpCall:
+		return vm.callFunction(operands[0])
+	case code.OpGetLocal:
+		return vm.push(vm.stack[frame.basePointer+operands[0]])
+	case code.OpSetLocal:
+		vm.stack[frame.basePointer+operands[0]] = vm.pop()
+	case code.OpClosure:
+		return vm.pushClosure(operands[0], operands[1])
+	case code.OpGetFree:
+		return vm.push(vm.readUpvalue(frame.cl.Free[operands[0]].(*upvalue)))
+	case code.OpSetFree:
+		vm.writeUpvalue(frame.cl.Free[operands[0]].(*upvalue), vm.pop())
+	case code.OpCaptureLocal:
+		return vm.push(vm.captureUpvalue(frame.basePointer + operands[0]))
+	case code.OpCaptureFree:
+		return vm.push(frame.cl.Free[operands[0]])
+	case code.OpBinaryConst:
+		if operands[0] >= len(vm.consts) {
+			return fmt.Errorf("constant index out of range: %d", operands[0])
+		}
+		vm.sp--
+		return vm.executeBinary(code.Opcode(operands[1]), vm.stack[vm.sp], vm.consts[operands[0]])
+	case code.OpCompareJump:
+		vm.sp -= 2
+		result, err := compare(code.Opcode(operands[1]), vm.stack[vm.sp], vm.stack[vm.sp+1])
+		if err != nil {
+			return err
+		}
+		if !result {
+			frame.ip = operands[0] - 1
+		}
+	case code.OpCheckDefined:
+		return vm.checkDefined(operands[0])
+	case code.OpJumpDefined:
+		if vm.stack[vm.sp-1] != nil {
+			frame.ip = operands[0] - 1
+		} else {
+			vm.sp--
+		}
+	case code.OpIterNext:
+		done, err := vm.executeIterNext(operands[1])
+		if err != nil {
+			return err
+		}
+		if done {
+			frame.ip = operands[0] - 1
+		}
+	default:
+		return fmt.Errorf("%s has no wide form", op)
+	}
+	return nil
+}
+
+// captureUpvalue returns the open upvalue for a stack slot, so closures
+// capturing the same variable share it.
+func (vm *VM) captureUpvalue(slot int) *upvalue {
+	for _, uv := range vm.openUpvalues {
+		if uv.slot == slot {
+			return uv
+		}
+	}
+	uv := &upvalue{slot: slot, open: true}
+	vm.allocs.upvalues.Add(1)
+	vm.openUpvalues = append(vm.openUpvalues, uv)
+	return uv
+}
+
+// closeUpvalues moves the variables at or above base off the stack, into
+// the upvalues that captured them.
+func (vm *VM) closeUpvalues(base int) {
+	open := vm.openUpvalues[:0]
+	for _, uv := range vm.openUpvalues {
+		if uv.slot >= base {
+			uv.closed = vm.stack[uv.slot]
+			uv.open = false
+		} else {
+			open = append(open, uv)
+		}
+	}
+	vm.openUpvalues = open
+}
+
+func (vm *VM) readUpvalue(uv *upvalue) object.Object {
+	if uv.open {
+		return vm.stack[uv.slot]
+	}
+	return uv.closed
+}
+
+func (vm *VM) writeUpvalue(uv *upvalue, value object.Object) {
+	if uv.open {
+		vm.stack[uv.slot] = value
+		return
+	}
+	uv.closed = value
+}
+
+func (vm *VM) pushClosure(constIndex, numFree int) error {
+	function, ok := vm.consts[constIndex].(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", vm.consts[constIndex])
+	}
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		captured := vm.stack[vm.sp-numFree+i]
+		if uv, ok := captured.(*upvalue); ok {
+			free[i] = uv
+		} else {
+			// a value such as the enclosing function itself
+			free[i] = &upvalue{closed: captured}
+			vm.allocs.upvalues.Add(1)
+		}
+	}
+	vm.sp = vm.sp - numFree
+	vm.allocs.closures.Add(1)
+	return vm.push(&object.Closure{Fn: function, Free: free})
+}
+
+func (vm *VM) executeThrow(value object.Object) error {
+	switch value := value.(type) {
+	case *object.Error:
+		return vm.raise(value)
+	case *object.String:
+		vm.allocs.errors.Add(1)
+		return vm.raise(&object.Error{Message: value.Value, Kind: object.ThrownErrorKind})
+	default:
+		return fmt.Errorf("throw expects a string or an error, got %s", value.Type())
+	}
+}
+
+// executeIterNext advances the iterator on top of the stack, leaving it in
+// place, and pushes the next value, or key and value when count is 2.
+func (vm *VM) executeIterNext(count int) (bool, error) {
+	it, ok := vm.StackTop().(*object.Iterator)
+	if !ok {
+		return false, fmt.Errorf("not an iterator: %s", vm.StackTop().Type())
+	}
+	if count == 2 {
+		key, value, ok := it.Next()
+		if !ok {
+			return true, nil
+		}
+		if err := vm.push(key); err != nil {
+			return false, err
+		}
+		return false, vm.push(value)
+	}
+	value, ok := it.NextValue()
+	if !ok {
+		return true, nil
+	}
+	return false, vm.push(value)
+}
+
 func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 	hashedPairs := make(map[object.HashKey]object.HashPair)
 	for i := startIndex; i < endIndex; i += 2 {
@@ -173,6 +854,7 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 		}
 		hashedPairs[hashKey.HashKey()] = pair
 	}
+	vm.allocs.hashes.Add(1)
 	return &object.Hash{Pairs: hashedPairs}, nil
 }
 func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
@@ -180,8 +862,17 @@ func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
 	for i := startIndex; i < endIndex; i++ {
 		elements[i-startIndex] = vm.stack[i]
 	}
+	vm.allocs.arrays.Add(1)
 	return &object.Array{Elements: elements}
 }
+func (vm *VM) buildString(startIndex, endIndex int) object.Object {
+	var out strings.Builder
+	for i := startIndex; i < endIndex; i++ {
+		out.WriteString(vm.stack[i].Inspect())
+	}
+	vm.allocs.strings.Add(1)
+	return &object.String{Value: out.String()}
+}
 func (vm *VM) push(o object.Object) error {
 	if vm.sp >= stackSize {
 		return fmt.Errorf("stack overflow")
@@ -216,41 +907,67 @@ func nativeBoolToBooleanObject(input bool) *object.Bool {
 func (vm *VM) executeComparison(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
-	if left.Type() == object.NUMBER && right.Type() == object.NUMBER {
-		return vm.executeNumberComparison(op, left, right)
+	result, err := compare(op, left, right)
+	if err != nil {
+		return err
+	}
+	return vm.push(nativeBoolToBooleanObject(result))
+}
+
+func compare(op code.Opcode, left, right object.Object) (bool, error) {
+	if l, ok := left.(*object.Number); ok {
+		if r, ok := right.(*object.Number); ok {
+			return compareNumbers(op, l.Value, r.Value)
+		}
 	}
-	log.Println(right.Type(), left.Type())
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(right == left))
+		return objectsEqual(left, right), nil
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(right != left))
+		return !objectsEqual(left, right), nil
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)",
-			op, left.Type(), right.Type())
+		return false, operatorError(op, left, right)
 	}
 }
-func (vm *VM) executeNumberComparison(
-	op code.Opcode,
-	left, right object.Object,
-) error {
-	leftValue := left.(*object.Number).Value
-	rightValue := right.(*object.Number).Value
+
+// objectsEqual compares strings and booleans by value, like the evaluator,
+// and everything else by identity.
+func objectsEqual(left, right object.Object) bool {
+	switch left := left.(type) {
+	case *object.String:
+		r, ok := right.(*object.String)
+		return ok && left.Value == r.Value
+	case *object.Bool:
+		r, ok := right.(*object.Bool)
+		return ok && left.Value == r.Value
+	}
+	return left == right
+}
+
+func compareNumbers(op code.Opcode, leftValue, rightValue float64) (bool, error) {
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+		return rightValue == leftValue, nil
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+		return rightValue != leftValue, nil
 	case code.OpGreaterThan:
-		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+		return leftValue > rightValue, nil
+	case code.OpGreaterEqual:
+		return leftValue >= rightValue, nil
+	case code.OpLessThan:
+		return leftValue < rightValue, nil
+	case code.OpLessEqual:
+		return leftValue <= rightValue, nil
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return false, fmt.Errorf("unknown operator: %d", op)
 	}
 }
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
-
+	return vm.executeBinary(op, left, right)
+}
+func (vm *VM) executeBinary(op code.Opcode, left, right object.Object) error {
 	leftType := left.Type()
 	rightType := right.Type()
 	switch {
@@ -258,20 +975,54 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return vm.executeBinaryNumberOperation(op, left, right)
 	case leftType == object.STRING && rightType == object.STRING:
 		return vm.executeBinaryStringOperation(op, left, right)
+	case op == code.OpAdd && (leftType == object.STRING && rightType == object.NUMBER ||
+		leftType == object.NUMBER && rightType == object.STRING):
+		// like the evaluator, a number added to a string is concatenated
+		vm.allocs.strings.Add(1)
+		return vm.push(&object.String{Value: left.Inspect() + right.Inspect()})
 	default:
-		return fmt.Errorf("unsupported types for binary operation: %s %s",
-			leftType, rightType)
+		return operatorError(op, left, right)
+	}
+}
+
+// operatorSymbols are the operators of the opcodes the compiler emits for
+// infix expressions.
+var operatorSymbols = map[code.Opcode]string{
+	code.OpAdd:          "+",
+	code.OpSub:          "-",
+	code.OpMul:          "*",
+	code.OpDiv:          "/",
+	code.OpMod:          "%",
+	code.OpPow:          "**",
+	code.OpGreaterThan:  ">",
+	code.OpGreaterEqual: ">=",
+	code.OpLessThan:     "<",
+	code.OpLessEqual:    "<=",
+	code.OpEqual:        "==",
+	code.OpNotEqual:     "!=",
+}
+
+// operatorError reports that op does not apply to left and right, in the
+// evaluator's words: a type mismatch for operands of different types other
+// than a number and a string, an unknown operator otherwise.
+func operatorError(op code.Opcode, left, right object.Object) error {
+	l, r := left.Type(), right.Type()
+	numberAndString := l == object.NUMBER && r == object.STRING || l == object.STRING && r == object.NUMBER
+	if l != r && !numberAndString {
+		return fmt.Errorf("type mismatch: %s %s %s", l, operatorSymbols[op], r)
 	}
+	return fmt.Errorf("unknown operator: %s %s %s", l, operatorSymbols[op], r)
 }
 func (vm *VM) executeBinaryStringOperation(
 	op code.Opcode,
 	left, right object.Object,
 ) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operator: %d", op)
+		return operatorError(op, left, right)
 	}
 	leftValue := left.(*object.String).Value
 	rightValue := right.(*object.String).Value
+	vm.allocs.strings.Add(1)
 	return vm.push(&object.String{Value: leftValue + rightValue})
 }
 
@@ -296,10 +1047,18 @@ func (vm *VM) executeBinaryNumberOperation(
 			return fmt.Errorf("division by zero")
 		}
 		result = leftValue / rightValue
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result = math.Mod(leftValue, rightValue)
+	case code.OpPow:
+		result = math.Pow(leftValue, rightValue)
 	default:
-		return fmt.Errorf("unknown number operator: %d", op)
+		return operatorError(op, left, right)
 	}
 
+	vm.allocs.numbers.Add(1)
 	return vm.push(&object.Number{Value: result})
 }
 
@@ -318,12 +1077,37 @@ func (vm *VM) executeBangOperator() error {
 	}
 }
 
+func (vm *VM) executeMinusOperator() error {
+	operand := vm.pop()
+	number, ok := operand.(*object.Number)
+	if !ok {
+		return fmt.Errorf("unknown operator: -%s", operand.Type())
+	}
+	vm.allocs.numbers.Add(1)
+	return vm.push(&object.Number{Value: -number.Value})
+}
+
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	switch {
 	case left.Type() == object.ARRAY && index.Type() == object.NUMBER:
 		return vm.executeArrayIndex(left, index)
 	case left.Type() == object.HASH:
 		return vm.executeHashIndex(left, index)
+	case left.Type() == object.ERROR && index.Type() == object.STRING:
+		name := index.(*object.String).Value
+		field, ok := left.(*object.Error).Field(name)
+		if !ok {
+			return fmt.Errorf("error has no field %s", name)
+		}
+		return vm.push(field)
+	case left.Type() == object.MODULE && index.Type() == object.STRING:
+		mod := left.(*object.Module)
+		name := index.(*object.String).Value
+		val, ok := mod.Env.Get(name)
+		if !ok {
+			return fmt.Errorf("builtin module %s has no symbol %s", mod.Name, name)
+		}
+		return vm.push(val)
 	default:
 		return fmt.Errorf("index operator not supported: %s", left.Type())
 	}
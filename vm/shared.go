@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pecet3/hmbk-script/modules"
+	"github.com/pecet3/hmbk-script/object"
+)
+
+// shared is the state a VM shares with the VMs that Call creates, which
+// may run at the same time (see modules.Caller), so it is guarded by a
+// lock. Values such as arrays and hashes reachable from the globals are
+// not.
+type shared struct {
+	// locking is set when the first builtin module is loaded, before
+	// anything can call back from another goroutine, and by Call. Until
+	// then there is only the one goroutine running the script, which needs
+	// no lock.
+	locking atomic.Bool
+	mu      sync.RWMutex
+	globals []object.Object
+	// modules holds the builtin modules used so far, by their index in
+	// object.BuiltinModules.
+	modules []*object.Module
+}
+
+func newShared(globals []object.Object) *shared {
+	return &shared{
+		globals: globals,
+		modules: make([]*object.Module, len(object.BuiltinModules)),
+	}
+}
+
+func (s *shared) getGlobal(index int) object.Object {
+	if s.locking.Load() {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	if index >= len(s.globals) {
+		return nil
+	}
+	return s.globals[index]
+}
+
+// setGlobal stores a global, making room for it first. Scripts with more
+// than GlobalSize globals only reach them through wide instructions.
+func (s *shared) setGlobal(index int, value object.Object) {
+	if s.locking.Load() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if index >= len(s.globals) {
+		s.globals = append(s.globals, make([]object.Object, index+1-len(s.globals))...)
+	}
+	s.globals[index] = value
+}
+
+// builtinModule returns the builtin module at index, creating it on first
+// use with call to run the script functions it is given.
+func (s *shared) builtinModule(index int, call modules.Caller) *object.Module {
+	s.locking.Store(true)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.modules[index] == nil {
+		s.modules[index], _ = modules.New(object.BuiltinModules[index], call)
+	}
+	return s.modules[index]
+}
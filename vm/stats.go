@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// VM values are plain Go values, so the Go garbage collector frees them
+// once nothing on the stack, in the globals, the constants or a closure
+// refers to them. There is no second heap to manage; instead the VM counts
+// what it allocates, and Stats puts those counts next to the runtime's view
+// of the heap. Collection is tuned the Go way, with GOGC and GOMEMLIMIT.
+//
+// The counters are shared with the VMs that Call creates, and updated
+// atomically.
+type allocCounters struct {
+	numbers   atomic.Uint64
+	strings   atomic.Uint64
+	arrays    atomic.Uint64
+	hashes    atomic.Uint64
+	closures  atomic.Uint64
+	upvalues  atomic.Uint64
+	iterators atomic.Uint64
+	errors    atomic.Uint64
+	calls     atomic.Uint64
+}
+
+// Stats is a snapshot of the memory use of a VM.
+type Stats struct {
+	// Values allocated by the VM since it was created, by kind. Values
+	// made inside builtins are not counted.
+	Numbers, Strings, Arrays, Hashes uint64
+	Closures, Upvalues, Iterators    uint64
+	Errors                           uint64
+	// Calls is the number of compiled functions called, each needing a
+	// frame.
+	Calls uint64
+
+	// The Go heap of the whole process.
+	HeapAlloc   uint64 // bytes of live and not yet collected objects
+	HeapObjects uint64
+	TotalAlloc  uint64 // bytes allocated since the process started
+	NumGC       uint32
+	PauseTotal  time.Duration
+}
+
+// Allocs is the number of values the VM allocated.
+func (s Stats) Allocs() uint64 {
+	return s.Numbers + s.Strings + s.Arrays + s.Hashes + s.Closures +
+		s.Upvalues + s.Iterators + s.Errors
+}
+
+// Stats returns the allocation counts of vm and the current Go heap
+// statistics. It is safe to call while the VM runs.
+func (vm *VM) Stats() Stats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	c := vm.allocs
+	return Stats{
+		Numbers:   c.numbers.Load(),
+		Strings:   c.strings.Load(),
+		Arrays:    c.arrays.Load(),
+		Hashes:    c.hashes.Load(),
+		Closures:  c.closures.Load(),
+		Upvalues:  c.upvalues.Load(),
+		Iterators: c.iterators.Load(),
+		Errors:    c.errors.Load(),
+		Calls:     c.calls.Load(),
+
+		HeapAlloc:   m.HeapAlloc,
+		HeapObjects: m.HeapObjects,
+		TotalAlloc:  m.TotalAlloc,
+		NumGC:       m.NumGC,
+		PauseTotal:  time.Duration(m.PauseTotalNs),
+	}
+}
+
+// WriteTo writes s in a few human readable lines. The heap and gc lines
+// are labelled as the whole process's, not the VM's.
+func (s Stats) WriteTo(w io.Writer) (int64, error) {
+	n, err := fmt.Fprintf(w,
+		"allocations: %d (numbers %d, strings %d, arrays %d, hashes %d, closures %d, upvalues %d, iterators %d, errors %d)\n"+
+			"calls: %d\n"+
+			"process heap: %s live in %d objects, %s allocated in total\n"+
+			"process gc: %d collections, %s paused\n",
+		s.Allocs(), s.Numbers, s.Strings, s.Arrays, s.Hashes, s.Closures, s.Upvalues, s.Iterators, s.Errors,
+		s.Calls,
+		formatBytes(s.HeapAlloc), s.HeapObjects, formatBytes(s.TotalAlloc),
+		s.NumGC, s.PauseTotal)
+	return int64(n), err
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
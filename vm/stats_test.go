@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pecet3/hmbk-script/compiler"
+	"github.com/pecet3/hmbk-script/object"
+)
+
+func TestStats(t *testing.T) {
+	input := `
+mut s = "";
+for (i in range(10)) { s = s + "a" }
+mut f = fn(x) { fn() { x } };
+f(1)();
+[1, 2];
+{"a": 1};
+try { throw "x" } catch (e) { e }
+1 + 2;
+-1;
+`
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	// calls from builtin modules count too
+	f, _ := comp.SymbolTable().Resolve("f")
+	vm.Call(vm.Globals()[f.Index], &object.Number{Value: 2})
+
+	stats := vm.Stats()
+	expected := Stats{
+		Numbers:   2,
+		Strings:   10,
+		Arrays:    1,
+		Hashes:    1,
+		Closures:  3,
+		Upvalues:  2,
+		Iterators: 1,
+		Errors:    1,
+		Calls:     3,
+	}
+	got := stats
+	got.HeapAlloc, got.HeapObjects, got.TotalAlloc, got.NumGC, got.PauseTotal = 0, 0, 0, 0, 0
+	if got != expected {
+		t.Errorf("wrong stats.\nwant=%+v\ngot=%+v", expected, got)
+	}
+	if stats.Allocs() != 21 {
+		t.Errorf("wrong number of allocations. want=21, got=%d", stats.Allocs())
+	}
+	if stats.HeapAlloc == 0 || stats.TotalAlloc < stats.HeapAlloc {
+		t.Errorf("implausible heap stats: %+v", stats)
+	}
+
+	var out strings.Builder
+	stats.WriteTo(&out)
+	if !strings.HasPrefix(out.String(), "allocations: 21 (numbers 2, strings 10,") ||
+		!strings.Contains(out.String(), "\nprocess heap: ") || !strings.Contains(out.String(), "\nprocess gc: ") {
+		t.Errorf("wrong report:\n%s", out.String())
+	}
+}
@@ -2,9 +2,12 @@ package vm
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/pecet3/hmbk-script/ast"
+	"github.com/pecet3/hmbk-script/code"
 	"github.com/pecet3/hmbk-script/compiler"
 	"github.com/pecet3/hmbk-script/lexer"
 	"github.com/pecet3/hmbk-script/object"
@@ -17,13 +20,13 @@ func parse(input string) *ast.Program {
 	return p.ParseProgram()
 }
 func testIntegerObject(expected int64, actual object.Object) error {
-	result, ok := actual.(*object.Integer)
+	result, ok := actual.(*object.Number)
 	if !ok {
-		return fmt.Errorf("object is not Integer. got=%T (%+v)",
+		return fmt.Errorf("object is not Number. got=%T (%+v)",
 			actual, actual)
 	}
-	if result.Value != expected {
-		return fmt.Errorf("object has wrong value. got=%d, want=%d",
+	if result.Value != float64(expected) {
+		return fmt.Errorf("object has wrong value. got=%g, want=%d",
 			result.Value, expected)
 	}
 	return nil
@@ -160,6 +163,13 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"5 * 2 + 10", 20},
 		{"5 + 2 * 10", 25},
 		{"5 * (2 + 10)", 60},
+		{"-5", -5},
+		{"10 % 3", 1},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"(-2) ** 2", 4},
+		{"2 ** -1", 0.5},
 	}
 	runVmTests(t, tests)
 }
@@ -183,6 +193,23 @@ func TestBooleanExpressions(t *testing.T) {
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
 		{"!(if (false) { 5; })", true},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || true", true},
+		{"true || false", true},
+		{"false || false", false},
+		{"1 < 2 && 2 < 3 || false", true},
+		{"1 || (if (false) { 1 })", true},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" == "b"`, false},
+		{`is_err(error("e")) == true`, true},
 	}
 	runVmTests(t, tests)
 }
@@ -258,3 +285,519 @@ func TestIndexExpressions(t *testing.T) {
 	}
 	runVmTests(t, tests)
 }
+
+func TestStringInterpolation(t *testing.T) {
+	tests := []vmTestCase{
+		{`"a ${1 + 2} b"`, "a 3 b"},
+		{`mut name = "world"; "Hello ${name}!"`, "Hello world!"},
+		{`"${[1, 2][0]}${true}"`, "1true"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"mut i = 0; mut n = 0; while (i < 5) { i = i + 1; n = n + 2; } n", 10},
+		{"mut i = 0; while (true) { i = i + 1; if (i == 3) { break; } } i", 3},
+		{"mut sum = 0; for (x in [1, 2, 3]) { sum = sum + x; } sum", 6},
+		{"mut sum = 0; for (i, x in [10, 20]) { sum = sum + i * x; } sum", 20},
+		{"mut sum = 0; for (x in [1, 2, 3, 4]) { if (x % 2 == 0) { continue; } sum = sum + x; } sum", 4},
+		{"mut sum = 0; for (k, v in {1: 10, 2: 20}) { sum = sum + k * v; } sum", 50},
+		{`mut s = ""; for (c in "abc") { s = c + s; } s`, "cba"},
+		{"mut n = 0; for (x in [1, 2]) { for (y in [1, 2, 3]) { if (y == 2) { break; } n = n + 1; } } n", 2},
+		{"mut x = 5; for (x in range(2)) {} x", 5},
+		{"mut k = 5; for (k, v in [1, 2]) { k = 9; } k", 5},
+		{"mut f = fn() { mut x = 7; for (x in range(3)) { mut y = x; } x + y }; f()", 9},
+	}
+	runVmTests(t, tests)
+}
+
+func TestIndexAssignment(t *testing.T) {
+	tests := []vmTestCase{
+		{"mut a = [1, 2, 3]; a[1] = 5; a[1]", 5},
+		{"mut a = [1, 2, 3]; mut b = a; b[0] = 9; a[0]", 9},
+		{`mut h = {"a": 1}; h["b"] = 2; h["a"] + h["b"]`, 3},
+		{`mut h = {"a": 1}; h.a = 7; h.a`, 7},
+		{`mut h = {"user": {"age": 1}}; h["user"]["age"] = 30; h.user.age`, 30},
+		{"mut a = [0, 0]; for (i, x in a) { a[i] = i + 10; } a[0] + a[1]", 21},
+		{`mut r = ""; try { mut a = [1]; a[3] = 2; } catch (e) { r = e.message; } r`, "index 3 out of range for array of length 1"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []vmTestCase{
+		{`mut r = 0; try { r = 1; } catch (e) { r = 2; } r`, 1},
+		{`mut r = ""; try { r = 1 / 0; } catch (e) { r = e.message; } r`, "division by zero"},
+		{`mut r = ""; try { throw "boom"; } catch (e) { r = "${e.kind}: ${e.message}"; } r`, "error: boom"},
+		{`mut r = 0; try { throw "x"; } catch { r = 5; } r`, 5},
+		{`mut log = ""; try { try { throw "a"; } finally { log = log + "f"; } } catch (e) { log = log + e.message; } log`, "fa"},
+		{`mut log = ""; try { try { throw "a"; } catch (e) { throw e; } finally { log = log + "f"; } } catch (e) { log = log + e.message; } log`, "fa"},
+		{`mut log = ""; try { log = "t"; } catch (e) { log = "c"; } finally { log = log + "f"; } log`, "tf"},
+		{`mut n = 0; for (x in [1, 2, 3]) { try { if (x == 2) { continue; } n = n + x; } finally { n = n + 10; } } n`, 34},
+		{`mut n = 0; while (true) { try { break; } finally { n = 1; } } n`, 1},
+		{`mut n = 0; while (true) { try { break; } catch (e) { n = 2; } } try { throw "after"; } catch (e) { n = n + 5; } n`, 5},
+		{`mut a = [1, 2]; mut r = 0; for (x in a) { try { r = r + [1][x]; r = r + 1 / 0; } catch (e) { r = r + 100; } } r`, 200},
+	}
+	runVmTests(t, tests)
+}
+
+func TestUncaughtThrow(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`try { throw "first"; } finally { 1; } 2;`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err == nil || err.Error() != "first" {
+		t.Fatalf("expected uncaught error %q. got=%v", "first", err)
+	}
+}
+
+func TestOperatorErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"a" - "b"`, "unknown operator: STRING - STRING"},
+		{`"a" < 1`, "unknown operator: STRING < NUMBER"},
+		{`1 <= true`, "type mismatch: NUMBER <= BOOL"},
+		{`true * false`, "unknown operator: BOOL * BOOL"},
+		{`-true`, "unknown operator: -BOOL"},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		if _, err := runBytecode(comp.Bytecode()); !strings.Contains(err, tt.expected) {
+			t.Errorf("input %q: wrong error. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestBlockDeclarations(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		{"mut a = 1; if (true) { mut a = 2 }; a", 2},
+		{"mut a = 1; if (false) { mut a = 2 }; a", 1},
+		{"mut a = 1; mut f = fn() { if (false) { mut a = 2 }; a }; f()", 1},
+		{"mut a = 1; mut f = fn() { if (true) { mut a = 2 }; a }; f() + a", 3},
+		{"mut a = 1; mut f = fn() { if (false) { mut a = 2 }; a = 5 }; f(); a", 5},
+		{"mut f = fn(n) { if (n) { mut b = 3 }; fn() { b } }; f(true)()", 3},
+	})
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"if (false) { mut z = 1 }; z", "identifier not found: z"},
+		{"if (false) { mut z = 1 }; z = 2", "assignment to undefined variable: z"},
+		// the slot of z still holds 1 from the first call
+		{"mut f = fn(n) { if (n) { mut z = 1 }; z }; f(true); f(false)", "identifier not found: z"},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		if _, err := runBytecode(comp.Bytecode()); !strings.Contains(err, tt.expected) {
+			t.Errorf("input %q: wrong error. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{`len("")`, 0},
+		{`len("four")`, 4},
+		{`len([1, 2, 3])`, 3},
+		{`len(range(5))`, 5},
+		{`typeof(1)`, "number"},
+		{`to_string(12)`, "12"},
+		{`to_number("3") + 1`, 4},
+		{`mut a = [1]; append(a, 2, 3); a`, []int{1, 2, 3}},
+		{`mut a = [1, 2, 3]; delete_index(a, 0); a`, []int{2, 3}},
+		{`is_err(error("boom"))`, true},
+		{`is_err(1)`, false},
+		{`print("hello")`, Null},
+		{`mut f = fn(xs) { len(xs) * 2 }; f([1, 2])`, 4},
+		{`try { len(1); } catch (e) { e.message }`, "argument to `len` not supported, got NUMBER"},
+		{`try { len(1, 2); } catch (e) { e.kind }`, "runtime"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestModules(t *testing.T) {
+	tests := []vmTestCase{
+		{"module m {\n @ const a = 1\n}\nm.a", 1},
+		{"const base = 10\nmodule m {\n @ const add = fn(x) { x + base }\n}\nm.add(5)", 15},
+		{"module m {\n mut x = 1\n @ const get = fn() { x }\n @ const inc = fn() { x = x + 1 }\n}\nmut x = 100\nm.inc()\nm.inc()\nm.get() + x", 103},
+		{"module m {\n @ const a = 1\n}\nmut f = fn() { m.a + 1 }\nf()", 2},
+		{"typeof(http.get)", "builtin"},
+	}
+	runVmTests(t, tests)
+
+	comp := compiler.New()
+	if err := comp.Compile(parse("http.nope")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if _, err := runBytecode(comp.Bytecode()); !strings.Contains(err, "builtin module http has no symbol nope") {
+		t.Errorf("wrong error for a missing module symbol. got=%q", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("mut g = 10\nmut add = fn(a, b) { a + b + g }\nmut fail = fn() { throw \"boom\" }"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 13, vm.Call(vm.Globals()[1], &object.Number{Value: 1}, &object.Number{Value: 2}))
+	result, ok := vm.Call(vm.Globals()[2]).(*object.GlobalError)
+	if !ok || result.Message != "boom" || result.Pos.String() != "3:19" {
+		t.Errorf("expected GlobalError boom at 3:19, got=%v", result)
+	}
+}
+
+// TestConcurrentCalls calls into the script from many goroutines, as the
+// http module does; run it with -race.
+func TestConcurrentCalls(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("mut hits = 0\nmut last = 0\nmut handle = fn(n) { mut twice = n * 2; hits = hits + 1; last = n; twice }"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	handle := vm.Globals()[2]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result := vm.Call(handle, &object.Number{Value: float64(i)})
+			if n, ok := result.(*object.Number); !ok || n.Value != float64(2*i) {
+				t.Errorf("call %d: got %v, want %d", i, result, 2*i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCallingFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{"mut f = fn() { 5 + 10; }; f();", 15},
+		{"mut one = fn() { 1; }; mut two = fn() { 2; }; one() + two()", 3},
+		{"mut a = fn() { 1 }; mut b = fn() { a() + 1 }; mut c = fn() { b() + 1 }; c();", 3},
+		{"mut f = fn() { return 99; 100; }; f();", 99},
+		{"mut f = fn() { if (true) { return 1; } 2 }; f();", 1},
+		{"mut f = fn() { }; f();", Null},
+		{"mut f = fn(a, b) { mut c = a + b; c }; f(1, 2) + f(3, 4);", 10},
+		{"mut g = 10; mut f = fn(a) { mut b = 2; g + a + b }; f(1) + f(2);", 27},
+		{"mut f = fn() { mut n = 0; for (x in [1, 2, 3]) { n = n + x; } n }; f();", 6},
+		{"mut f = fn() { for (x in [1, 2, 3]) { if (x == 2) { return x; } } 0 }; f();", 2},
+		{"mut g = 0; mut f = fn() { try { return 1; } finally { g = 5; } }; f() + g;", 6},
+		{"mut f = fn() { throw \"x\" }; mut r = 0; try { f(); } catch (e) { r = 7; } r", 7},
+		{"mut f = fn() { try { throw \"x\" } catch (e) { return 3; } }; mut r = 0; try { r = f(); 1 / 0; } catch (e) { r = r + 1; } r", 4},
+	}
+	runVmTests(t, tests)
+}
+
+func TestCallingFunctionsWithWrongArguments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"fn() { 1; }(1);", "wrong number of arguments. got=1, want=0"},
+		{"fn(a) { a; }();", "wrong number of arguments. got=0, want=1"},
+		{"mut x = 1; x();", "not a function: NUMBER"},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong VM error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{"mut newClosure = fn(a) { fn() { a; }; }; mut closure = newClosure(99); closure();", 99},
+		{"mut newAdder = fn(a, b) { fn(c) { a + b + c }; }; mut adder = newAdder(1, 2); adder(8);", 11},
+		{"mut newAdder = fn(a) { fn(b) { fn(c) { a + b + c } } }; newAdder(1)(2)(3);", 6},
+		{"mut counter = fn() { mut n = 0; fn() { n = n + 1; n } }; mut c = counter(); c(); c(); c();", 3},
+		{"mut fs = [0, 0]; for (i, x in [1, 2]) { fs[i] = fn() { x * 10 }; } fs[0]() + fs[1]()", 40},
+		{"mut f = fn() { mut fs = [0, 0]; for (i, x in [1, 2]) { fs[i] = fn() { x * 10 }; } fs[0]() + fs[1]() }; f()", 40},
+		{"mut f = fn() { mut a = 1; mut g = fn() { a }; a = 2; g() }; f()", 2},
+		{"mut f = fn() { mut a = 1; mut set = fn() { a = 5; }; set(); a }; f()", 5},
+		{"mut f = fn() { mut n = 0; mut inc = fn() { n = n + 1; }; mut get = fn() { n }; [inc, get] }; mut p = f(); p[0](); p[0](); p[1]()", 2},
+		{"mut f = fn() { mut n = 0; fn() { fn() { n = n + 1; n } } }; mut g = f()(); g(); g()", 2},
+		// a function assigning to its own name assigns to its binding
+		{"mut g = fn() { g = 5; }; g(); g", 5},
+		{"mut g = fn() { fn() { g = 6; }(); }; g(); g", 6},
+		{"mut f = fn() { mut g = fn() { g = 7; }; g(); g }; f()", 7},
+		{"mut g = fn(n) { if (n == 0) { g = 8; return 0; } g(n - 1) + 1 }; [g(2), g]", []int{2, 8}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{"const countDown = fn(x) { if (x == 0) { return 0; } countDown(x - 1); }; countDown(1);", 0},
+		{"mut fib = fn(x) { if (x < 2) { return x; } fib(x - 1) + fib(x - 2) }; fib(15);", 610},
+		{"mut wrapper = fn() { mut countDown = fn(x) { if (x == 0) { return 0; } countDown(x - 1); }; countDown(1); }; wrapper();", 0},
+	}
+	runVmTests(t, tests)
+}
+
+func TestOptimizedProgramsBehaveTheSame(t *testing.T) {
+	inputs := []string{
+		`1 + 2 * 3 - 4 / 2`,
+		`-(2 ** 10) % 7`,
+		`"a" + "b" == "ab"`,
+		`mut s = "x"; s == "x"`,
+		`!(1 > 2) != false`,
+		`if (1 > 2) { 10 } else { 20 }`,
+		`if (false) { 10 }`,
+		`mut f = fn(x) { if (x > 1) { return "big"; 1 } "small" }; f(2) + f(1)`,
+		`mut total = 0; for (x in range(10)) { if (x % 2 == 0) { continue } total = total + x }
+total`,
+		`mut i = 0; while (true) { i = i + 1; if (i == 5) { break } }
+i`,
+		`mut i = 0; while (false) { i = i + 1 }
+i`,
+		`try { 1 / 0 } catch (e) { e.message }`,
+		`try { throw "a" + "b" } catch (e) { e.message } finally { 3 }`,
+		`mut make = fn(n) { fn() { n + 1 + 2 } }; make(1)()`,
+		`[1 + 1, "a" + "b", 2 * 2][2]`,
+		`{"k" + "ey": 1 + 1}["key"]`,
+		`true && 1 > 2 || "s" == "s"`,
+		`1 / 0`,
+		`mut n = 3; n - 1 + n * 2 / 4 % 5 ** 2`,
+		`mut s = "a"; s + "b"`,
+		`mut a = 1; mut b = 2; if (a == b) { 1 } else { if (a != b) { if (b >= a) { 3 } } }`,
+		`mut x = "s"; x > 1`,
+		`mut x = "s"; x - 1`,
+	}
+	for _, input := range inputs {
+		p := parser.New(lexer.New(input))
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			t.Fatalf("input %q: parser errors: %v", input, p.Errors())
+		}
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		optimized, err := compiler.Optimize(comp.Bytecode())
+		if err != nil {
+			t.Fatalf("optimizer error: %s", err)
+		}
+		super, err := compiler.Superinstructions(optimized)
+		if err != nil {
+			t.Fatalf("superinstructions error: %s", err)
+		}
+		want, wantErr := runBytecode(comp.Bytecode())
+		got, gotErr := runBytecode(optimized)
+		if want != got || wantErr != gotErr {
+			t.Errorf("input %q: optimized result %q (error %q), want %q (error %q)",
+				input, got, gotErr, want, wantErr)
+		}
+		got, gotErr = runBytecode(super)
+		if want != got || wantErr != gotErr {
+			t.Errorf("input %q: result with superinstructions %q (error %q), want %q (error %q)",
+				input, got, gotErr, want, wantErr)
+		}
+		if len(optimized.Instructions) > len(comp.Bytecode().Instructions) {
+			t.Errorf("input %q: optimized code is longer", input)
+		}
+	}
+}
+
+// TestErrorPositions checks that caught errors carry the position the
+// evaluator reports for them, with and without -O.
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int // line * 100 + column
+	}{
+		{"mut r = 0;\ntry { throw \"inner\"; } catch (e) { r = e.line * 100 + e.column; } r", 207},
+		{"mut z = 0;\nmut r = 0;\ntry {\n  r = 1 +\n   10 / z;\n} catch (e) { r = e.line * 100 + e.column; } r", 507},
+		{"mut r = 0;\ntry { mut n =   len(1, 2); } catch (e) { r = e.line * 100 + e.column; } r", 220},
+		{"mut f = fn() {\n  mut a = [1];\n    a[5] = 1;\n};\nmut r = 0;\ntry { f(); } catch (e) { r = e.line * 100 + e.column; } r", 306},
+		{"mut r = 0;\ntry {\n   throw error(\"bad\", \"ValueError\");\n} catch (e) { r = e.line * 100 + e.column; } r", 304},
+		{"mut r = 0;\nmut x = true;\ntry { r = -x; } catch (e) { r = e.line * 100 + e.column; } r", 311},
+		// a rethrown error keeps the position where it was first raised
+		{"mut r = 0;\ntry { try { throw \"x\"; } catch (e) { throw e; } } catch (e) { r = e.line * 100 + e.column; } r", 213},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		optimized, err := compiler.Optimize(comp.Bytecode())
+		if err == nil {
+			optimized, err = compiler.Superinstructions(optimized)
+		}
+		if err != nil {
+			t.Fatalf("optimizer error: %s", err)
+		}
+		for _, b := range []*compiler.Bytecode{comp.Bytecode(), optimized} {
+			got, err := runBytecode(b)
+			if err != "" {
+				t.Fatalf("vm error: %s", err)
+			}
+			if got != fmt.Sprint(tt.expected) {
+				t.Errorf("input %q: wrong position. want=%d, got=%s", tt.input, tt.expected, got)
+			}
+		}
+	}
+}
+
+// TestTraceback checks that uncaught errors name the calls they went
+// through, also when they were caught and rethrown on the way.
+func TestTraceback(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 / 0", "GLOBAL ERROR: 1:3: division by zero"},
+		{"mut f = fn() {\n  1 / 0\n};\nf();",
+			"GLOBAL ERROR: 2:5: division by zero\n    at f (2:5)\n    at <main> (4:2)"},
+		{"mut f = fn() { throw \"x\" };\nmut g = fn() {\n  try { f() } catch (e) { throw e }\n};\ng();",
+			"GLOBAL ERROR: 1:16: x\n    at f (1:16)\n    at g (3:10)\n    at <main> (5:2)"},
+		{"mut f = fn() { [][1] };\nmut g = fn() {\n  try { f() } catch (e) { e }\n  throw \"y\";\n};\ng();",
+			"GLOBAL ERROR: 4:3: y\n    at g (4:3)\n    at <main> (6:2)"},
+	}
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.Bytecode())
+		err := vm.Run()
+		if err == nil {
+			t.Fatalf("input %q: no error", tt.input)
+		}
+		if got := vm.GlobalError(err).Traceback(); got != tt.expected {
+			t.Errorf("input %q: wrong traceback. want=\n%s\ngot=\n%s", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func runBytecode(bytecode *compiler.Bytecode) (string, string) {
+	vm := New(bytecode)
+	if err := vm.Run(); err != nil {
+		return "", err.Error()
+	}
+	return vm.stack[vm.sp].Inspect(), ""
+}
+
+func TestWideOperands(t *testing.T) {
+	// enough statements for more than 65535 constants and 64 KiB of code
+	var body strings.Builder
+	sum := 0
+	for i := 0; i < 70000; i++ {
+		fmt.Fprintf(&body, "x = x + %d;\n", i%3)
+		sum += i % 3
+	}
+	// and more than 65535 globals
+	var globals strings.Builder
+	names := make([]string, 66000)
+	for i := range names {
+		for n := i; ; n = n/26 - 1 {
+			names[i] = string(rune('a'+n%26)) + names[i]
+			if n < 26 {
+				break
+			}
+		}
+		fmt.Fprintf(&globals, "mut v%s = %d;\n", names[i], i)
+	}
+	// and more than 255 locals, parameters, arguments and free variables,
+	// whose operands are 1 byte wide
+	const many = 300
+	var locals, params, args, terms strings.Builder
+	for i := 0; i < many; i++ {
+		fmt.Fprintf(&locals, "mut v%s = %d;\n", names[i], i)
+		fmt.Fprintf(&params, "p%s, ", names[i])
+		fmt.Fprintf(&args, "%d, ", i)
+		fmt.Fprintf(&terms, "v%s + ", names[i])
+	}
+	last := "v" + names[many-1]
+	manySum := many * (many - 1) / 2
+
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"mut x = 0;\nif (x == 0) {\n" + body.String() + "} else {\nx = -1\n}\nx", sum},
+		{"mut x = 0;\nmut i = 0;\nwhile (i < 2) {\n" + body.String() + "i = i + 1\n}\nx", 2 * sum},
+		{"mut x = 0;\nmut f = fn() {\n" + body.String() + "x\n};\nf() + 1", sum + 1},
+		{globals.String() + "v" + names[len(names)-1] + " + v" + names[0], len(names) - 1},
+		{"mut f = fn() {\n" + locals.String() + last + " = " + last + " + 1;\n" + last + "\n};\nf()", many},
+		{"mut f = fn(" + strings.TrimSuffix(params.String(), ", ") + ") { p" + names[0] + " + p" + names[many-1] + " };\nf(" + strings.TrimSuffix(args.String(), ", ") + ")", many - 1},
+		{"mut f = fn() {\n" + locals.String() + "fn() { fn() { " + last + " = " + last + " + 1; " + terms.String() + "0 } }\n};\nf()()()", manySum + 1},
+	}
+	for _, tt := range tests {
+		p := parser.New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			t.Fatalf("parser errors: %v", p.Errors()[:1])
+		}
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.Bytecode()
+		optimized, err := compiler.Optimize(bytecode)
+		if err != nil {
+			t.Fatalf("optimizer error: %s", err)
+		}
+		for _, b := range []*compiler.Bytecode{bytecode, optimized} {
+			got, err := runBytecode(b)
+			if err != "" {
+				t.Fatalf("vm error: %s", err)
+			}
+			if got != fmt.Sprint(tt.expected) {
+				t.Errorf("wrong result. want=%d, got=%s", tt.expected, got)
+			}
+		}
+	}
+}
+
+func TestInvalidOperands(t *testing.T) {
+	tests := []struct {
+		ins      []code.Instructions
+		expected string
+	}{
+		{[]code.Instructions{code.Make(code.OpGetBuiltin, 255)}, "builtin index out of range: 255"},
+		{[]code.Instructions{code.Make(code.OpGetBuiltinModule, 255)}, "builtin module index out of range: 255"},
+		{[]code.Instructions{code.Make(code.OpTrue), code.Make(code.OpBinaryConst, 7, int(code.OpAdd))}, "constant index out of range: 7"},
+		{[]code.Instructions{code.Make(code.OpTrue), code.Make(code.OpSetGlobal, 0xFFFFFFFF)}, "global index out of range: 4294967295"},
+	}
+	for _, tt := range tests {
+		ins := code.Instructions{}
+		for _, in := range tt.ins {
+			ins = append(ins, in...)
+		}
+		vm := New(&compiler.Bytecode{Instructions: ins})
+		err := vm.Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+}